@@ -0,0 +1,277 @@
+package art
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+var nodeSizes = [...]int64{
+	typeNode4:   int64(unsafe.Sizeof(node4{})),
+	typeNode16:  int64(unsafe.Sizeof(node16{})),
+	typeNode48:  int64(unsafe.Sizeof(node48{})),
+	typeNode256: int64(unsafe.Sizeof(node256{})),
+}
+
+// MemStats is the memory used by nodes of ART, broken down by node type.
+type MemStats struct {
+	Node4   NodeStats
+	Node16  NodeStats
+	Node48  NodeStats
+	Node256 NodeStats
+	Leaf    NodeStats
+	// Arena is the bytes of slabs allocated by arena, which include the memory of removed nodes and leaves.
+	Arena int64
+}
+
+// NodeStats is the number and total bytes of a type of node.
+type NodeStats struct {
+	Count int64
+	Bytes int64
+}
+
+// Total returns the total bytes used by all nodes.
+func (s *MemStats) Total() int64 {
+	return s.Node4.Bytes + s.Node16.Bytes + s.Node48.Bytes + s.Node256.Bytes + s.Leaf.Bytes
+}
+
+// allocator keeps track of the nodes reachable from the root of a tree.
+// Nodes are counted when they are created by writers, and uncounted when they are retired from the tree.
+type allocator struct {
+	counts [typeDummy]int64
+	bytes  [typeDummy]int64
+	// arena is nil if the tree doesn't use arena.
+	arena *arena
+	// reclaim is nil if the tree doesn't reuse nodes.
+	reclaim *reclaimer
+	// inPlace is true if leaves have headers, and their values are overwritten if they fit in the leaves.
+	inPlace bool
+}
+
+func (a *allocator) add(nodeType uint8, size int64) {
+	atomic.AddInt64(&a.counts[nodeType], 1)
+	atomic.AddInt64(&a.bytes[nodeType], size)
+}
+
+func (a *allocator) sub(nodeType uint8, size int64) {
+	atomic.AddInt64(&a.counts[nodeType], -1)
+	atomic.AddInt64(&a.bytes[nodeType], -size)
+}
+
+func (a *allocator) load(nodeType uint8) NodeStats {
+	return NodeStats{
+		Count: atomic.LoadInt64(&a.counts[nodeType]),
+		Bytes: atomic.LoadInt64(&a.bytes[nodeType]),
+	}
+}
+
+func (a *allocator) stats() MemStats {
+	s := MemStats{
+		Node4:   a.load(typeNode4),
+		Node16:  a.load(typeNode16),
+		Node48:  a.load(typeNode48),
+		Node256: a.load(typeNode256),
+		Leaf:    a.load(typeLeaf),
+	}
+	if a.arena != nil {
+		s.Arena = a.arena.size()
+	}
+	return s
+}
+
+// allocNode returns an empty inner node of nodeType.
+// The node is reused from free list or allocated from arena if the tree has them.
+func (a *allocator) allocNode(nodeType uint8) *node {
+	if a.reclaim != nil {
+		if n := a.reclaim.alloc(nodeType); n != nil {
+			return n
+		}
+	}
+	if a.arena != nil {
+		n := (*node)(unsafe.Pointer(&a.arena.alloc(int(nodeSizes[nodeType]))[0]))
+		n.nodeType = nodeType
+		n.arena = true
+		if nodeType == typeNode48 {
+			(*node48)(unsafe.Pointer(n)).slots = node48EmptySlots
+		}
+		return n
+	}
+	switch nodeType {
+	case typeNode4:
+		return newNode4().toNode()
+	case typeNode16:
+		return newNode16().toNode()
+	case typeNode48:
+		return newNode48().toNode()
+	case typeNode256:
+		return newNode256().toNode()
+	default:
+		panic("unreachable code")
+	}
+}
+
+// newNode returns an empty inner node of nodeType created by this writer.
+func (w writer) newNode(nodeType uint8) *node {
+	n := w.alloc.allocNode(nodeType)
+	n.epoch = w.epoch
+	w.alloc.add(nodeType, nodeSizes[nodeType])
+	return n
+}
+
+func (w writer) newNode4() *node4 {
+	return (*node4)(unsafe.Pointer(w.newNode(typeNode4)))
+}
+
+func (w writer) newNode16() *node16 {
+	return (*node16)(unsafe.Pointer(w.newNode(typeNode16)))
+}
+
+func (w writer) newNode48() *node48 {
+	return (*node48)(unsafe.Pointer(w.newNode(typeNode48)))
+}
+
+func (w writer) newNode256() *node256 {
+	return (*node256)(unsafe.Pointer(w.newNode(typeNode256)))
+}
+
+// newNodeWithSize returns the smallest node which can hold size children.
+func (w writer) newNodeWithSize(size int) *node {
+	return w.newNode(nodeTypeWithSize(size))
+}
+
+func (w writer) newLeaf(key []byte, value []byte) *leaf {
+	if w.alloc.inPlace {
+		return w.newMutableLeaf(key, value)
+	}
+	var l *leaf
+	if a := w.alloc.arena; a != nil {
+		l = initLeaf(a.alloc(leafSize(key, value)), key, value)
+	} else {
+		l = newLeaf(key, value)
+	}
+	w.alloc.add(typeLeaf, l.size())
+	return l
+}
+
+// newMutableLeaf returns a leaf with header, which is allocated from arena if the tree uses it.
+func (w writer) newMutableLeaf(key []byte, value []byte) *leaf {
+	size := mutableLeafSize(key, value)
+	var mem []byte
+	if a := w.alloc.arena; a != nil {
+		mem = a.alloc(size)
+	} else {
+		mem = allocMutableLeaf(size)
+	}
+	l := initMutableLeaf(mem, key, value, w.epoch)
+	w.alloc.add(typeLeaf, l.mutableSize())
+	return l
+}
+
+// updateLeaf overwrites the value of l, l must be held by a node locked by this writer.
+// It returns false if the tree doesn't update in place, value doesn't fit in l,
+// or l maybe reachable from snapshots. Nothing is allocated if it returns true.
+func (w writer) updateLeaf(l *leaf, value []byte) bool {
+	if !w.alloc.inPlace || l.header().epoch < w.frozenEpoch || len(value) > int(l.header().capacity) {
+		return false
+	}
+	l.overwriteValue(value)
+	return true
+}
+
+// leafValue returns the value of l which is safe to retain by users.
+// The values of trees which update in place maybe overwritten, so they are copied.
+func (a *allocator) leafValue(l *leaf) []byte {
+	if a.inPlace {
+		return l.appendValue([]byte{})
+	}
+	return l.value()
+}
+
+// appendLeafValue appends the value of l to dst.
+func (a *allocator) appendLeafValue(dst []byte, l *leaf) []byte {
+	if a.inPlace {
+		return l.appendValue(dst)
+	}
+	return append(dst, l.value()...)
+}
+
+// clone returns an unlocked copy of n which is created by this writer.
+func (w writer) clone(n *node) *node {
+	c := w.newNode(n.nodeType)
+	version := c.version
+	if n.arena {
+		// the slots hold arenaRef, copy them as bytes so GC never sees them.
+		size := int(nodeSizes[n.nodeType])
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(c)), size), unsafe.Slice((*byte)(unsafe.Pointer(n)), size))
+		c.version = version
+		c.epoch = w.epoch
+		return c
+	}
+	switch n.nodeType {
+	case typeNode4:
+		*(*node4)(unsafe.Pointer(c)) = *(*node4)(unsafe.Pointer(n))
+	case typeNode16:
+		*(*node16)(unsafe.Pointer(c)) = *(*node16)(unsafe.Pointer(n))
+	case typeNode48:
+		*(*node48)(unsafe.Pointer(c)) = *(*node48)(unsafe.Pointer(n))
+	case typeNode256:
+		*(*node256)(unsafe.Pointer(c)) = *(*node256)(unsafe.Pointer(n))
+	}
+	c.version = version
+	c.epoch = w.epoch
+	return c
+}
+
+// freeLeaf uncount l which has been removed from tree.
+func (w writer) freeLeaf(l *leaf) {
+	if w.alloc.inPlace {
+		w.alloc.sub(typeLeaf, l.mutableSize())
+		return
+	}
+	w.alloc.sub(typeLeaf, l.size())
+}
+
+// retire uncount and unlock n which has been removed from tree, its children is not affected.
+// A frozen node is still used by snapshots, so it is not marked as obsolete and never reused.
+// Operations reached it before removal will fail to validate its parent.
+func (w writer) retire(n *node) {
+	w.alloc.sub(n.nodeType, nodeSizes[n.nodeType])
+	if w.frozen(n) {
+		n.unlock()
+		return
+	}
+	n.unlockObsolete()
+	if r := w.alloc.reclaim; r != nil {
+		r.retire(n)
+	}
+}
+
+// retireDetached retire n which maybe a leaf or a locked inner node, and all nodes in its subtree.
+func (w writer) retireDetached(n *node) {
+	if n.nodeType == typeLeaf {
+		w.freeLeaf((*leaf)(unsafe.Pointer(n)))
+	} else {
+		w.retireTree(n)
+	}
+}
+
+// retireTree retire n and all nodes in its subtree, which has been detached from tree.
+// n must be locked by caller. Every inner node in the subtree is locked before retire,
+// so the writers reached the subtree before detach will finish or fail before it is uncounted.
+func (w writer) retireTree(n *node) {
+	if l := n.loadPrefixLeaf(); l != nil {
+		w.freeLeaf(l)
+	}
+	for k := 0; k < 256; k++ {
+		c, ck := n.seekChild(k)
+		if c == nil {
+			break
+		}
+		if c.nodeType == typeLeaf {
+			w.freeLeaf((*leaf)(unsafe.Pointer(c)))
+		} else if c.lock(w.contention) {
+			w.retireTree(c)
+		}
+		k = ck
+	}
+	w.retire(n)
+}
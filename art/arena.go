@@ -0,0 +1,222 @@
+package art
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// DefaultSlabSize is the slab size used by WithArena when slabSize is not positive.
+const DefaultSlabSize = 4 << 20
+
+const arenaAlign = 8
+
+// arena allocates nodes and leaves from large slabs, so GC only sees a few large pointer-free objects
+// instead of one object per node and leaf.
+//
+// Like the badger skiplist arena, the nodes allocated from arena reference their children and prefixLeaf
+// by arenaRef instead of Go pointers, so slabs are byte slices which are never scanned by GC.
+// The slabs are registered in a process wide slab table to resolve refs without the arena,
+// they are released from the table once the arena is unreachable.
+// The memory of removed nodes is not reused unless the tree reuses nodes, and all slabs are freed
+// at once when the tree is dropped.
+type arena struct {
+	slabSize int
+	// curr is the slab which is used to allocate, it's *slab.
+	curr  unsafe.Pointer
+	total int64
+
+	mu    sync.Mutex
+	slabs [][]byte
+	ids   []uint32
+}
+
+type slab struct {
+	offset uint64
+	buf    []byte
+}
+
+func newArena(slabSize int) *arena {
+	if slabSize <= 0 {
+		slabSize = DefaultSlabSize
+	}
+	a := &arena{slabSize: slabSize}
+	runtime.SetFinalizer(a, (*arena).release)
+	return a
+}
+
+// alloc returns size bytes of zeroed memory which is aligned to 8 bytes.
+// This operation is thread safe.
+func (a *arena) alloc(size int) []byte {
+	aligned := uint64(size+arenaAlign-1) &^ (arenaAlign - 1)
+	// large objects use their own slabs, so they will not waste the rest of current slab.
+	if aligned > uint64(a.slabSize/4) {
+		return a.newSlab(int(aligned))[:size]
+	}
+	for {
+		if s := (*slab)(atomic.LoadPointer(&a.curr)); s != nil {
+			end := atomic.AddUint64(&s.offset, aligned)
+			if end <= uint64(len(s.buf)) {
+				start := end - aligned
+				return s.buf[start : start+uint64(size)]
+			}
+			a.grow(s)
+		} else {
+			a.grow(nil)
+		}
+	}
+}
+
+// grow replace the full slab old with a new slab, if no one has replaced it.
+func (a *arena) grow(old *slab) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if atomic.LoadPointer(&a.curr) != unsafe.Pointer(old) {
+		return
+	}
+	buf := a.newSlabLocked(a.slabSize)
+	atomic.StorePointer(&a.curr, unsafe.Pointer(&slab{buf: buf}))
+}
+
+func (a *arena) newSlab(size int) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.newSlabLocked(size)
+}
+
+func (a *arena) newSlabLocked(size int) []byte {
+	buf := make([]byte, size)
+	a.slabs = append(a.slabs, buf)
+	a.ids = append(a.ids, registerSlab(buf))
+	atomic.AddInt64(&a.total, int64(size))
+	return buf
+}
+
+// size returns the total bytes of slabs.
+func (a *arena) size() int64 {
+	return atomic.LoadInt64(&a.total)
+}
+
+// release removes the slabs of a from the slab table, it's called when a is unreachable.
+func (a *arena) release() {
+	releaseSlabs(a.ids)
+}
+
+// arenaRef references a node or leaf allocated from arena, it's stored in the nodes allocated from arena
+// instead of Go pointer. The high 32 bits is the id of slab and the low 32 bits is the offset in the slab.
+// The zero ref is nil, as the ids of slabs start from 1.
+type arenaRef uint64
+
+// slabTable maps the ids of slabs to their memory, and the addresses to the ids.
+// It is replaced as a whole when slabs are registered or released, so refs are resolved without lock.
+type slabTable struct {
+	// bases is the memory of slabs indexed by id, the unused ids are nil.
+	bases []unsafe.Pointer
+	// bounds is the address ranges of slabs sorted by start.
+	bounds []slabBound
+}
+
+type slabBound struct {
+	start, end uintptr
+	id         uint32
+}
+
+// slabs is the slab table of all arenas, it's *slabTable.
+var slabs struct {
+	mu    sync.Mutex
+	table unsafe.Pointer
+}
+
+func loadSlabTable() *slabTable {
+	if t := (*slabTable)(atomic.LoadPointer(&slabs.table)); t != nil {
+		return t
+	}
+	return &slabTable{}
+}
+
+// registerSlab adds buf into the slab table, and returns the id of it.
+func registerSlab(buf []byte) uint32 {
+	slabs.mu.Lock()
+	defer slabs.mu.Unlock()
+	old := loadSlabTable()
+	t := &slabTable{
+		bases:  make([]unsafe.Pointer, len(old.bases), len(old.bases)+1),
+		bounds: make([]slabBound, len(old.bounds), len(old.bounds)+1),
+	}
+	copy(t.bases, old.bases)
+	copy(t.bounds, old.bounds)
+
+	id := uint32(1)
+	for int(id) < len(t.bases) && t.bases[id] != nil {
+		id++
+	}
+	if int(id) >= len(t.bases) {
+		t.bases = append(t.bases, make([]unsafe.Pointer, int(id)+1-len(t.bases))...)
+	}
+	base := unsafe.Pointer(&buf[0])
+	t.bases[id] = base
+
+	start := uintptr(base)
+	i := sort.Search(len(t.bounds), func(i int) bool { return t.bounds[i].start > start })
+	t.bounds = append(t.bounds, slabBound{})
+	copy(t.bounds[i+1:], t.bounds[i:])
+	t.bounds[i] = slabBound{start: start, end: start + uintptr(len(buf)), id: id}
+	atomic.StorePointer(&slabs.table, unsafe.Pointer(t))
+	return id
+}
+
+// releaseSlabs removes the slabs of ids from the slab table, so their memory can be freed and the ids can be reused.
+func releaseSlabs(ids []uint32) {
+	if len(ids) == 0 {
+		return
+	}
+	slabs.mu.Lock()
+	defer slabs.mu.Unlock()
+	old := loadSlabTable()
+	t := &slabTable{
+		bases:  make([]unsafe.Pointer, len(old.bases)),
+		bounds: make([]slabBound, 0, len(old.bounds)),
+	}
+	copy(t.bases, old.bases)
+	for _, id := range ids {
+		t.bases[id] = nil
+	}
+	for _, b := range old.bounds {
+		if t.bases[b.id] != nil {
+			t.bounds = append(t.bounds, b)
+		}
+	}
+	atomic.StorePointer(&slabs.table, unsafe.Pointer(t))
+}
+
+// refOf returns the ref of p, which must point into a slab.
+func refOf(p unsafe.Pointer) arenaRef {
+	if p == nil {
+		return 0
+	}
+	bounds := loadSlabTable().bounds
+	addr := uintptr(p)
+	i := sort.Search(len(bounds), func(i int) bool { return bounds[i].end > addr })
+	if i == len(bounds) || bounds[i].start > addr {
+		panic("art: link a node not allocated from arena")
+	}
+	return arenaRef(bounds[i].id)<<32 | arenaRef(addr-bounds[i].start)
+}
+
+// pointer returns the memory referenced by r.
+func (r arenaRef) pointer() unsafe.Pointer {
+	if r == 0 {
+		return nil
+	}
+	id := int(r >> 32)
+	bases := loadSlabTable().bases
+	if id >= len(bases) || bases[id] == nil {
+		// r is loaded before the slab table without synchronization, reload the table after its slab is registered.
+		slabs.mu.Lock()
+		bases = loadSlabTable().bases
+		slabs.mu.Unlock()
+	}
+	return unsafe.Add(bases[id], int(uint32(r)))
+}
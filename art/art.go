@@ -5,7 +5,9 @@
 package art
 
 import (
+	"bytes"
 	"context"
+	"sync"
 	"unsafe"
 
 	"github.com/pingcap/failpoint"
@@ -17,52 +19,255 @@ import (
 type ART struct {
 	dummy node
 	root  *node
+
+	// epoch is the epoch of newly created nodes, it is increased by every snapshot.
+	epoch uint64
+	// frozenEpoch is the epoch of the latest alive snapshot, nodes created before it must be copied before modify.
+	frozenEpoch uint64
+	snapMu      sync.Mutex
+	snapshots   []uint64
+
+	alloc      allocator
+	contention contention
 }
 
 // OpFunc is ART query callback function.
 // If OpFunc return true the current query will terminate immediately.
 type OpFunc func(key []byte, value []byte) (end bool)
 
+// Option configures the ART created by New.
+type Option func(t *ART)
+
+// WithArena makes the tree allocate nodes and leaves from an arena of slabs of slabSize bytes,
+// DefaultSlabSize is used if slabSize is not positive. Nodes reference their children by offsets
+// in slabs instead of Go pointers, so GC doesn't scan the tree. The memory of deleted keys and replaced
+// nodes is not freed until the whole tree is dropped, unless the nodes are reused by WithReclamation.
+func WithArena(slabSize int) Option {
+	return func(t *ART) {
+		t.alloc.arena = newArena(slabSize)
+	}
+}
+
+// WithReclamation makes the tree reuse the inner nodes retired by grow, shrink and path compression.
+// Every operation enters a guard to protect the nodes it may visit, the retired nodes are put into
+// free lists of their types once no operation can visit them.
+func WithReclamation() Option {
+	return func(t *ART) {
+		t.alloc.reclaim = new(reclaimer)
+	}
+}
+
+// WithInPlaceUpdate makes the tree overwrite the value in the leaf of an existing key on update,
+// if the new value fits in the leaf, instead of allocating a new leaf with the key.
+// Leaves are rounded up to 16 bytes, the spare bytes are reserved for growing values.
+// It removes the garbage of workloads which update the same keys with values of similar size repeatedly.
+// Every leaf has a 24 bytes header with a version to detect concurrent overwrite, so Get and Iterator.Value
+// copy the value; use AppendValue with a reused buffer to read without allocation.
+// The leaves reachable from alive snapshots are never updated in place.
+func WithInPlaceUpdate() Option {
+	return func(t *ART) {
+		t.alloc.inPlace = true
+	}
+}
+
 // New create a new empty ART.
-func New() *ART {
-	return &ART{
-		dummy: node{nodeType: typeDummy},
-		root:  newNode4().toNode(),
+func New(opts ...Option) *ART {
+	t := newTree(opts)
+	t.root = t.loadWriter().newNode4().toNode()
+	return t
+}
+
+// rootLink returns the link of root, which is a Go pointer even if the tree uses arena.
+func (t *ART) rootLink() link {
+	return link{p: &t.root}
+}
+
+// enter enters a guard of node reclamation, the guard must be exited after the operation finished.
+func (t *ART) enter() guard {
+	return t.alloc.reclaim.enter()
+}
+
+func newTree(opts []Option) *ART {
+	t := &ART{dummy: node{nodeType: typeDummy}}
+	for _, opt := range opts {
+		opt(t)
 	}
+	return t
+}
+
+// Len returns the number of keys in this tree.
+// This operation is thread safe.
+func (t *ART) Len() int {
+	return int(t.alloc.load(typeLeaf).Count)
+}
+
+// MemSize returns the bytes used by nodes and leaves of this tree.
+// The nodes only reachable from snapshots are not counted.
+// This operation is thread safe.
+func (t *ART) MemSize() int64 {
+	s := t.alloc.stats()
+	return s.Total()
+}
+
+// MemStats returns the number and bytes of each type of node in this tree.
+// The counters are loaded one by one, so they maybe inconsistent with each other under concurrent update.
+// This operation is thread safe.
+func (t *ART) MemStats() MemStats {
+	return t.alloc.stats()
 }
 
 // Get lookup this tree, and return the value associate with the given key.
 // This operation is thread safe.
 func (t *ART) Get(key []byte) ([]byte, bool) {
+	defer t.enter().exit()
 	for {
-		if value, ex, ok := t.root.search(key, 0, &t.dummy, t.dummy.waitUnlock()); ok {
-			return value, ex
+		if l, ok := t.root.search(&t.contention, key, 0, &t.dummy, t.dummy.waitUnlock(&t.contention)); ok {
+			if l == nil {
+				return nil, false
+			}
+			return t.alloc.leafValue(l), true
+		}
+		t.contention.restart()
+	}
+}
+
+// AppendValue appends the value associated with key to dst, and returns the extended buffer.
+// The value is copied, so it can be read into a reused buffer and modified by the caller.
+// This operation is thread safe.
+func (t *ART) AppendValue(dst, key []byte) ([]byte, bool) {
+	defer t.enter().exit()
+	for {
+		if l, ok := t.root.search(&t.contention, key, 0, &t.dummy, t.dummy.waitUnlock(&t.contention)); ok {
+			if l == nil {
+				return dst, false
+			}
+			return t.alloc.appendLeafValue(dst, l), true
 		}
+		t.contention.restart()
 	}
 }
 
 // Put put the given key and value into this tree, or replace exist key's value.
 // This operation is thread safe.
 func (t *ART) Put(key []byte, value []byte) {
+	defer t.enter().exit()
 	for {
-		if t.root.insert(key, value, 0, &t.dummy, t.dummy.waitUnlock(), &t.root) {
+		if t.root.insert(t, key, value, 0, &t.dummy, t.dummy.waitUnlock(&t.contention), t.rootLink()) {
 			return
 		}
+		t.contention.restart()
 	}
 }
 
 // Delete delete the given key and it's value from this tree.
 // This operation is thread safe.
 func (t *ART) Delete(key []byte) {
+	defer t.enter().exit()
 	for {
-		if t.root.remove(key, 0, &t.dummy, t.dummy.waitUnlock(), &t.root) {
+		if t.root.remove(t, key, 0, &t.dummy, t.dummy.waitUnlock(&t.contention), t.rootLink()) {
 			return
 		}
+		t.contention.restart()
+	}
+}
+
+// DeletePrefix delete all keys which have the given prefix from this tree.
+// The subtree contains these keys is detached from its parent at once, instead of deleting keys one by one.
+// An empty prefix will delete all keys in this tree.
+// This operation is thread safe.
+func (t *ART) DeletePrefix(prefix []byte) {
+	defer t.enter().exit()
+	for {
+		if t.root.removePrefix(t, prefix, 0, &t.dummy, t.dummy.waitUnlock(&t.contention), t.rootLink()) {
+			return
+		}
+		t.contention.restart()
+	}
+}
+
+// PutIfAbsent put the given key and value into this tree if the key doesn't exist.
+// It returns the exist value and false if the key already exist, otherwise returns nil and true.
+// The check and insert are done atomically under the node lock.
+// This operation is thread safe.
+func (t *ART) PutIfAbsent(key []byte, value []byte) (existing []byte, inserted bool) {
+	t.update(key, func(old []byte, exists bool) ([]byte, updateOp) {
+		if exists {
+			existing, inserted = old, false
+			return nil, opKeep
+		}
+		existing, inserted = nil, true
+		return value, opPut
+	})
+	return
+}
+
+// CompareAndSwap replace the value of key with newValue if the key exist and its value equals to oldValue.
+// It returns true if the value is replaced.
+// This operation is thread safe.
+func (t *ART) CompareAndSwap(key []byte, oldValue, newValue []byte) (swapped bool) {
+	t.update(key, func(old []byte, exists bool) ([]byte, updateOp) {
+		if swapped = exists && bytes.Equal(old, oldValue); swapped {
+			return newValue, opPut
+		}
+		return nil, opKeep
+	})
+	return
+}
+
+// CompareAndDelete delete the key if the key exist and its value equals to oldValue.
+// It returns true if the key is deleted.
+// This operation is thread safe.
+func (t *ART) CompareAndDelete(key []byte, oldValue []byte) (deleted bool) {
+	t.update(key, func(old []byte, exists bool) ([]byte, updateOp) {
+		if deleted = exists && bytes.Equal(old, oldValue); deleted {
+			return nil, opDelete
+		}
+		return nil, opKeep
+	})
+	return
+}
+
+// Update atomically read the current value of key and replace it with the value returned by fn.
+// exists is false if the key doesn't exist, and the key will be deleted if fn returns del as true.
+// The fn is called while holding the lock of node which holds the key, so it must not access this tree,
+// and it may be called more than once if the update restarts due to concurrent modification.
+// This operation is thread safe.
+func (t *ART) Update(key []byte, fn func(old []byte, exists bool) (new []byte, del bool)) {
+	t.update(key, func(old []byte, exists bool) ([]byte, updateOp) {
+		value, del := fn(old, exists)
+		if del {
+			return nil, opDelete
+		}
+		return value, opPut
+	})
+}
+
+// updateOp is the modification to be applied on a key by update.
+type updateOp uint8
+
+const (
+	opKeep updateOp = iota
+	opPut
+	opDelete
+)
+
+// updateFunc is called by update with the current value of key while the node holds the key is locked.
+// It returns the new value and the modification should be applied.
+// updateFunc may be called again if the update restarts after it returns.
+type updateFunc func(old []byte, exists bool) (value []byte, op updateOp)
+
+func (t *ART) update(key []byte, fn updateFunc) {
+	defer t.enter().exit()
+	for {
+		if t.root.update(t, key, 0, &t.dummy, t.dummy.waitUnlock(&t.contention), t.rootLink(), fn) {
+			return
+		}
+		t.contention.restart()
 	}
 }
 
 //go:norace
-func (n *node) search(key []byte, depth uint32, parent *node, parentVersion uint64) ([]byte, bool, bool) {
+func (n *node) search(cont *contention, key []byte, depth uint32, parent *node, parentVersion uint64) (*leaf, bool) {
 	var (
 		version  uint64
 		ok       bool
@@ -72,45 +277,39 @@ func (n *node) search(key []byte, depth uint32, parent *node, parentVersion uint
 
 	for {
 		failpoint.Inject("get-before-rLock-fp", func() {})
-		if version, ok = currNode.rLock(); !ok {
-			return nil, false, false
+		if version, ok = currNode.rLock(cont); !ok {
+			return nil, false
 		}
-		if !parent.rUnlock(parentVersion) {
-			return nil, false, false
+		if !parent.rUnlock(cont, parentVersion) {
+			return nil, false
 		}
 
 		failpoint.Inject("get-before-checkPrefix-fp", func() {})
 		if depth, ok = currNode.checkPrefix(key, depth); !ok {
-			return nil, false, currNode.rUnlock(version)
+			return nil, currNode.rUnlock(cont, version)
 		}
 		failpoint.Inject("get-after-checkPrefix-fp", func() {})
 
 		var nextNode *node
 		if depth == keyLen {
-			nextNode = (*node)(unsafe.Pointer(currNode.prefixLeaf))
+			nextNode = currNode.loadPrefixLeaf().toNode()
 		} else if depth < keyLen {
 			nextNode, _, _ = currNode.findChild(key[depth])
 		}
 
-		if !currNode.lockCheck(version) {
-			return nil, false, false
+		if !currNode.lockCheck(cont, version) {
+			return nil, false
 		}
 
 		if nextNode == nil {
-			return nil, false, true
+			return nil, true
 		}
 
 		if nextNode.nodeType == typeLeaf {
-			l := (*leaf)(unsafe.Pointer(nextNode))
-			var (
-				value []byte
-				ex    bool
-			)
-			if l.match(key) {
-				value = l.value()
-				ex = true
+			if l := (*leaf)(unsafe.Pointer(nextNode)); l.match(key) {
+				return l, true
 			}
-			return value, ex, true
+			return nil, true
 		}
 
 		depth += 1
@@ -124,22 +323,23 @@ func (n *node) search(key []byte, depth uint32, parent *node, parentVersion uint
 var putTestCtx context.Context
 
 //go:norace
-func (n *node) insert(key []byte, value []byte, depth uint32, parent *node, parentVersion uint64, nodeLoc **node) bool {
+func (n *node) insert(t *ART, key []byte, value []byte, depth uint32, parent *node, parentVersion uint64, nodeLoc link) bool {
 	var (
 		version  uint64
 		ok       bool
 		nextNode *node
-		nextLoc  **node
+		nextLoc  link
 		currNode = n
+		cont     = &t.contention
 	)
 
 	for {
-		if version, ok = currNode.rLock(); !ok {
+		if version, ok = currNode.rLock(cont); !ok {
 			return false
 		}
 
 		failpoint.InjectContext(putTestCtx, "set-before-prefixMismatch-fp", func() {})
-		p, fullKey, ok := currNode.prefixMismatch(key, depth, parent, version, parentVersion)
+		p, fullKey, ok := currNode.prefixMismatch(cont, key, depth, parent, version, parentVersion)
 		if !ok {
 			return false
 		}
@@ -148,14 +348,18 @@ func (n *node) insert(key []byte, value []byte, depth uint32, parent *node, pare
 		// split current node due to prefix mismatch.
 		if p != currNode.prefixLen {
 			// update parent node, so lock it first.
-			if !parent.upgradeToLock(parentVersion) {
+			if !parent.upgradeToLock(cont, parentVersion) {
+				return false
+			}
+			if !currNode.upgradeToLockWithNode(cont, version, parent) {
 				return false
 			}
-			if !currNode.upgradeToLockWithNode(version, parent) {
+			w, ok := t.lockedWriter(key, currNode, parent, true)
+			if !ok {
 				return false
 			}
 
-			currNode.insertSplitPrefix(key, fullKey, value, depth, p, nodeLoc)
+			currNode.insertSplitPrefix(key, fullKey, value, depth, p, nodeLoc, w)
 
 			currNode.unlock()
 			parent.unlock()
@@ -165,48 +369,60 @@ func (n *node) insert(key []byte, value []byte, depth uint32, parent *node, pare
 		depth += currNode.prefixLen
 
 		if depth == uint32(len(key)) {
-			if !currNode.upgradeToLock(version) {
+			if !currNode.upgradeToLock(cont, version) {
 				return false
 			}
 			// only modify current node, rUnlock parent.
-			if !parent.rUnlockWithNode(parentVersion, currNode) {
+			if !parent.rUnlockWithNode(cont, parentVersion, currNode) {
+				return false
+			}
+			w, ok := t.lockedWriter(key, currNode, parent, false)
+			if !ok {
 				return false
 			}
 
-			currNode.updatePrefixLeaf(key, value)
+			currNode.updatePrefixLeaf(key, value, w)
 
 			currNode.unlock()
 			return true
 		}
 
 		nextNode, nextLoc, _ = currNode.findChild(key[depth])
-		if !currNode.lockCheck(version) {
+		if !currNode.lockCheck(cont, version) {
 			return false
 		}
 
 		// no exist key, insert it directly.
 		if nextNode == nil {
 			if currNode.isFull() {
-				if !parent.upgradeToLock(parentVersion) {
+				if !parent.upgradeToLock(cont, parentVersion) {
 					return false
 				}
-				if !currNode.upgradeToLockWithNode(version, parent) {
+				if !currNode.upgradeToLockWithNode(cont, version, parent) {
+					return false
+				}
+				w, ok := t.lockedWriter(key, currNode, parent, true)
+				if !ok {
 					return false
 				}
 
-				currNode.growAndInsert(key[depth], newLeaf(key, value).toNode(), nodeLoc)
+				currNode.growAndInsert(key[depth], w.newLeaf(key, value).toNode(), nodeLoc, w)
 
-				currNode.unlockObsolete()
+				w.retire(currNode)
 				parent.unlock()
 			} else {
-				if !currNode.upgradeToLock(version) {
+				if !currNode.upgradeToLock(cont, version) {
+					return false
+				}
+				if !parent.rUnlockWithNode(cont, parentVersion, currNode) {
 					return false
 				}
-				if !parent.rUnlockWithNode(parentVersion, currNode) {
+				w, ok := t.lockedWriter(key, currNode, parent, false)
+				if !ok {
 					return false
 				}
 
-				currNode.insertChild(key[depth], newLeaf(key, value).toNode())
+				currNode.insertChild(key[depth], w.newLeaf(key, value).toNode())
 
 				currNode.unlock()
 			}
@@ -215,17 +431,21 @@ func (n *node) insert(key []byte, value []byte, depth uint32, parent *node, pare
 
 		// step to next level.
 
-		if !parent.rUnlock(parentVersion) {
+		if !parent.rUnlock(cont, parentVersion) {
 			return false
 		}
 
 		if nextNode.nodeType == typeLeaf {
-			if !currNode.upgradeToLock(version) {
+			if !currNode.upgradeToLock(cont, version) {
+				return false
+			}
+			w, ok := t.lockedWriter(key, currNode, parent, false)
+			if !ok {
 				return false
 			}
 
 			l := (*leaf)(unsafe.Pointer(nextNode))
-			l.updateOrExpand(key, value, depth+1, nextLoc)
+			l.updateOrExpand(key, value, depth+1, nextLoc, w)
 
 			currNode.unlock()
 			return true
@@ -240,70 +460,81 @@ func (n *node) insert(key []byte, value []byte, depth uint32, parent *node, pare
 }
 
 //go:norace
-func (n *node) remove(key []byte, depth uint32, parent *node, parentVersion uint64, nodeLoc **node) bool {
+func (n *node) remove(t *ART, key []byte, depth uint32, parent *node, parentVersion uint64, nodeLoc link) bool {
 	var (
 		version  uint64
 		ok       bool
 		currNode = n
+		cont     = &t.contention
 	)
 
 	for {
-		if version, ok = currNode.rLock(); !ok {
+		if version, ok = currNode.rLock(cont); !ok {
 			return false
 		}
-		if !parent.rUnlock(parentVersion) {
+		if !parent.rUnlock(cont, parentVersion) {
 			return false
 		}
 
 		if depth, ok = currNode.checkPrefix(key, depth); !ok {
-			return currNode.rUnlock(version)
+			return currNode.rUnlock(cont, version)
 		}
 
 		// remove prefixLeaf, maybe compress current node.
 		if depth == uint32(len(key)) {
-			l := currNode.prefixLeaf
-			if !currNode.lockCheck(version) {
+			l := currNode.loadPrefixLeaf()
+			if !currNode.lockCheck(cont, version) {
 				return false
 			}
 			if l == nil || !l.match(key) {
-				return currNode.rUnlock(version)
+				return currNode.rUnlock(cont, version)
 			}
 
 			// compress single way node, maybe restart.
 			if currNode.shouldCompress(parent) {
-				if !parent.upgradeToLock(parentVersion) {
+				if !parent.upgradeToLock(cont, parentVersion) {
 					return false
 				}
-				if !currNode.upgradeToLockWithNode(version, parent) {
+				if !currNode.upgradeToLockWithNode(cont, version, parent) {
+					return false
+				}
+				w, ok := t.lockedWriter(key, currNode, parent, true)
+				if !ok {
 					return false
 				}
 
 				n4 := (*node4)(unsafe.Pointer(currNode))
-				ok := n4.compressChild(0, nodeLoc)
+				ok = n4.compressChild(0, nodeLoc, w)
 
 				if !ok {
 					currNode.unlock()
 				} else {
-					currNode.unlockObsolete()
+					w.freeLeaf(l)
+					w.retire(currNode)
 				}
 				parent.unlock()
 				return ok
 			}
 
-			if !currNode.upgradeToLock(version) {
+			if !currNode.upgradeToLock(cont, version) {
+				return false
+			}
+			w, ok := t.lockedWriter(key, currNode, parent, false)
+			if !ok {
 				return false
 			}
-			currNode.prefixLeaf = nil
+			currNode.storePrefixLeaf(nil)
+			w.freeLeaf(l)
 			currNode.unlock()
 			return true
 		}
 
 		if depth > uint32(len(key)) {
-			return currNode.rUnlock(version)
+			return currNode.rUnlock(cont, version)
 		}
 
 		nextNode, nextLoc, idx := currNode.findChild(key[depth])
-		if !currNode.lockCheck(version) {
+		if !currNode.lockCheck(cont, version) {
 			return false
 		}
 
@@ -315,30 +546,40 @@ func (n *node) remove(key []byte, depth uint32, parent *node, parentVersion uint
 		if nextNode.nodeType == typeLeaf {
 			l := (*leaf)(unsafe.Pointer(nextNode))
 			if !l.match(key) {
-				return !currNode.rUnlock(version)
+				return currNode.rUnlock(cont, version)
 			}
 			if currNode.shouldShrink(parent) {
-				if !parent.upgradeToLock(parentVersion) {
+				if !parent.upgradeToLock(cont, parentVersion) {
 					return false
 				}
-				if !currNode.upgradeToLockWithNode(version, parent) {
+				if !currNode.upgradeToLockWithNode(cont, version, parent) {
+					return false
+				}
+				w, ok := t.lockedWriter(key, currNode, parent, true)
+				if !ok {
 					return false
 				}
 
-				ok := currNode.removeChildAndShrink(key[depth], nodeLoc)
+				ok = currNode.removeChildAndShrink(key[depth], nodeLoc, w)
 
 				if !ok {
 					currNode.unlock()
 				} else {
-					currNode.unlockObsolete()
+					w.freeLeaf(l)
+					w.retire(currNode)
 				}
 				parent.unlock()
 				return ok
 			}
-			if !currNode.upgradeToLock(version) {
+			if !currNode.upgradeToLock(cont, version) {
+				return false
+			}
+			w, ok := t.lockedWriter(key, currNode, parent, false)
+			if !ok {
 				return false
 			}
 			currNode.removeChild(idx)
+			w.freeLeaf(l)
 			currNode.unlock()
 			return true
 		}
@@ -350,3 +591,327 @@ func (n *node) remove(key []byte, depth uint32, parent *node, parentVersion uint
 		currNode = nextNode
 	}
 }
+
+//go:norace
+func (n *node) removePrefix(t *ART, prefix []byte, depth uint32, parent *node, parentVersion uint64, nodeLoc link) bool {
+	var (
+		version  uint64
+		ok       bool
+		currNode = n
+		cont     = &t.contention
+	)
+
+	for {
+		if version, ok = currNode.rLock(cont); !ok {
+			return false
+		}
+		if !parent.rUnlock(cont, parentVersion) {
+			return false
+		}
+
+		nodePrefix, ok := currNode.loadPrefix(cont, depth, version)
+		if !ok {
+			return false
+		}
+		rest := prefix[depth:]
+
+		// the whole tree match the prefix, only root can reach here, replace it with an empty node.
+		if len(rest) <= len(nodePrefix) {
+			if !bytes.HasPrefix(nodePrefix, rest) {
+				return currNode.rUnlock(cont, version)
+			}
+			if parent.nodeType != typeDummy {
+				return false
+			}
+			if !parent.upgradeToLock(cont, parentVersion) {
+				return false
+			}
+			if !currNode.upgradeToLockWithNode(cont, version, parent) {
+				return false
+			}
+			w := t.loadWriter()
+			nodeLoc.store(w.newNode4().toNode())
+
+			parent.unlock()
+			w.retireTree(currNode)
+			return true
+		}
+		if !bytes.HasPrefix(rest, nodePrefix) {
+			return currNode.rUnlock(cont, version)
+		}
+		depth += currNode.prefixLen
+
+		nextNode, nextLoc, idx := currNode.findChild(prefix[depth])
+		if !currNode.lockCheck(cont, version) {
+			return false
+		}
+
+		// not found.
+		if nextNode == nil {
+			return true
+		}
+
+		var nextVersion uint64
+		if nextNode.nodeType == typeLeaf {
+			l := (*leaf)(unsafe.Pointer(nextNode))
+			if !bytes.HasPrefix(l.key(), prefix) {
+				return currNode.rUnlock(cont, version)
+			}
+		} else {
+			if nextVersion, ok = nextNode.rLock(cont); !ok {
+				return false
+			}
+			if !currNode.lockCheck(cont, version) {
+				return false
+			}
+
+			// the prefix end inside next node's compressed path, so all keys under next node match the prefix.
+			// otherwise the matched keys are deeper in the tree, step to next level.
+			nextPrefix, ok := nextNode.loadPrefix(cont, depth+1, nextVersion)
+			if !ok {
+				return false
+			}
+			if rest := prefix[depth+1:]; len(rest) > len(nextPrefix) {
+				depth += 1
+				parent = currNode
+				parentVersion = version
+				nodeLoc = nextLoc
+				currNode = nextNode
+				continue
+			} else if !bytes.HasPrefix(nextPrefix, rest) {
+				return currNode.rUnlock(cont, version)
+			}
+		}
+
+		// detach next node from current node, maybe shrink current node.
+		if currNode.shouldShrink(parent) {
+			if !parent.upgradeToLock(cont, parentVersion) {
+				return false
+			}
+			if !currNode.upgradeToLockWithNode(cont, version, parent) {
+				return false
+			}
+			w, ok := t.lockedWriter(prefix, currNode, parent, true)
+			if !ok {
+				return false
+			}
+			if nextNode.nodeType != typeLeaf && !nextNode.upgradeToLock(cont, nextVersion) {
+				currNode.unlock()
+				parent.unlock()
+				return false
+			}
+
+			ok = currNode.removeChildAndShrink(prefix[depth], nodeLoc, w)
+
+			if !ok {
+				if nextNode.nodeType != typeLeaf {
+					nextNode.unlock()
+				}
+				currNode.unlock()
+				parent.unlock()
+				return false
+			}
+			w.retire(currNode)
+			parent.unlock()
+			w.retireDetached(nextNode)
+			return true
+		}
+
+		if !currNode.upgradeToLock(cont, version) {
+			return false
+		}
+		w, ok := t.lockedWriter(prefix, currNode, parent, false)
+		if !ok {
+			return false
+		}
+		if nextNode.nodeType != typeLeaf && !nextNode.upgradeToLockWithNode(cont, nextVersion, currNode) {
+			return false
+		}
+
+		currNode.removeChild(idx)
+
+		currNode.unlock()
+		w.retireDetached(nextNode)
+		return true
+	}
+}
+
+// update is the read-modify-write version of insert and remove.
+// It locks all nodes which maybe modified by any kind of op before call fn,
+// so fn can make decision with the current value atomically.
+//
+//go:norace
+func (n *node) update(t *ART, key []byte, depth uint32, parent *node, parentVersion uint64, nodeLoc link, fn updateFunc) bool {
+	var (
+		version  uint64
+		ok       bool
+		currNode = n
+		cont     = &t.contention
+	)
+
+	for {
+		if version, ok = currNode.rLock(cont); !ok {
+			return false
+		}
+
+		p, fullKey, ok := currNode.prefixMismatch(cont, key, depth, parent, version, parentVersion)
+		if !ok {
+			return false
+		}
+
+		// key doesn't exist, current node must be split if fn want to insert it.
+		if p != currNode.prefixLen {
+			if !currNode.upgradeToLockWithParent(cont, version, parent, parentVersion, true) {
+				return false
+			}
+			w, ok := t.lockedWriter(key, currNode, parent, true)
+			if !ok {
+				return false
+			}
+
+			if value, op := fn(nil, false); op == opPut {
+				currNode.insertSplitPrefix(key, fullKey, value, depth, p, nodeLoc, w)
+			}
+
+			currNode.unlock()
+			parent.unlock()
+			return true
+		}
+		depth += currNode.prefixLen
+
+		if depth == uint32(len(key)) {
+			l := currNode.loadPrefixLeaf()
+			if !currNode.lockCheck(cont, version) {
+				return false
+			}
+			var (
+				old      []byte
+				exists   = l != nil && l.match(key)
+				compress = exists && currNode.shouldCompress(parent)
+			)
+			if !currNode.upgradeToLockWithParent(cont, version, parent, parentVersion, compress) {
+				return false
+			}
+			w, ok := t.lockedWriter(key, currNode, parent, compress)
+			if !ok {
+				return false
+			}
+			if exists {
+				old = t.alloc.leafValue(l)
+			}
+
+			obsolete := false
+			switch value, op := fn(old, exists); {
+			case op == opPut:
+				currNode.updatePrefixLeaf(key, value, w)
+			case op == opDelete && exists && compress:
+				n4 := (*node4)(unsafe.Pointer(currNode))
+				ok = n4.compressChild(0, nodeLoc, w)
+				obsolete = ok
+			case op == opDelete && exists:
+				currNode.storePrefixLeaf(nil)
+				w.freeLeaf(l)
+			}
+
+			if obsolete {
+				w.freeLeaf(l)
+				w.retire(currNode)
+			} else {
+				currNode.unlock()
+			}
+			if compress {
+				parent.unlock()
+			}
+			return ok
+		}
+
+		nextNode, nextLoc, idx := currNode.findChild(key[depth])
+		if !currNode.lockCheck(cont, version) {
+			return false
+		}
+
+		// key doesn't exist, current node must grow if fn want to insert it into a full node.
+		if nextNode == nil {
+			full := currNode.isFull()
+			if !currNode.upgradeToLockWithParent(cont, version, parent, parentVersion, full) {
+				return false
+			}
+			w, ok := t.lockedWriter(key, currNode, parent, full)
+			if !ok {
+				return false
+			}
+
+			obsolete := false
+			if value, op := fn(nil, false); op == opPut {
+				if full {
+					currNode.growAndInsert(key[depth], w.newLeaf(key, value).toNode(), nodeLoc, w)
+					obsolete = true
+				} else {
+					currNode.insertChild(key[depth], w.newLeaf(key, value).toNode())
+				}
+			}
+
+			if obsolete {
+				w.retire(currNode)
+			} else {
+				currNode.unlock()
+			}
+			if full {
+				parent.unlock()
+			}
+			return true
+		}
+
+		if nextNode.nodeType == typeLeaf {
+			var (
+				old    []byte
+				l      = (*leaf)(unsafe.Pointer(nextNode))
+				exists = l.match(key)
+				shrink = exists && currNode.shouldShrink(parent)
+			)
+			if !currNode.upgradeToLockWithParent(cont, version, parent, parentVersion, shrink) {
+				return false
+			}
+			w, ok := t.lockedWriter(key, currNode, parent, shrink)
+			if !ok {
+				return false
+			}
+			if exists {
+				old = t.alloc.leafValue(l)
+			}
+
+			obsolete := false
+			switch value, op := fn(old, exists); {
+			case op == opPut:
+				l.updateOrExpand(key, value, depth+1, nextLoc, w)
+			case op == opDelete && exists && shrink:
+				ok = currNode.removeChildAndShrink(key[depth], nodeLoc, w)
+				obsolete = ok
+			case op == opDelete && exists:
+				currNode.removeChild(idx)
+				w.freeLeaf(l)
+			}
+
+			if obsolete {
+				w.freeLeaf(l)
+				w.retire(currNode)
+			} else {
+				currNode.unlock()
+			}
+			if shrink {
+				parent.unlock()
+			}
+			return ok
+		}
+
+		if !parent.rUnlock(cont, parentVersion) {
+			return false
+		}
+
+		depth += 1
+		parent = currNode
+		parentVersion = version
+		nodeLoc = nextLoc
+		currNode = nextNode
+	}
+}
@@ -1,10 +1,13 @@
 package art
 
 import (
+	"bytes"
 	"fmt"
 	"runtime"
+	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/coocood/badger/skl"
 	"github.com/coocood/badger/y"
@@ -33,7 +36,109 @@ func BenchmarkArtSet(b *testing.B) {
 	}
 }
 
+func BenchmarkArtSetWithArena(b *testing.B) {
+	es := genEntries(N)
+	test := []int{10000, 100000, 1000000}
+	for _, t := range test {
+		b.Run(fmt.Sprintf("ART-set-arena-%d", t), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if t >= 100000 {
+					b.StopTimer()
+					runtime.GC()
+					b.StartTimer()
+				}
+				tree := New(WithArena(0))
+				for _, e := range es[:t] {
+					tree.Put(e.k[:], e.v)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkArtUpdate(b *testing.B) {
+	es := genEntries(10000)
+	for _, inPlace := range []bool{false, true} {
+		var opts []Option
+		if inPlace {
+			opts = append(opts, WithInPlaceUpdate())
+		}
+		b.Run(fmt.Sprintf("ART-update-in-place-%v", inPlace), func(b *testing.B) {
+			tree := New(opts...)
+			for _, e := range es {
+				tree.Put(e.k[:], e.v)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e := es[i%len(es)]
+				tree.Put(e.k[:], e.v)
+			}
+		})
+	}
+}
+
+func BenchmarkArtPutBatch(b *testing.B) {
+	es := genEntries(N)
+	sort.Slice(es, func(i, j int) bool { return bytes.Compare(es[i].k[:], es[j].k[:]) < 0 })
+	keys := make([][]byte, len(es))
+	values := make([][]byte, len(es))
+	for i, e := range es {
+		keys[i], values[i] = e.k[:], e.v
+	}
+	test := []int{10, 100, 1000, 10000, 100000, 1000000}
+	for _, t := range test {
+		b.Run(fmt.Sprintf("ART-put-batch-%d", t), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if t >= 100000 {
+					b.StopTimer()
+					runtime.GC()
+					b.StartTimer()
+				}
+				tree := New()
+				tree.PutBatch(keys[:t], values[:t])
+			}
+		})
+	}
+}
+
+func BenchmarkArtBuildFromSorted(b *testing.B) {
+	es := genEntries(N)
+	sort.Slice(es, func(i, j int) bool { return bytes.Compare(es[i].k[:], es[j].k[:]) < 0 })
+	test := []int{10, 100, 1000, 10000, 100000, 1000000}
+	for _, t := range test {
+		b.Run(fmt.Sprintf("ART-build-%d", t), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if t >= 100000 {
+					b.StopTimer()
+					runtime.GC()
+					b.StartTimer()
+				}
+				var pos int
+				BuildFromSorted(func() ([]byte, []byte, bool) {
+					if pos == t {
+						return nil, nil, false
+					}
+					pos++
+					return es[pos-1].k[:], es[pos-1].v, true
+				})
+			}
+		})
+	}
+}
+
 func BenchmarkArtConSet(b *testing.B) {
+	benchmarkArtConSet(b)
+}
+
+func BenchmarkArtConSetWithReclamation(b *testing.B) {
+	benchmarkArtConSet(b, WithReclamation())
+}
+
+func benchmarkArtConSet(b *testing.B, opts ...Option) {
 	G := runtime.GOMAXPROCS(0)
 	es := make([][]*entry, G)
 	for i := range es {
@@ -44,7 +149,7 @@ func BenchmarkArtConSet(b *testing.B) {
 		b.StopTimer()
 		start := make(chan struct{})
 		var wg sync.WaitGroup
-		tree := New()
+		tree := New(opts...)
 		for g := 0; g < G; g++ {
 			wg.Add(1)
 			go func(g1 int) {
@@ -62,6 +167,36 @@ func BenchmarkArtConSet(b *testing.B) {
 	}
 }
 
+func BenchmarkArtHotKeySet(b *testing.B) {
+	backoffs := []struct {
+		name string
+		b    Backoff
+	}{
+		{"Spin", SpinBackoff()},
+		{"Yield", YieldBackoff(30)},
+		{"Exponential", ExponentialBackoff(30, time.Microsecond, 100*time.Microsecond)},
+	}
+	for _, bo := range backoffs {
+		b.Run(bo.name, func(b *testing.B) {
+			tree := New(WithBackoff(bo.b), WithContentionStats())
+			keys := make([][]byte, 16)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("hot-key-%02d", i))
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					tree.Put(keys[i%len(keys)], keys[0])
+					i++
+				}
+			})
+			c := tree.Contention()
+			b.ReportMetric(float64(c.Restarts)/float64(b.N), "restarts/op")
+			b.ReportMetric(float64(c.LockWait.Nanoseconds())/float64(b.N), "wait-ns/op")
+		})
+	}
+}
+
 func BenchmarkArtGet(b *testing.B) {
 	es := genEntries(N)
 	test := []int{10, 100, 1000, 10000, 100000, 1000000}
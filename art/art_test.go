@@ -1,8 +1,17 @@
 package art
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
@@ -96,6 +105,21 @@ func TestEmptyKey(t *testing.T) {
 	require.Equal(t, []byte("nil"), v)
 }
 
+func TestDeleteAbsentKey(t *testing.T) {
+	a := New()
+	keys := [][]byte{{1, 2, 3}, {2, 3, 4}}
+	putAndCheck(t, a, keys)
+
+	// The slot of key[0] holds leaf {1, 2, 3}, which doesn't match the deleted key.
+	a.Delete([]byte{1, 2, 4})
+	a.Delete([]byte{2})
+	for _, k := range keys {
+		v, ok := a.Get(k)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+	}
+}
+
 func TestExpandLeaf(t *testing.T) {
 	a := New()
 	keys := [][]byte{
@@ -388,3 +412,2210 @@ func shuffleKeys(es []*entry) [][19]byte {
 	}
 	return keys
 }
+
+func collectScan(a *ART, start, end []byte, reverse bool) [][]byte {
+	var keys [][]byte
+	fn := func(k, v []byte) bool {
+		keys = append(keys, append([]byte{}, k...))
+		return false
+	}
+	if reverse {
+		a.ReverseScan(start, end, fn)
+	} else {
+		a.Scan(start, end, fn)
+	}
+	return keys
+}
+
+func expectedRange(keys [][]byte, start, end []byte, reverse bool) [][]byte {
+	var result [][]byte
+	for _, k := range keys {
+		if len(start) != 0 && bytes.Compare(k, start) < 0 {
+			continue
+		}
+		if len(end) != 0 && bytes.Compare(k, end) >= 0 {
+			continue
+		}
+		result = append(result, k)
+	}
+	if reverse {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+	return result
+}
+
+func TestScan(t *testing.T) {
+	a := New()
+	keys := [][]byte{
+		{},
+		{1},
+		{1, 2},
+		{1, 2, 3},
+		{1, 2, 3, 4},
+		{1, 2, 3, 4, 5},
+		{2, 3},
+		{2, 3, 4},
+		{2, 3, 5},
+		{3, 1},
+		{3, 2},
+		[]byte("abcdefghijklmn"),
+		[]byte("abcdefghijklmn123"),
+		[]byte("abcdefghijklmnopq"),
+		[]byte("abcdefghijklmo123"),
+	}
+	for i := 0; i < 256; i++ {
+		keys = append(keys, []byte{4, byte(i)})
+	}
+	putAndCheck(t, a, keys)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	bounds := [][]byte{
+		nil,
+		{0},
+		{1},
+		{1, 2, 3},
+		{1, 2, 3, 3},
+		{1, 2, 3, 5},
+		{2},
+		{2, 3, 4, 5},
+		{4, 100},
+		{4, 255, 0},
+		{5},
+		[]byte("abcdefghijk"),
+		[]byte("abcdefghijklmn2"),
+		[]byte("abcdefghijklmz"),
+	}
+	for _, start := range bounds {
+		for _, end := range bounds {
+			require.Equal(t, expectedRange(keys, start, end, false), collectScan(a, start, end, false), "%v %v", start, end)
+			require.Equal(t, expectedRange(keys, start, end, true), collectScan(a, start, end, true), "%v %v", start, end)
+		}
+	}
+
+	var cnt int
+	a.Scan(nil, nil, func(k, v []byte) bool {
+		require.Equal(t, k, v)
+		cnt++
+		return cnt == 10
+	})
+	require.Equal(t, 10, cnt)
+}
+
+func TestScanRandomKeys(t *testing.T) {
+	a := New()
+	es := genEntries(100000)
+	keys := make([][]byte, 0, len(es))
+	for _, e := range es {
+		a.Put(e.k[:], e.v)
+		keys = append(keys, e.k[:])
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	require.Equal(t, keys, collectScan(a, nil, nil, false))
+	require.Equal(t, expectedRange(keys, nil, nil, true), collectScan(a, nil, nil, true))
+
+	start, end := keys[1000], keys[2000]
+	require.Equal(t, keys[1000:2000], collectScan(a, start, end, false))
+	require.Equal(t, expectedRange(keys, start, end, true), collectScan(a, start, end, true))
+}
+
+func TestScanWithConcurrentWrite(t *testing.T) {
+	a := New()
+	var stable [][]byte
+	for i := 0; i < 5000; i++ {
+		k := []byte(fmt.Sprintf("key-%06d", i*2))
+		a.Put(k, k)
+		stable = append(stable, k)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := []byte(fmt.Sprintf("key-%06d", rnd.Intn(5000)*2+1))
+				if rnd.Intn(2) == 0 {
+					a.Put(k, k)
+				} else {
+					a.Delete(k)
+				}
+			}
+		}(g)
+	}
+
+	for i := 0; i < 20; i++ {
+		for _, reverse := range []bool{false, true} {
+			var (
+				prev   []byte
+				result [][]byte
+			)
+			fn := func(k, v []byte) bool {
+				require.Equal(t, k, v)
+				if prev != nil {
+					cmp := bytes.Compare(prev, k)
+					if reverse {
+						cmp = -cmp
+					}
+					require.True(t, cmp < 0)
+				}
+				prev = k
+				if k[len(k)-1]%2 == 0 {
+					result = append(result, k)
+				}
+				return false
+			}
+			if reverse {
+				a.ReverseScan(nil, nil, fn)
+			} else {
+				a.Scan(nil, nil, fn)
+			}
+			require.Equal(t, expectedRange(stable, nil, nil, reverse), result)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func collectPrefix(a *ART, prefix []byte) [][]byte {
+	var keys [][]byte
+	a.ScanPrefix(prefix, func(k, v []byte) bool {
+		keys = append(keys, append([]byte{}, k...))
+		return false
+	})
+	return keys
+}
+
+func expectedPrefix(keys [][]byte, prefix []byte) [][]byte {
+	var result [][]byte
+	for _, k := range keys {
+		if bytes.HasPrefix(k, prefix) {
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+func TestScanPrefix(t *testing.T) {
+	a := New()
+	keys := [][]byte{
+		{},
+		{1},
+		{1, 2},
+		{1, 2, 3},
+		{1, 2, 3, 4},
+		{1, 2, 4},
+		{2, 3},
+		[]byte("abcdefghijklmn"),
+		[]byte("abcdefghijklmn123"),
+		[]byte("abcdefghijklmnopq"),
+		[]byte("abcdefghijklmo123"),
+	}
+	putAndCheck(t, a, keys)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	prefixes := [][]byte{
+		nil,
+		{1},
+		{1, 2},
+		{1, 2, 3},
+		{1, 3},
+		{2},
+		{3},
+		[]byte("abc"),
+		[]byte("abcdefghijklm"),
+		[]byte("abcdefghijklmn"),
+		[]byte("abcdefghijklmn1"),
+		[]byte("abcdefghijklmz"),
+	}
+	for _, prefix := range prefixes {
+		require.Equal(t, expectedPrefix(keys, prefix), collectPrefix(a, prefix), "%v", prefix)
+	}
+
+	es := genEntries(10000)
+	for _, e := range es {
+		a.Put(e.k[:], e.v)
+		keys = append(keys, e.k[:])
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	for tid := int64(0); tid <= 16; tid++ {
+		prefix := tablecodec.GenTableRecordPrefix(tid)
+		require.Equal(t, expectedPrefix(keys, prefix), collectPrefix(a, prefix), "%v", prefix)
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	a := New()
+	keys := [][]byte{
+		{},
+		{1},
+		{1, 2},
+		{1, 2, 3},
+		{1, 2, 3, 4},
+		{1, 2, 4},
+		{2, 3},
+		[]byte("abcdefghijklmn"),
+		[]byte("abcdefghijklmn123"),
+		[]byte("abcdefghijklmnopq"),
+		[]byte("abcdefghijklmo123"),
+	}
+	prefixes := [][]byte{
+		{1, 3},
+		{1, 2, 3},
+		[]byte("abcdefghijklmn1"),
+		[]byte("abcdefghijklm"),
+		{2},
+		{1},
+		nil,
+	}
+	putAndCheck(t, a, keys)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	for _, prefix := range prefixes {
+		a.DeletePrefix(prefix)
+		var remain [][]byte
+		for _, k := range keys {
+			if !bytes.HasPrefix(k, prefix) {
+				remain = append(remain, k)
+			}
+		}
+		keys = remain
+		require.Equal(t, keys, collectScan(a, nil, nil, false), "%v", prefix)
+	}
+
+	es := genEntries(10000)
+	for _, e := range es {
+		a.Put(e.k[:], e.v)
+	}
+	for tid := int64(1); tid <= 15; tid += 2 {
+		a.DeletePrefix(tablecodec.GenTableRecordPrefix(tid))
+	}
+	for _, e := range es {
+		v, ok := a.Get(e.k[:])
+		if tablecodec.DecodeTableID(e.k[:])%2 == 1 {
+			require.False(t, ok)
+		} else {
+			require.True(t, ok)
+			require.Equal(t, e.v, v)
+		}
+	}
+}
+
+func TestDeletePrefixWithConcurrentWrite(t *testing.T) {
+	a := New()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 20000; i++ {
+				k := tablecodec.EncodeRowKeyWithHandle(int64(g*2+rnd.Intn(2)), rnd.Int63n(1000))
+				if rnd.Intn(100) == 0 {
+					a.DeletePrefix(tablecodec.GenTableRecordPrefix(int64(g * 2)))
+				} else {
+					a.Put(k, k)
+				}
+			}
+			a.DeletePrefix(tablecodec.GenTableRecordPrefix(int64(g * 2)))
+		}(g)
+	}
+	wg.Wait()
+
+	a.Scan(nil, nil, func(k, v []byte) bool {
+		require.Equal(t, int64(1), tablecodec.DecodeTableID(k)%2)
+		require.Equal(t, k, v)
+		return false
+	})
+	for tid := int64(1); tid < 8; tid += 2 {
+		a.DeletePrefix(tablecodec.GenTableRecordPrefix(tid))
+	}
+	require.Empty(t, collectScan(a, nil, nil, false))
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	a := New()
+	keys := [][]byte{{}, {1}, {1, 2}, {1, 2, 3}, {1, 3}, []byte("abcdefghijklmn"), []byte("abcdefghijklmo")}
+	for _, k := range keys {
+		existing, inserted := a.PutIfAbsent(k, k)
+		require.True(t, inserted)
+		require.Nil(t, existing)
+	}
+	for _, k := range keys {
+		existing, inserted := a.PutIfAbsent(k, []byte("new"))
+		require.False(t, inserted)
+		require.Equal(t, k, existing)
+		v, ok := a.Get(k)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+	}
+
+	es := genEntries(10000)
+	for _, e := range es {
+		a.PutIfAbsent(e.k[:], e.v)
+	}
+	for _, e := range es {
+		v, ok := a.Get(e.k[:])
+		require.True(t, ok)
+		require.Equal(t, e.v, v)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	a := New()
+	keys := [][]byte{{}, {1}, {1, 2}, {1, 2, 3}, {1, 3}, []byte("abcdefghijklmn"), []byte("abcdefghijklmo")}
+	for _, k := range keys {
+		require.False(t, a.CompareAndSwap(k, nil, k))
+		_, ok := a.Get(k)
+		require.False(t, ok)
+	}
+	putAndCheck(t, a, keys)
+
+	for _, k := range keys {
+		require.False(t, a.CompareAndSwap(k, []byte("x"), []byte("y")))
+		require.True(t, a.CompareAndSwap(k, k, []byte("y")))
+		v, ok := a.Get(k)
+		require.True(t, ok)
+		require.Equal(t, []byte("y"), v)
+	}
+
+	for _, k := range keys {
+		require.False(t, a.CompareAndDelete(k, k))
+		require.True(t, a.CompareAndDelete(k, []byte("y")))
+		_, ok := a.Get(k)
+		require.False(t, ok)
+		require.False(t, a.CompareAndDelete(k, []byte("y")))
+	}
+	require.Empty(t, collectScan(a, nil, nil, false))
+
+	es := genEntries(10000)
+	for _, e := range es {
+		a.Put(e.k[:], e.v)
+	}
+	for _, e := range es {
+		a.CompareAndDelete(e.k[:], e.v)
+	}
+	require.Empty(t, collectScan(a, nil, nil, false))
+}
+
+func TestCompareAndSwapWithConcurrentWrite(t *testing.T) {
+	a := New()
+	const (
+		numKeys    = 100
+		numWorkers = 8
+		numIncr    = 1000
+	)
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("counter-%03d", i))
+	}
+	var inserted [numKeys]int32
+	var wg sync.WaitGroup
+	for g := 0; g < numWorkers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < numIncr; i++ {
+				n := rnd.Intn(numKeys)
+				if _, ok := a.PutIfAbsent(key(n), []byte{0, 0}); ok {
+					atomic.AddInt32(&inserted[n], 1)
+				}
+				for {
+					old, _ := a.Get(key(n))
+					cnt := int(old[0])<<8 | int(old[1]) + 1
+					if a.CompareAndSwap(key(n), old, []byte{byte(cnt >> 8), byte(cnt)}) {
+						break
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	total := 0
+	for i := 0; i < numKeys; i++ {
+		if inserted[i] == 0 {
+			continue
+		}
+		require.Equal(t, int32(1), inserted[i])
+		v, ok := a.Get(key(i))
+		require.True(t, ok)
+		total += int(v[0])<<8 | int(v[1])
+	}
+	require.Equal(t, numWorkers*numIncr, total)
+}
+
+func TestUpdate(t *testing.T) {
+	a := New()
+	incr := func(old []byte, exists bool) ([]byte, bool) {
+		if !exists {
+			return []byte{1}, false
+		}
+		return []byte{old[0] + 1}, false
+	}
+	keys := [][]byte{{}, {1}, {1, 2}, {1, 2, 3}, {1, 3}, []byte("abcdefghijklmn"), []byte("abcdefghijklmo")}
+	for i := 0; i < 3; i++ {
+		for _, k := range keys {
+			a.Update(k, incr)
+		}
+	}
+	for _, k := range keys {
+		v, ok := a.Get(k)
+		require.True(t, ok)
+		require.Equal(t, []byte{3}, v)
+	}
+
+	for _, k := range keys {
+		a.Update(k, func(old []byte, exists bool) ([]byte, bool) {
+			require.True(t, exists)
+			return nil, true
+		})
+		_, ok := a.Get(k)
+		require.False(t, ok)
+		a.Update(k, func(old []byte, exists bool) ([]byte, bool) {
+			require.False(t, exists)
+			return nil, true
+		})
+	}
+	require.Empty(t, collectScan(a, nil, nil, false))
+}
+
+func TestUpdateWithConcurrentWrite(t *testing.T) {
+	a := New()
+	const (
+		numKeys    = 300
+		numWorkers = 8
+		numIncr    = 2000
+	)
+	var wg sync.WaitGroup
+	for g := 0; g < numWorkers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < numIncr; i++ {
+				k := []byte(fmt.Sprintf("counter-%03d", rnd.Intn(numKeys)))
+				a.Update(k, func(old []byte, exists bool) ([]byte, bool) {
+					var cnt int
+					if exists {
+						cnt = int(old[0])<<8 | int(old[1])
+					}
+					cnt++
+					return []byte{byte(cnt >> 8), byte(cnt)}, false
+				})
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	total := 0
+	a.Scan(nil, nil, func(k, v []byte) bool {
+		total += int(v[0])<<8 | int(v[1])
+		return false
+	})
+	require.Equal(t, numWorkers*numIncr, total)
+}
+
+func TestPutBatch(t *testing.T) {
+	es := genEntries(100000)
+	sort.Slice(es, func(i, j int) bool { return bytes.Compare(es[i].k[:], es[j].k[:]) < 0 })
+	keys := make([][]byte, 0, len(es))
+	values := make([][]byte, 0, len(es))
+	for _, e := range es {
+		keys = append(keys, e.k[:])
+		values = append(values, e.v)
+	}
+
+	a := New()
+	a.PutBatch(keys[:len(keys)/2], values[:len(keys)/2])
+	a.PutBatch(keys, values)
+	for i, k := range keys {
+		v, ok := a.Get(k)
+		require.True(t, ok)
+		require.Equal(t, values[i], v)
+	}
+	require.Equal(t, expectedRange(keys, nil, nil, false), collectScan(a, nil, nil, false))
+
+	// unsorted keys, prefix keys and duplicated keys.
+	a = New()
+	keys = [][]byte{{1, 2, 3}, {1}, {1, 2}, {}, {1, 2, 3}, []byte("abcdefghijklmn"), []byte("abcdefghijklmn123"), {1, 3}}
+	a.PutBatch(keys, keys)
+	for _, k := range keys {
+		v, ok := a.Get(k)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+	}
+}
+
+func TestPutBatchNodeSize(t *testing.T) {
+	for _, c := range []struct {
+		n   int
+		typ uint8
+	}{{4, typeNode4}, {10, typeNode16}, {30, typeNode48}, {100, typeNode256}} {
+		a := New()
+		var keys [][]byte
+		for i := 0; i < c.n; i++ {
+			keys = append(keys, []byte{1, byte(i)})
+		}
+		a.PutBatch(keys, keys)
+		child, _, _ := a.root.findChild(1)
+		require.Equal(t, c.typ, child.nodeType, "%d", c.n)
+		require.Equal(t, keys, collectScan(a, nil, nil, false))
+	}
+
+	// the keys below each child are skipped when estimating the fanout.
+	a := New()
+	var keys [][]byte
+	for i := 0; i < 30; i++ {
+		for j := 0; j < 300; j++ {
+			keys = append(keys, []byte{1, byte(i), byte(j >> 8), byte(j)})
+		}
+	}
+	b := newBatchCursor(a, keys)
+	require.Equal(t, 30, b.fanout(1, 256))
+	require.Equal(t, 10, b.fanout(1, 10))
+	b.pos = 299
+	require.Equal(t, 1, b.fanout(3, 256))
+	a.PutBatch(keys, keys)
+	child, _, _ := a.root.findChild(1)
+	require.Equal(t, uint8(typeNode48), child.nodeType)
+	require.Equal(t, keys, collectScan(a, nil, nil, false))
+}
+
+func TestPutBatchReclamation(t *testing.T) {
+	es := genEntries(50000)
+	sort.Slice(es, func(i, j int) bool { return bytes.Compare(es[i].k[:], es[j].k[:]) < 0 })
+	keys := make([][]byte, 0, len(es))
+	for _, e := range es {
+		keys = append(keys, e.k[:])
+	}
+
+	a := New(WithReclamation())
+	a.PutBatch(keys, keys)
+	// the grown nodes are retired during the batch, the epoch must advance without waiting the batch finished.
+	require.True(t, atomic.LoadUint64(&a.alloc.reclaim.epoch) > 2)
+	for _, k := range keys {
+		a.Delete(k)
+	}
+	a.PutBatch(keys, keys)
+	require.Equal(t, keys, collectScan(a, nil, nil, false))
+}
+
+func TestPutBatchWithConcurrentWrite(t *testing.T) {
+	a := New()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			var keys [][]byte
+			for i := 0; i < 20000; i++ {
+				keys = append(keys, []byte(fmt.Sprintf("key-%06d-%d", i, g)))
+			}
+			a.PutBatch(keys, keys)
+			for _, k := range keys {
+				a.Delete(k)
+			}
+			a.PutBatch(keys, keys)
+		}(g)
+	}
+	wg.Wait()
+
+	var cnt int
+	a.Scan(nil, nil, func(k, v []byte) bool {
+		require.Equal(t, k, v)
+		cnt++
+		return false
+	})
+	require.Equal(t, 4*20000, cnt)
+}
+
+func sliceIter(keys, values [][]byte) func() ([]byte, []byte, bool) {
+	var i int
+	return func() ([]byte, []byte, bool) {
+		if i == len(keys) {
+			return nil, nil, false
+		}
+		i++
+		return keys[i-1], values[i-1], true
+	}
+}
+
+func TestBuildFromSorted(t *testing.T) {
+	a := BuildFromSorted(sliceIter(nil, nil))
+	require.Empty(t, collectScan(a, nil, nil, false))
+	putAndCheck(t, a, [][]byte{{1}, {2}})
+
+	keys := [][]byte{
+		{},
+		{1},
+		{1, 2},
+		{1, 2},
+		{1, 2, 3},
+		{1, 2, 3, 4},
+		{1, 2, 4},
+		{2, 3},
+	}
+	for i := 0; i < 256; i++ {
+		keys = append(keys, []byte{3, byte(i)})
+	}
+	keys = append(keys,
+		[]byte("abcdefghijklmn"),
+		[]byte("abcdefghijklmn123"),
+		[]byte("abcdefghijklmnopq"),
+		[]byte("abcdefghijklmo123"),
+	)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		values[i] = []byte{byte(i)}
+	}
+	a = BuildFromSorted(sliceIter(keys, values))
+	v, ok := a.Get([]byte{1, 2})
+	require.True(t, ok)
+	require.Equal(t, []byte{3}, v)
+	unique := append(keys[:3:3], keys[4:]...)
+	require.Equal(t, unique, collectScan(a, nil, nil, false))
+	require.Equal(t, expectedPrefix(unique, []byte("abcdefghijklmn")), collectPrefix(a, []byte("abcdefghijklmn")))
+
+	putAndCheck(t, a, [][]byte{{1, 2, 3, 5}, []byte("abcdefghijklmm"), []byte("abcdefghijk")})
+	for _, k := range unique {
+		a.Delete(k)
+		_, ok := a.Get(k)
+		require.False(t, ok)
+	}
+
+	require.Panics(t, func() {
+		BuildFromSorted(sliceIter([][]byte{{2}, {1}}, [][]byte{{2}, {1}}))
+	})
+}
+
+func TestBuildFromSortedRandomKeys(t *testing.T) {
+	es := genEntries(100000)
+	sort.Slice(es, func(i, j int) bool { return bytes.Compare(es[i].k[:], es[j].k[:]) < 0 })
+	var i int
+	a := BuildFromSorted(func() ([]byte, []byte, bool) {
+		if i == len(es) {
+			return nil, nil, false
+		}
+		i++
+		return es[i-1].k[:], es[i-1].v, true
+	})
+
+	keys := make([][]byte, 0, len(es))
+	for _, e := range es {
+		v, ok := a.Get(e.k[:])
+		require.True(t, ok)
+		require.Equal(t, e.v, v)
+		keys = append(keys, e.k[:])
+	}
+	require.Equal(t, keys, collectScan(a, nil, nil, false))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := g; j < len(es); j += 4 {
+				if j%2 == 0 {
+					a.Delete(es[j].k[:])
+				} else {
+					a.Put(es[j].k[:], es[j].k[:])
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	for j, e := range es {
+		v, ok := a.Get(e.k[:])
+		if j%2 == 0 {
+			require.False(t, ok)
+		} else {
+			require.True(t, ok)
+			require.Equal(t, e.k[:], v)
+		}
+	}
+}
+
+func collectSnapshot(s *Snapshot) [][]byte {
+	var kvs [][]byte
+	s.Scan(nil, nil, func(k, v []byte) bool {
+		kvs = append(kvs, append([]byte{}, k...), append([]byte{}, v...))
+		return false
+	})
+	return kvs
+}
+
+func TestSnapshot(t *testing.T) {
+	a := New()
+	es := genEntries(10000)
+	var keys [][]byte
+	for _, e := range es {
+		a.Put(e.k[:], e.v)
+		keys = append(keys, e.k[:])
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	s1 := a.Snapshot()
+	for i, e := range es {
+		switch i % 3 {
+		case 0:
+			a.Delete(e.k[:])
+		case 1:
+			a.Put(e.k[:], []byte("new"))
+		}
+	}
+	a.DeletePrefix(tablecodec.GenTableRecordPrefix(1))
+	s2 := a.Snapshot()
+	a.PutBatch(keys, keys)
+	s3 := a.Snapshot()
+	a.DeletePrefix(nil)
+
+	for i, e := range es {
+		v, ok := s1.Get(e.k[:])
+		require.True(t, ok)
+		require.Equal(t, e.v, v)
+
+		v, ok = s2.Get(e.k[:])
+		switch {
+		case i%3 == 0 || tablecodec.DecodeTableID(e.k[:]) == 1:
+			require.False(t, ok)
+		case i%3 == 1:
+			require.True(t, ok)
+			require.Equal(t, []byte("new"), v)
+		default:
+			require.True(t, ok)
+			require.Equal(t, e.v, v)
+		}
+
+		v, ok = s3.Get(e.k[:])
+		require.True(t, ok)
+		require.Equal(t, e.k[:], v)
+
+		_, ok = a.Get(e.k[:])
+		require.False(t, ok)
+	}
+
+	var snapKeys [][]byte
+	s1.Scan(nil, nil, func(k, v []byte) bool {
+		snapKeys = append(snapKeys, append([]byte{}, k...))
+		return false
+	})
+	require.Equal(t, keys, snapKeys)
+	it := s3.NewIterator()
+	it.SeekToLast()
+	for i := len(keys) - 1; i >= 0; i-- {
+		require.True(t, it.Valid())
+		require.Equal(t, keys[i], it.Key())
+		it.Prev()
+	}
+	require.False(t, it.Valid())
+
+	s2.Release()
+	s1.Release()
+	s3.Release()
+	putAndCheck(t, a, keys)
+}
+
+func TestSnapshotWithConcurrentWrite(t *testing.T) {
+	a := New()
+	for i := 0; i < 5000; i++ {
+		k := []byte(fmt.Sprintf("key-%06d", i))
+		a.Put(k, []byte{0})
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := []byte(fmt.Sprintf("key-%06d", rnd.Intn(10000)))
+				switch rnd.Intn(3) {
+				case 0:
+					a.Delete(k)
+				default:
+					a.Update(k, func(old []byte, exists bool) ([]byte, bool) {
+						if !exists {
+							return []byte{1}, false
+						}
+						return []byte{old[0] + 1}, false
+					})
+				}
+			}
+		}(g)
+	}
+
+	for i := 0; i < 20; i++ {
+		s := a.Snapshot()
+		first := collectSnapshot(s)
+		sleep()
+		require.Equal(t, first, collectSnapshot(s))
+		if i%2 == 0 {
+			s.Release()
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// walkMemStats counts nodes reachable from root, a must not be updated concurrently.
+func walkMemStats(a *ART) MemStats {
+	var s MemStats
+	stats := map[uint8]*NodeStats{
+		typeNode4:   &s.Node4,
+		typeNode16:  &s.Node16,
+		typeNode48:  &s.Node48,
+		typeNode256: &s.Node256,
+		typeLeaf:    &s.Leaf,
+	}
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n.nodeType == typeLeaf {
+			stats[typeLeaf].Count++
+			if a.alloc.inPlace {
+				stats[typeLeaf].Bytes += (*leaf)(unsafe.Pointer(n)).mutableSize()
+			} else {
+				stats[typeLeaf].Bytes += (*leaf)(unsafe.Pointer(n)).size()
+			}
+			return
+		}
+		stats[n.nodeType].Count++
+		stats[n.nodeType].Bytes += nodeSizes[n.nodeType]
+		if l := n.loadPrefixLeaf(); l != nil {
+			walk(l.toNode())
+		}
+		for k := 0; k < 256; k++ {
+			c, ck := n.seekChild(k)
+			if c == nil {
+				break
+			}
+			walk(c)
+			k = ck
+		}
+	}
+	walk(a.root)
+	return s
+}
+
+func checkMemStats(t *testing.T, a *ART, n int) {
+	require.Equal(t, n, a.Len())
+	s := a.MemStats()
+	expected := walkMemStats(a)
+	expected.Arena = s.Arena
+	require.Equal(t, expected, s)
+	require.Equal(t, s.Total(), a.MemSize())
+}
+
+func TestLenAndMemSize(t *testing.T) {
+	a := New()
+	checkMemStats(t, a, 0)
+	require.Equal(t, int64(1), a.MemStats().Node4.Count)
+
+	keys := make(map[string]struct{})
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 5000; i++ {
+		k := make([]byte, 1+rnd.Intn(4))
+		rnd.Read(k)
+		a.Put(k, k[:rnd.Intn(len(k))])
+		keys[string(k)] = struct{}{}
+	}
+	checkMemStats(t, a, len(keys))
+	s := a.MemStats()
+	require.True(t, s.Node256.Count > 0)
+	require.True(t, s.Leaf.Bytes > int64(len(keys))*9)
+
+	for k := range keys {
+		if k[0]%4 == 0 {
+			a.Delete([]byte(k))
+			delete(keys, k)
+		}
+	}
+	checkMemStats(t, a, len(keys))
+
+	a.DeletePrefix([]byte{1})
+	a.DeletePrefix([]byte{2, 3})
+	for k := range keys {
+		if k[0] == 1 || len(k) >= 2 && k[0] == 2 && k[1] == 3 {
+			delete(keys, k)
+		}
+	}
+	checkMemStats(t, a, len(keys))
+
+	for k := range keys {
+		a.Update([]byte(k), func(old []byte, exists bool) ([]byte, bool) {
+			return nil, k[0]%2 == 0
+		})
+		if k[0]%2 == 0 {
+			delete(keys, k)
+		}
+	}
+	checkMemStats(t, a, len(keys))
+
+	snap := a.Snapshot()
+	for k := range keys {
+		a.Put([]byte(k), []byte("updated"))
+	}
+	checkMemStats(t, a, len(keys))
+	snap.Release()
+
+	a.DeletePrefix(nil)
+	checkMemStats(t, a, 0)
+
+	var bkeys, bvalues [][]byte
+	for i := 0; i < 1000; i++ {
+		bkeys = append(bkeys, []byte(fmt.Sprintf("key-%04d", i/2)))
+		bvalues = append(bvalues, []byte{byte(i)})
+	}
+	a.PutBatch(bkeys, bvalues)
+	checkMemStats(t, a, 500)
+	checkMemStats(t, BuildFromSorted(sliceIter(bkeys, bvalues)), 500)
+}
+
+func TestStats(t *testing.T) {
+	a := New()
+	s := a.Stats()
+	require.Equal(t, int64(1), s.Node4)
+	require.Equal(t, int64(0), s.Leaves)
+
+	a.Put([]byte{1}, nil)
+	a.Put([]byte{1, 2}, nil)
+	a.Put([]byte{1, 2, 3, 4, 5, 6}, nil)
+	a.Put([]byte{1, 2, 3, 4, 5, 7}, nil)
+	s = a.Stats()
+	// root -> {1} -> {1, 2} -> {1, 2, 3, 4, 5}, the last node has prefix {4, 5}.
+	require.Equal(t, int64(4), s.Node4)
+	require.Equal(t, int64(4), s.Leaves)
+	require.Equal(t, int64(2), s.PrefixLeaves)
+	require.Equal(t, []int64{0, 0, 1, 1, 2}, s.Depth)
+	require.Equal(t, []int64{3, 0, 1}, s.PrefixLen)
+
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 5000; i++ {
+		k := make([]byte, 1+rnd.Intn(4))
+		rnd.Read(k)
+		a.Put(k, k)
+	}
+	s, ms := a.Stats(), a.MemStats()
+	require.Equal(t, ms.Node4.Count, s.Node4)
+	require.Equal(t, ms.Node16.Count, s.Node16)
+	require.Equal(t, ms.Node48.Count, s.Node48)
+	require.Equal(t, ms.Node256.Count, s.Node256)
+	require.Equal(t, int64(a.Len()), s.Leaves)
+	var leaves, nodes int64
+	for _, cnt := range s.Depth {
+		leaves += cnt
+	}
+	for _, cnt := range s.PrefixLen {
+		nodes += cnt
+	}
+	require.Equal(t, s.Leaves, leaves)
+	require.Equal(t, s.Node4+s.Node16+s.Node48+s.Node256, nodes)
+	require.Equal(t, int64(0), s.Restarts)
+	require.Equal(t, int64(0), s.Spins)
+}
+
+func TestBackoff(t *testing.T) {
+	b := ExponentialBackoff(2, time.Microsecond, 8*time.Microsecond).(exponentialBackoff)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		b.Wait(i)
+	}
+	require.True(t, time.Since(start) < time.Millisecond)
+	start = time.Now()
+	for i := 2; i < 100; i++ {
+		b.Wait(i)
+	}
+	require.True(t, time.Since(start) >= 98*time.Microsecond)
+
+	// large min must not overflow when it is shifted.
+	b = ExponentialBackoff(0, time.Hour, 2*time.Hour).(exponentialBackoff)
+	require.Equal(t, time.Hour, b.delay(0))
+	require.Equal(t, 2*time.Hour, b.delay(1))
+	for shift := 2; shift < 100; shift++ {
+		require.Equal(t, 2*time.Hour, b.delay(shift))
+	}
+
+	for _, b := range []Backoff{SpinBackoff(), YieldBackoff(0), YieldBackoff(4), ExponentialBackoff(4, 0, 0)} {
+		a := New(WithBackoff(b), WithContentionStats())
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 2000; i++ {
+					a.Put([]byte{byte(i % 4)}, []byte{byte(g)})
+					a.Get([]byte{byte(i % 4)})
+				}
+			}(g)
+		}
+		wg.Wait()
+		require.Equal(t, 4, a.Len())
+
+		c := a.Contention()
+		require.True(t, c.Restarts >= 0 && c.ValidationFailures >= c.Restarts)
+		require.True(t, c.Spins >= 0 && c.LockWait >= 0)
+		require.Equal(t, c, a.Stats().ContentionStats)
+	}
+}
+
+func TestContentionStats(t *testing.T) {
+	a := New()
+	a.contention.restart()
+	a.contention.fail()
+	require.Equal(t, ContentionStats{}, a.Contention())
+
+	a = New(WithContentionStats())
+	a.contention.restart()
+	a.contention.fail()
+	a.contention.fail()
+	require.Equal(t, ContentionStats{Restarts: 1, ValidationFailures: 2}, a.Contention())
+	require.Equal(t, uintptr(64), unsafe.Sizeof(paddedCounter{}))
+}
+
+func TestLenWithConcurrentWrite(t *testing.T) {
+	a := New()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 20000; i++ {
+				k := []byte(fmt.Sprintf("key-%04d", rnd.Intn(2000)))
+				switch rnd.Intn(8) {
+				case 0:
+					a.Delete(k)
+				case 1:
+					a.DeletePrefix(k[:6])
+				case 2:
+					s := a.Snapshot()
+					s.Get(k)
+					s.Release()
+				default:
+					a.Put(k, k)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	n := 0
+	a.Scan(nil, nil, func(key, value []byte) bool {
+		n++
+		return false
+	})
+	checkMemStats(t, a, n)
+}
+
+func TestArena(t *testing.T) {
+	a := New(WithArena(4096))
+	expected := make(map[string][]byte)
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 20000; i++ {
+		k := []byte(fmt.Sprintf("key-%05d", rnd.Intn(5000)))
+		switch rnd.Intn(10) {
+		case 0:
+			a.Delete(k)
+			delete(expected, string(k))
+		case 1:
+			a.DeletePrefix(k[:7])
+			for ek := range expected {
+				if bytes.HasPrefix([]byte(ek), k[:7]) {
+					delete(expected, ek)
+				}
+			}
+		default:
+			v := make([]byte, rnd.Intn(2048))
+			rnd.Read(v)
+			a.Put(k, v)
+			expected[string(k)] = v
+		}
+		if i%1000 == 0 {
+			runtime.GC()
+		}
+	}
+	runtime.GC()
+
+	for k, v := range expected {
+		val, ok := a.Get([]byte(k))
+		require.True(t, ok)
+		require.Equal(t, v, val)
+	}
+	checkMemStats(t, a, len(expected))
+	require.True(t, a.MemStats().Arena >= a.MemStats().Leaf.Bytes)
+
+	inArena := func(a *ART, p unsafe.Pointer) bool {
+		for _, s := range a.alloc.arena.slabs {
+			start := uintptr(unsafe.Pointer(&s[0]))
+			if uintptr(p) >= start && uintptr(p) < start+uintptr(len(s)) {
+				return true
+			}
+		}
+		return false
+	}
+	// inner nodes reference their children by offsets, so they are put in arena with leaves.
+	require.True(t, inArena(a, unsafe.Pointer(a.root)))
+	it := a.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		for _, f := range it.stack {
+			require.True(t, inArena(a, unsafe.Pointer(f.n)))
+		}
+		require.True(t, inArena(a, unsafe.Pointer(it.leaf)))
+	}
+
+	// leaves with header are put in arena too.
+	c := New(WithArena(4096), WithInPlaceUpdate())
+	for k, v := range expected {
+		c.Put([]byte(k), v)
+	}
+	checkMemStats(t, c, len(expected))
+	it = c.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.True(t, inArena(c, unsafe.Pointer(it.leaf.header())))
+	}
+
+	b := BuildFromSorted(sliceIter([][]byte{{1}, {1, 2}, {3}}, [][]byte{{1}, {2}, {3}}), WithArena(0))
+	require.True(t, b.MemStats().Arena == DefaultSlabSize)
+	checkMemStats(t, b, 3)
+}
+
+func TestArenaRelease(t *testing.T) {
+	ids := func() []uint32 {
+		a := New(WithArena(4096))
+		for i := 0; i < 10000; i++ {
+			k := []byte(fmt.Sprintf("key-%05d", i))
+			a.Put(k, k)
+		}
+		table := loadSlabTable()
+		for _, id := range a.alloc.arena.ids {
+			require.NotNil(t, table.bases[id])
+		}
+		return append([]uint32(nil), a.alloc.arena.ids...)
+	}()
+
+	released := func() bool {
+		table := loadSlabTable()
+		for _, id := range ids {
+			if table.bases[id] != nil {
+				return false
+			}
+		}
+		return true
+	}
+	// the slabs are released by the finalizer of arena after the tree is collected.
+	for i := 0; i < 100 && !released(); i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, released())
+}
+
+func TestArenaWithConcurrentWrite(t *testing.T) {
+	a := New(WithArena(1 << 16))
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 20000; i++ {
+				k := []byte(fmt.Sprintf("key-%d-%05d", g, rnd.Intn(5000)))
+				if rnd.Intn(4) == 0 {
+					a.Delete(k)
+				} else {
+					a.Put(k, k)
+				}
+				if i%5000 == 0 {
+					runtime.GC()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	n := 0
+	a.Scan(nil, nil, func(key, value []byte) bool {
+		require.Equal(t, key, value)
+		n++
+		return false
+	})
+	checkMemStats(t, a, n)
+}
+
+func TestReclamation(t *testing.T) {
+	for _, opts := range [][]Option{{WithReclamation()}, {WithReclamation(), WithArena(0)}} {
+		a := New(opts...)
+		r := a.alloc.reclaim
+		freeNode16 := func() int {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return len(r.free[typeNode16])
+		}
+		for round := 0; round < 3; round++ {
+			free := freeNode16()
+			for i := 0; i < 5000; i++ {
+				a.Put([]byte(fmt.Sprintf("%d-%d", i%100, i)), []byte{byte(i)})
+			}
+			checkMemStats(t, a, 5000)
+			if round > 0 {
+				require.True(t, freeNode16() < free)
+			}
+			for i := 0; i < 5000; i++ {
+				k := []byte(fmt.Sprintf("%d-%d", i%100, i))
+				v, ok := a.Get(k)
+				require.True(t, ok)
+				require.Equal(t, []byte{byte(i)}, v)
+				a.Delete(k)
+			}
+			checkMemStats(t, a, 0)
+			require.True(t, freeNode16() > 0)
+		}
+	}
+}
+
+func TestReclamationWithConcurrentRead(t *testing.T) {
+	a := New(WithReclamation())
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 50000; i++ {
+				k := []byte(fmt.Sprintf("%02d-%04d", rnd.Intn(20), rnd.Intn(2000)))
+				switch rnd.Intn(6) {
+				case 0, 1:
+					a.Delete(k)
+				case 2:
+					a.DeletePrefix(k[:3])
+				default:
+					a.Put(k, k)
+				}
+			}
+		}(g)
+	}
+	var readers sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			it := a.NewIterator()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var prev []byte
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+					require.Equal(t, it.Key(), it.Value())
+					require.True(t, bytes.Compare(prev, it.Key()) < 0)
+					prev = it.Key()
+				}
+				a.Scan(nil, nil, func(key, value []byte) bool {
+					require.Equal(t, key, value)
+					return false
+				})
+				s := a.Snapshot()
+				s.Scan(nil, nil, func(key, value []byte) bool {
+					require.Equal(t, key, value)
+					return false
+				})
+				s.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	n := 0
+	a.Scan(nil, nil, func(key, value []byte) bool {
+		n++
+		return false
+	})
+	checkMemStats(t, a, n)
+}
+
+func TestWriteToAndLoad(t *testing.T) {
+	large := make([]byte, 1<<20)
+	rand.Read(large)
+	keys := [][]byte{{}, {1}, {1, 2}, {1, 2, 3}, []byte("key"), []byte("key-large"), []byte("key-prefix-longer-than-8-bytes")}
+	values := [][]byte{[]byte("empty"), {}, {2}, {3}, nil, large, []byte("v")}
+
+	a := New()
+	for i := range keys {
+		a.Put(keys[i], values[i])
+	}
+	for i := 0; i < 1000; i++ {
+		a.Put([]byte(fmt.Sprintf("%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+
+	var buf bytes.Buffer
+	n, err := a.WriteTo(&buf)
+	require.Nil(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+	data := buf.Bytes()
+
+	for _, opts := range [][]Option{nil, {WithArena(0)}} {
+		b, err := Load(bytes.NewReader(data), opts...)
+		require.Nil(t, err)
+		require.Equal(t, collectScan(a, nil, nil, false), collectScan(b, nil, nil, false))
+		for i := range keys {
+			v, ok := b.Get(keys[i])
+			require.True(t, ok)
+			require.Equal(t, len(values[i]), len(v))
+			require.True(t, bytes.Equal(values[i], v))
+		}
+		checkMemStats(t, b, a.Len())
+	}
+
+	var empty bytes.Buffer
+	_, err = New().WriteTo(&empty)
+	require.Nil(t, err)
+	b, err := Load(&empty)
+	require.Nil(t, err)
+	require.Equal(t, 0, b.Len())
+
+	_, err = Load(bytes.NewReader(data[:len(data)-1]))
+	require.Equal(t, ErrInvalidDump, err)
+	_, err = Load(bytes.NewReader(data[:len(data)/2]))
+	require.Equal(t, ErrInvalidDump, err)
+	_, err = Load(bytes.NewReader([]byte("not a dump")))
+	require.Equal(t, ErrInvalidDump, err)
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)/2] ^= 1
+	_, err = Load(bytes.NewReader(corrupted))
+	require.Equal(t, ErrChecksumMismatch, err)
+
+	// the input is read to EOF, with or without buffering.
+	trailing := append(append([]byte{}, data...), "trailing"...)
+	_, err = Load(bytes.NewReader(trailing))
+	require.Equal(t, ErrInvalidDump, err)
+	_, err = Load(struct{ io.Reader }{bytes.NewReader(trailing)})
+	require.Equal(t, ErrInvalidDump, err)
+	b, err = Load(struct{ io.Reader }{bytes.NewReader(data)})
+	require.Nil(t, err)
+	require.Equal(t, a.Len(), b.Len())
+}
+
+func TestWriteToWithConcurrentWrite(t *testing.T) {
+	a := New()
+	for i := 0; i < 10000; i++ {
+		a.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte{0})
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			k := []byte(fmt.Sprintf("key-%05d", i%20000))
+			if i%3 == 0 {
+				a.Delete(k)
+			} else {
+				a.Put(k, []byte{1})
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+		_, err := a.WriteTo(&buf)
+		require.Nil(t, err)
+		b, err := Load(&buf)
+		require.Nil(t, err)
+		prev := -1
+		b.Scan(nil, nil, func(key, value []byte) bool {
+			var k int
+			_, err := fmt.Sscanf(string(key), "key-%d", &k)
+			require.Nil(t, err)
+			require.True(t, k > prev)
+			prev = k
+			return false
+		})
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestIterator(t *testing.T) {
+	a := New()
+	it := a.NewIterator()
+	it.SeekToFirst()
+	require.False(t, it.Valid())
+	it.SeekToLast()
+	require.False(t, it.Valid())
+
+	keys := [][]byte{
+		{},
+		{1},
+		{1, 2},
+		{1, 2, 3},
+		{1, 2, 3, 4},
+		{1, 2, 3, 4, 5},
+		{2, 3},
+		{2, 3, 4},
+		{2, 3, 5},
+		{3, 1},
+		[]byte("abcdefghijklmn"),
+		[]byte("abcdefghijklmn123"),
+		[]byte("abcdefghijklmo123"),
+	}
+	for i := 0; i < 256; i += 3 {
+		keys = append(keys, []byte{4, byte(i)})
+	}
+	putAndCheck(t, a, keys)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, keys[i], it.Key())
+		require.Equal(t, keys[i], it.Value())
+		i++
+	}
+	require.Equal(t, len(keys), i)
+
+	i = len(keys) - 1
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		require.Equal(t, keys[i], it.Key())
+		i--
+	}
+	require.Equal(t, -1, i)
+
+	for i, k := range keys {
+		require.True(t, it.Seek(k))
+		require.Equal(t, k, it.Key())
+		if i > 0 {
+			it.Prev()
+			require.Equal(t, keys[i-1], it.Key())
+			it.Next()
+		}
+		it.Next()
+		if i+1 < len(keys) {
+			require.Equal(t, keys[i+1], it.Key())
+		} else {
+			require.False(t, it.Valid())
+		}
+	}
+
+	seeks := [][]byte{{0}, {1, 2, 3, 3}, {1, 2, 3, 4, 5, 0}, {2}, {2, 3, 4, 0}, {4, 1}, {4, 255, 1}, []byte("abcdefghijklmn2"), []byte("abcdefghijklmz")}
+	for _, k := range seeks {
+		idx := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], k) >= 0 })
+		require.False(t, it.Seek(k))
+		if idx == len(keys) {
+			require.False(t, it.Valid())
+			continue
+		}
+		require.Equal(t, keys[idx], it.Key())
+		if idx > 0 {
+			it.Prev()
+			require.Equal(t, keys[idx-1], it.Key())
+		}
+	}
+}
+
+func TestIteratorWithConcurrentWrite(t *testing.T) {
+	a := New()
+	var stable [][]byte
+	for i := 0; i < 5000; i++ {
+		k := []byte(fmt.Sprintf("key-%06d", i*2))
+		a.Put(k, k)
+		stable = append(stable, k)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := []byte(fmt.Sprintf("key-%06d", rnd.Intn(5000)*2+1))
+				if rnd.Intn(2) == 0 {
+					a.Put(k, k)
+				} else {
+					a.Delete(k)
+				}
+			}
+		}(g)
+	}
+
+	it := a.NewIterator()
+	for i := 0; i < 20; i++ {
+		var (
+			prev   []byte
+			result [][]byte
+		)
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			k := it.Key()
+			require.Equal(t, k, it.Value())
+			require.True(t, prev == nil || bytes.Compare(prev, k) < 0)
+			prev = k
+			if k[len(k)-1]%2 == 0 {
+				result = append(result, k)
+			}
+		}
+		require.Equal(t, stable, result)
+
+		prev, result = nil, result[:0]
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			k := it.Key()
+			require.True(t, prev == nil || bytes.Compare(prev, k) > 0)
+			prev = k
+			if k[len(k)-1]%2 == 0 {
+				result = append(result, k)
+			}
+		}
+		require.Equal(t, expectedRange(stable, nil, nil, true), result)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestIteratorRandomKeys(t *testing.T) {
+	a := New()
+	es := genEntries(100000)
+	keys := make([][]byte, 0, len(es))
+	for _, e := range es {
+		a.Put(e.k[:], e.v)
+		keys = append(keys, e.k[:])
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	it := a.NewIterator()
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, keys[i], it.Key())
+		i++
+	}
+	require.Equal(t, len(keys), i)
+
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 1000; i++ {
+		idx := rnd.Intn(len(keys))
+		k := append([]byte{}, keys[idx]...)
+		k[len(k)-1]++
+		it.Seek(k)
+		next := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], k) >= 0 })
+		if next == len(keys) {
+			require.False(t, it.Valid())
+			continue
+		}
+		require.Equal(t, keys[next], it.Key())
+		if next > 0 {
+			it.Prev()
+			require.Equal(t, keys[next-1], it.Key())
+		}
+	}
+}
+
+func TestIteratorDeleteAndSet(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithInPlaceUpdate()}, {WithReclamation()}} {
+		a := New(opts...)
+		var keys [][]byte
+		for i := 0; i < 1000; i++ {
+			keys = append(keys, []byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("key-%04d-", i)))
+		}
+		putAndCheck(t, a, keys)
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+		// delete every other key and update the others in one forward pass.
+		it := a.NewIterator()
+		var i int
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			require.Equal(t, keys[i], it.Key())
+			if i%2 == 0 {
+				it.Delete()
+				it.Delete()
+				require.Equal(t, keys[i], it.Key())
+			} else {
+				it.Set([]byte("v"))
+				require.Equal(t, []byte("v"), it.Value())
+			}
+			i++
+		}
+		require.Equal(t, len(keys), i)
+		require.Equal(t, len(keys)/2, a.Len())
+		for i, k := range keys {
+			v, ok := a.Get(k)
+			require.Equal(t, i%2 == 1, ok)
+			if ok {
+				require.Equal(t, []byte("v"), v)
+			}
+		}
+
+		// Set after Delete insert the key again.
+		it.SeekToLast()
+		k := it.Key()
+		it.Delete()
+		it.Set(k)
+		require.Equal(t, k, it.Value())
+		v, ok := a.Get(k)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+
+		// delete all keys in a reverse pass, the nodes shrink along the way.
+		i = len(keys) - 1
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			require.Equal(t, keys[i], it.Key())
+			it.Delete()
+			i -= 2
+		}
+		require.Equal(t, -1, i)
+		require.Equal(t, 0, a.Len())
+		it.SeekToFirst()
+		require.False(t, it.Valid())
+	}
+}
+
+func TestSnapshotIteratorReadOnly(t *testing.T) {
+	a := New()
+	keys := [][]byte{{1}, {1, 2}, {2}}
+	for _, k := range keys {
+		a.Put(k, k)
+	}
+	snap := a.Snapshot()
+	defer snap.Release()
+
+	it := snap.NewIterator()
+	it.Seek([]byte{1, 2})
+	require.Panics(t, func() { it.Delete() })
+	require.Panics(t, func() { it.Set([]byte("new")) })
+
+	for _, k := range keys {
+		v, ok := a.Get(k)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+		v, ok = snap.Get(k)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+	}
+}
+
+func TestIteratorDeleteWithConcurrentWrite(t *testing.T) {
+	a := New()
+	for i := 0; i < 5000; i++ {
+		k := []byte(fmt.Sprintf("key-%06d", i*2))
+		a.Put(k, k)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := []byte(fmt.Sprintf("key-%06d", rnd.Intn(5000)*2+1))
+				if rnd.Intn(2) == 0 {
+					a.Put(k, k)
+				} else {
+					a.Delete(k)
+				}
+			}
+		}(g)
+	}
+
+	it := a.NewIterator()
+	var prev []byte
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		k := it.Key()
+		require.True(t, prev == nil || bytes.Compare(prev, k) < 0)
+		prev = k
+		if k[len(k)-1]%2 == 0 {
+			if k[len(k)-2]%2 == 0 {
+				it.Delete()
+			} else {
+				it.Set([]byte("v"))
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for i := 0; i < 5000; i++ {
+		k := []byte(fmt.Sprintf("key-%06d", i*2))
+		v, ok := a.Get(k)
+		if k[len(k)-2]%2 == 0 {
+			require.False(t, ok)
+		} else {
+			require.True(t, ok)
+			require.Equal(t, []byte("v"), v)
+		}
+	}
+}
+
+func TestMinMaxFloorCeil(t *testing.T) {
+	a := New()
+	_, _, ok := a.Min()
+	require.False(t, ok)
+	_, _, ok = a.Max()
+	require.False(t, ok)
+	_, _, ok = a.Floor([]byte{1})
+	require.False(t, ok)
+	_, _, ok = a.Ceil(nil)
+	require.False(t, ok)
+
+	keys := [][]byte{
+		{1},
+		{1, 2},
+		{1, 2, 3},
+		{1, 2, 3, 4, 5},
+		{2, 3},
+		{2, 3, 4},
+		{2, 3, 5},
+		{3, 1},
+		[]byte("abcdefghijklmn"),
+		[]byte("abcdefghijklmn123"),
+		[]byte("abcdefghijklmo123"),
+	}
+	for i := 0; i < 256; i += 3 {
+		keys = append(keys, []byte{4, byte(i)}, []byte{5, byte(i), 0})
+	}
+	putAndCheck(t, a, keys)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	k, v, ok := a.Min()
+	require.True(t, ok)
+	require.Equal(t, keys[0], k)
+	require.Equal(t, keys[0], v)
+	k, _, ok = a.Max()
+	require.True(t, ok)
+	require.Equal(t, keys[len(keys)-1], k)
+
+	checkNearest := func(key []byte) {
+		idx := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], key) >= 0 })
+		k, v, ok := a.Ceil(key)
+		require.Equal(t, idx < len(keys), ok, "%v", key)
+		if ok {
+			require.Equal(t, keys[idx], k, "%v", key)
+			require.Equal(t, keys[idx], v)
+		}
+
+		if idx == len(keys) || !bytes.Equal(keys[idx], key) {
+			idx--
+		}
+		k, _, ok = a.Floor(key)
+		require.Equal(t, idx >= 0, ok, "%v", key)
+		if ok {
+			require.Equal(t, keys[idx], k, "%v", key)
+		}
+	}
+	for _, k := range keys {
+		checkNearest(k)
+		checkNearest(append(append([]byte{}, k...), 0))
+		checkNearest(k[:len(k)-1])
+		prev := append([]byte{}, k...)
+		prev[len(prev)-1]--
+		checkNearest(prev)
+		next := append([]byte{}, k...)
+		next[len(next)-1]++
+		checkNearest(next)
+	}
+	for _, k := range [][]byte{nil, {0}, {1, 2, 3, 4}, {2}, {4, 1, 1}, {5, 255}, {6}, []byte("abcdefghijklmn2"), []byte("abcdefghijklmz")} {
+		checkNearest(k)
+	}
+
+	a.Put(nil, []byte("empty"))
+	k, v, ok = a.Min()
+	require.True(t, ok)
+	require.Empty(t, k)
+	require.Equal(t, []byte("empty"), v)
+	k, _, ok = a.Floor([]byte{0})
+	require.True(t, ok)
+	require.Empty(t, k)
+}
+
+func TestFloorCeilWithConcurrentWrite(t *testing.T) {
+	a := New()
+	for i := 0; i < 5000; i++ {
+		k := []byte(fmt.Sprintf("key-%06d", i*4))
+		a.Put(k, k)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				k := []byte(fmt.Sprintf("key-%06d", rnd.Intn(5000)*4+1+rnd.Intn(3)))
+				if rnd.Intn(2) == 0 {
+					a.Put(k, k)
+				} else {
+					a.Delete(k)
+				}
+			}
+		}(g)
+	}
+
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 100000; i++ {
+		n := rnd.Intn(5000-2)*4 + 4
+		key := []byte(fmt.Sprintf("key-%06d", n+2))
+		k, v, ok := a.Ceil(key)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+		require.True(t, bytes.Compare(k, key) >= 0)
+		require.True(t, bytes.Compare(k, []byte(fmt.Sprintf("key-%06d", n+4))) <= 0)
+
+		k, v, ok = a.Floor(key)
+		require.True(t, ok)
+		require.Equal(t, k, v)
+		require.True(t, bytes.Compare(k, key) <= 0)
+		require.True(t, bytes.Compare(k, []byte(fmt.Sprintf("key-%06d", n))) >= 0)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestMap(t *testing.T) {
+	m := NewMap(Int64Key, StringValue)
+	keys := rand.Perm(2000)
+	for _, k := range keys {
+		m.Put(int64(k-1000), fmt.Sprint(k-1000))
+	}
+	m.Put(0, "")
+	require.Equal(t, 2000, m.Len())
+
+	for k := int64(-1000); k < 1000; k++ {
+		v, ok := m.Get(k)
+		require.True(t, ok)
+		if k == 0 {
+			require.Equal(t, "", v)
+		} else {
+			require.Equal(t, fmt.Sprint(k), v)
+		}
+	}
+	_, ok := m.Get(1000)
+	require.False(t, ok)
+
+	for k := int64(-1000); k < 1000; k += 2 {
+		m.Delete(k)
+	}
+	require.Equal(t, 1000, m.Len())
+
+	// negative keys must be visited before positive keys.
+	start, end := int64(-100), int64(100)
+	expected := int64(-99)
+	m.Scan(&start, &end, func(key int64, value string) bool {
+		require.Equal(t, expected, key)
+		expected += 2
+		return false
+	})
+	require.Equal(t, end+1, expected)
+
+	var count int
+	m.Scan(nil, nil, func(key int64, value string) bool {
+		count++
+		return false
+	})
+	require.Equal(t, 1000, count)
+}
+
+func TestMapWithStringKey(t *testing.T) {
+	m := NewMap(StringKey, BytesValue)
+	keys := []string{"", "\x00", "\x00\x00", "\x00\x01", "a", "a\x00", "a\x00b", "ab", "b"}
+	for _, i := range rand.Perm(len(keys)) {
+		m.Put(keys[i], []byte(keys[i]))
+	}
+	var i int
+	m.Scan(nil, nil, func(key string, value []byte) bool {
+		require.Equal(t, keys[i], key)
+		require.Equal(t, []byte(keys[i]), value)
+		i++
+		return false
+	})
+	require.Equal(t, len(keys), i)
+
+	v, ok := m.Get("a\x00")
+	require.True(t, ok)
+	require.Equal(t, []byte("a\x00"), v)
+
+	// the range ends at the empty key is empty, it must not be taken as unbounded.
+	start, end := "", ""
+	for _, s := range []*string{nil, &start} {
+		m.Scan(s, &end, func(key string, value []byte) bool {
+			require.Fail(t, "unexpected key", "%q", key)
+			return false
+		})
+	}
+}
+
+func TestMapWithFloat64Key(t *testing.T) {
+	m := NewMap(Float64Key, StringValue)
+	keys := []float64{math.Inf(-1), -1e10, -1, -0.5, 0, 0.5, 1, 1e10, math.Inf(1)}
+	for _, i := range rand.Perm(len(keys)) {
+		m.Put(keys[i], fmt.Sprint(keys[i]))
+	}
+	m.Put(math.Copysign(0, -1), "-0")
+	var i int
+	m.Scan(nil, nil, func(key float64, value string) bool {
+		require.Equal(t, keys[i], key)
+		i++
+		return false
+	})
+	require.Equal(t, len(keys), i)
+
+	v, ok := m.Get(0)
+	require.True(t, ok)
+	require.Equal(t, "-0", v)
+
+	// NaN is encoded by keyenc, which sorts it after +Inf regardless of its sign.
+	m.Put(math.Copysign(math.NaN(), -1), "NaN")
+	var last float64
+	m.Scan(nil, nil, func(key float64, value string) bool {
+		last = key
+		return false
+	})
+	require.True(t, math.IsNaN(last))
+}
+
+func TestInPlaceUpdate(t *testing.T) {
+	for _, opts := range [][]Option{{WithInPlaceUpdate()}, {WithInPlaceUpdate(), WithArena(0)}} {
+		a := New(opts...)
+		keys := [][]byte{{1}, {1, 2}, {1, 2, 3}, {2}}
+		for _, k := range keys {
+			a.Put(k, []byte("aaaa"))
+		}
+		leaves := make([]*leaf, len(keys))
+		for i, k := range keys {
+			leaves[i], _ = a.root.search(nil, k, 0, &a.dummy, a.dummy.waitUnlock(nil))
+		}
+		checkMemStats(t, a, len(keys))
+		arena := a.MemStats().Arena
+
+		// the leaf is reused for both shorter and longer values which fit in it, including the prefixLeaf.
+		for _, value := range [][]byte{[]byte("bb"), []byte("cccccc"), {}, []byte("bb")} {
+			for _, k := range keys {
+				a.Put(k, value)
+			}
+			for i, k := range keys {
+				l, _ := a.root.search(nil, k, 0, &a.dummy, a.dummy.waitUnlock(nil))
+				require.True(t, leaves[i] == l)
+				v, ok := a.Get(k)
+				require.True(t, ok)
+				require.Equal(t, value, v)
+			}
+			checkMemStats(t, a, len(keys))
+		}
+		require.Equal(t, arena, a.MemStats().Arena)
+		require.True(t, a.CompareAndSwap(keys[0], []byte("bb"), []byte("dddd")))
+		l, _ := a.root.search(nil, keys[0], 0, &a.dummy, a.dummy.waitUnlock(nil))
+		require.True(t, leaves[0] == l)
+
+		// a value which doesn't fit needs a new leaf.
+		large := bytes.Repeat([]byte{'h'}, 64)
+		a.Put(keys[1], large)
+		l, _ = a.root.search(nil, keys[1], 0, &a.dummy, a.dummy.waitUnlock(nil))
+		require.True(t, leaves[1] != l)
+		v, _ := a.Get(keys[1])
+		require.Equal(t, large, v)
+		checkMemStats(t, a, len(keys))
+
+		// the leaves reachable from snapshot must not be modified.
+		s := a.Snapshot()
+		a.Put(keys[2], []byte("e"))
+		l, _ = a.root.search(nil, keys[2], 0, &a.dummy, a.dummy.waitUnlock(nil))
+		require.True(t, leaves[2] != l)
+		v, _ = s.Get(keys[2])
+		require.Equal(t, []byte("bb"), v)
+		v, _ = a.Get(keys[2])
+		require.Equal(t, []byte("e"), v)
+		s.Release()
+
+		// the returned values are copied, so they are not modified by later updates.
+		v, _ = a.Get(keys[3])
+		existing, inserted := a.PutIfAbsent(keys[3], []byte("f"))
+		require.False(t, inserted)
+		it := a.NewIterator()
+		require.True(t, it.Seek(keys[3]))
+		iv := it.Value()
+		var sv []byte
+		a.Scan(keys[3], nil, func(key, value []byte) bool {
+			sv = value
+			return true
+		})
+		a.Put(keys[3], []byte("gg"))
+		l, _ = a.root.search(nil, keys[3], 0, &a.dummy, a.dummy.waitUnlock(nil))
+		require.True(t, leaves[3] == l)
+		for _, v := range [][]byte{v, existing, iv, sv} {
+			require.Equal(t, []byte("bb"), v)
+		}
+		checkMemStats(t, a, len(keys))
+	}
+}
+
+func TestInPlaceUpdateAllocs(t *testing.T) {
+	key := []byte("counter")
+	value := make([]byte, 8)
+	plain := New()
+	plain.Put(key, value)
+	// enabled failpoints allocate, Put of a tree without in place update passes the same failpoints
+	// and allocates nothing else but the new leaf.
+	putAllocs := testing.AllocsPerRun(100, func() {
+		plain.Put(key, value)
+	})
+
+	for _, opts := range [][]Option{{WithInPlaceUpdate()}, {WithInPlaceUpdate(), WithArena(1 << 12)}} {
+		a := New(opts...)
+		for i := 0; i < 100; i++ {
+			a.Put([]byte(fmt.Sprint(i)), value)
+		}
+		a.Put(key, value)
+		memStats := a.MemStats()
+		var i uint64
+		allocs := testing.AllocsPerRun(100, func() {
+			i++
+			binary.BigEndian.PutUint64(value, i)
+			a.Put(key, value)
+		})
+		require.Equal(t, putAllocs-1, allocs)
+
+		// the arena doesn't grow when the same keys are updated repeatedly.
+		for i := 0; i < 10000; i++ {
+			a.Put([]byte(fmt.Sprint(i%100)), value[:i%9])
+		}
+		require.Equal(t, memStats, a.MemStats())
+		v, _ := a.Get(key)
+		require.Equal(t, value, v)
+	}
+}
+
+func TestAppendValue(t *testing.T) {
+	keys := [][]byte{{1}, {1, 2}, {2}}
+	plain := New()
+	for _, k := range keys {
+		plain.Put(k, bytes.Repeat(k, 10))
+	}
+	// enabled failpoints allocate, Get of a tree without in place update passes the same failpoints and doesn't copy values.
+	getAllocs := testing.AllocsPerRun(100, func() {
+		_, _ = plain.Get([]byte{2})
+	})
+
+	for _, opts := range [][]Option{nil, {WithInPlaceUpdate()}} {
+		a := New(opts...)
+		for _, k := range keys {
+			a.Put(k, bytes.Repeat(k, 10))
+		}
+		buf, ok := a.AppendValue([]byte("prefix"), []byte{1, 2})
+		require.True(t, ok)
+		require.Equal(t, append([]byte("prefix"), bytes.Repeat([]byte{1, 2}, 10)...), buf)
+		buf, ok = a.AppendValue(buf[:0], []byte{3})
+		require.False(t, ok)
+		require.Empty(t, buf)
+
+		it := a.NewIterator()
+		var i int
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			buf = it.AppendValue(buf[:0])
+			require.Equal(t, bytes.Repeat(keys[i], 10), buf)
+			i++
+		}
+		require.Equal(t, len(keys), i)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			buf, _ = a.AppendValue(buf[:0], []byte{2})
+		})
+		require.Equal(t, getAllocs, allocs)
+		// the values of trees which update in place are copied by Get.
+		allocs = testing.AllocsPerRun(100, func() {
+			_, _ = a.Get([]byte{2})
+		})
+		if a.alloc.inPlace {
+			require.Equal(t, getAllocs+1, allocs)
+		} else {
+			require.Equal(t, getAllocs, allocs)
+		}
+	}
+}
+
+func TestInPlaceUpdateWithConcurrentRead(t *testing.T) {
+	const (
+		numKeys   = 100
+		numReader = 4
+	)
+	a := New(WithInPlaceUpdate())
+	for i := 0; i < numKeys; i++ {
+		a.Put([]byte(fmt.Sprint(i)), bytes.Repeat([]byte{'a'}, 16))
+	}
+
+	// every value is filled with the same byte, so a torn value has different bytes or unexpected length.
+	// The values are checked again after the writer finished, they must not be modified by later updates.
+	checkValue := func(v []byte) {
+		require.True(t, len(v) >= 8 && len(v) <= 16, "%v", v)
+		require.Equal(t, bytes.Repeat(v[:1], len(v)), v)
+	}
+	var (
+		done int32
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < numReader; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var retained [][]byte
+			for atomic.LoadInt32(&done) == 0 {
+				v, ok := a.Get([]byte(fmt.Sprint(rand.Intn(numKeys))))
+				require.True(t, ok)
+				checkValue(v)
+				retained = append(retained, v)
+				a.Scan(nil, nil, func(key, value []byte) bool {
+					checkValue(value)
+					return false
+				})
+			}
+			for _, v := range retained {
+				checkValue(v)
+			}
+		}()
+	}
+
+	for i := 0; i < 100000; i++ {
+		a.Put([]byte(fmt.Sprint(i%numKeys)), bytes.Repeat([]byte{byte('a' + i%26)}, 8+i%9))
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+	checkMemStats(t, a, numKeys)
+}
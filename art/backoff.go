@@ -0,0 +1,86 @@
+package art
+
+import (
+	"runtime"
+	"time"
+)
+
+// Backoff is the policy to wait for a locked node.
+// Operations on ART never block on locks, they read the version of a node repeatedly until it is unlocked,
+// and call Wait between two reads.
+type Backoff interface {
+	// Wait is called each time the node is found locked, attempt is the number of times
+	// Wait has been called for the same node.
+	Wait(attempt int)
+}
+
+// defaultBackoff is the backoff used by trees created without WithBackoff.
+var defaultBackoff = YieldBackoff(30)
+
+// WithBackoff sets the policy to wait for locked nodes, the default is YieldBackoff(30).
+func WithBackoff(b Backoff) Option {
+	return func(t *ART) {
+		t.contention.backoff = b
+	}
+}
+
+// SpinBackoff returns a Backoff which keeps spinning on the locked node.
+// It has the lowest latency when locks are held shortly and there are enough idle CPUs.
+func SpinBackoff() Backoff {
+	return spinBackoff{}
+}
+
+// YieldBackoff returns a Backoff which yields the processor every spins attempts.
+func YieldBackoff(spins int) Backoff {
+	if spins <= 0 {
+		spins = 1
+	}
+	return yieldBackoff{spins: spins}
+}
+
+// ExponentialBackoff returns a Backoff which spins for the first spins attempts, then sleeps
+// from min and doubles the sleep time after each attempt until it reaches max.
+// It reduces the CPU burned by waiters under heavy write contention on hot keys.
+func ExponentialBackoff(spins int, min, max time.Duration) Backoff {
+	if min <= 0 {
+		min = time.Microsecond
+	}
+	if max < min {
+		max = min
+	}
+	return exponentialBackoff{spins: spins, min: min, max: max}
+}
+
+type spinBackoff struct{}
+
+func (spinBackoff) Wait(int) {}
+
+type yieldBackoff struct {
+	spins int
+}
+
+func (b yieldBackoff) Wait(attempt int) {
+	if (attempt+1)%b.spins == 0 {
+		runtime.Gosched()
+	}
+}
+
+type exponentialBackoff struct {
+	spins    int
+	min, max time.Duration
+}
+
+func (b exponentialBackoff) Wait(attempt int) {
+	if attempt < b.spins {
+		return
+	}
+	time.Sleep(b.delay(attempt - b.spins))
+}
+
+// delay returns the sleep time after shift sleeps, min is checked before shift so it never overflows.
+func (b exponentialBackoff) delay(shift int) time.Duration {
+	if shift < 63 && b.min <= b.max>>uint(shift) {
+		return b.min << uint(shift)
+	}
+	return b.max
+}
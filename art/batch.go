@@ -0,0 +1,300 @@
+package art
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// batchGuardKeys is the number of keys inserted by PutBatch under one reclamation guard,
+// so a large batch doesn't block the epoch advancement until it finishes.
+const batchGuardKeys = 64
+
+// PutBatch put the given keys and values into this tree, the keys should be sorted in ascending order.
+// Instead of starting every insertion from root, PutBatch remember the path of the last inserted key,
+// and restart from the deepest node shared by the last key and current key.
+// When a full node must grow, the following keys are used to decide the final size of it.
+// Unsorted keys are still inserted correctly, but the batch will degenerate to sequential Put.
+// This operation is thread safe, but it is not atomic.
+func (t *ART) PutBatch(keys, values [][]byte) {
+	if len(keys) != len(values) {
+		panic("art: keys and values have different length")
+	}
+
+	b := newBatchCursor(t, keys)
+	for i := 0; i < len(keys); i += batchGuardKeys {
+		b.insertRange(i, values)
+	}
+}
+
+// insertRange inserts at most batchGuardKeys keys from start under one reclamation guard.
+// The frames are kept across guards, the nodes in frames may be reused after the guard exited,
+// but their versions keep increasing, so they will fail to validate and the insertion restarts from root.
+func (b *batchCursor) insertRange(start int, values [][]byte) {
+	end := start + batchGuardKeys
+	if end > len(b.keys) {
+		end = len(b.keys)
+	}
+	defer b.t.enter().exit()
+	for i := start; i < end; i++ {
+		b.pos = i
+		for !b.insert(b.keys[i], values[i]) {
+			b.frames = b.frames[:0]
+			b.t.contention.restart()
+		}
+	}
+}
+
+// batchCursor remembers the path of the last inserted key of PutBatch.
+type batchCursor struct {
+	t    *ART
+	keys [][]byte
+	// lcp[i] is the longest common prefix length of keys[i-1] and keys[i].
+	lcp []uint32
+	// skip[i] is the first j > i with lcp[j] < lcp[i], or len(keys) if there is no such j.
+	// The keys in [i, skip[i]) share a prefix of lcp[i] bytes, so they are in the same subtree below it.
+	skip   []uint32
+	pos    int
+	frames []batchFrame
+}
+
+// batchFrame is an inner node on the path of the last inserted key.
+type batchFrame struct {
+	n *node
+	// version is the version of n after the last insertion, the frame is stale if n's version changed.
+	version uint64
+	// depth is the depth of n.
+	depth uint32
+	loc   link
+}
+
+func newBatchCursor(t *ART, keys [][]byte) *batchCursor {
+	lcp := make([]uint32, len(keys))
+	for i := 1; i < len(keys); i++ {
+		a, b := keys[i-1], keys[i]
+		l := min(uint32(len(a)), uint32(len(b)))
+		var j uint32
+		for j < l && a[j] == b[j] {
+			j++
+		}
+		lcp[i] = j
+	}
+
+	skip := make([]uint32, len(keys))
+	var stack []uint32
+	for i := len(keys) - 1; i > 0; i-- {
+		for len(stack) > 0 && lcp[stack[len(stack)-1]] >= lcp[i] {
+			stack = stack[:len(stack)-1]
+		}
+		skip[i] = uint32(len(keys))
+		if len(stack) > 0 {
+			skip[i] = stack[len(stack)-1]
+		}
+		stack = append(stack, uint32(i))
+	}
+	return &batchCursor{t: t, keys: keys, lcp: lcp, skip: skip}
+}
+
+func (b *batchCursor) push(n *node, version uint64, depth uint32, loc link) {
+	b.frames = append(b.frames, batchFrame{n: n, version: version, depth: depth, loc: loc})
+}
+
+// pushNew push the node at loc created by the current insertion. Its parent must be locked,
+// so the version of it can't be changed by other writers. A node reused from free list has a non-zero version.
+func (b *batchCursor) pushNew(loc link, depth uint32) {
+	n := loc.load()
+	b.push(n, atomic.LoadUint64(&n.version), depth, loc)
+}
+
+// fanout estimates the number of children will be inserted into a node at depth
+// by the current key and the following keys, the result is at most limit.
+// The keys below a child are skipped at once, so the cost is bounded by the fanout instead of the keys in the node.
+func (b *batchCursor) fanout(depth uint32, limit int) int {
+	cnt := 1
+	for i := b.pos + 1; i < len(b.keys) && b.lcp[i] >= depth && cnt < limit; {
+		if b.lcp[i] == depth {
+			cnt++
+			i++
+		} else {
+			i = int(b.skip[i])
+		}
+	}
+	return cnt
+}
+
+// insert insert key into t, start from the deepest valid node in frames.
+// It returns false if the insertion should restart from root.
+func (b *batchCursor) insert(key, value []byte) bool {
+	k := len(b.frames) - 1
+	for k > 0 && b.frames[k].depth > b.lcp[b.pos] {
+		k--
+	}
+	if k <= 0 {
+		b.frames = b.frames[:0]
+		return b.insertFrom(b.t.root, key, value, 0, &b.t.dummy, b.t.dummy.waitUnlock(&b.t.contention), b.t.rootLink())
+	}
+
+	// all nodes from root to parent must not change since the last insertion,
+	// so the start node is still reachable by current key at the recorded depth.
+	for i := 0; i < k; i++ {
+		if !b.frames[i].n.lockCheck(&b.t.contention, b.frames[i].version) {
+			return false
+		}
+	}
+	start, parent := b.frames[k], b.frames[k-1]
+	b.frames = b.frames[:k]
+	return b.insertFrom(start.n, key, value, start.depth, parent.n, parent.version, start.loc)
+}
+
+// insertFrom is the same as insert, but record the path into frames.
+//
+//go:norace
+func (b *batchCursor) insertFrom(n *node, key []byte, value []byte, depth uint32, parent *node, parentVersion uint64, nodeLoc link) bool {
+	var (
+		version  uint64
+		ok       bool
+		nextNode *node
+		nextLoc  link
+		currNode = n
+		cont     = &b.t.contention
+	)
+
+	for {
+		if version, ok = currNode.rLock(cont); !ok {
+			return false
+		}
+
+		p, fullKey, ok := currNode.prefixMismatch(cont, key, depth, parent, version, parentVersion)
+		if !ok {
+			return false
+		}
+
+		// split current node due to prefix mismatch.
+		if p != currNode.prefixLen {
+			if !parent.upgradeToLock(cont, parentVersion) {
+				return false
+			}
+			if !currNode.upgradeToLockWithNode(cont, version, parent) {
+				return false
+			}
+			w, ok := b.t.lockedWriter(key, currNode, parent, true)
+			if !ok {
+				return false
+			}
+
+			currNode.insertSplitPrefix(key, fullKey, value, depth, p, nodeLoc, w)
+			b.updateLast(parent, parentVersion)
+			b.pushNew(nodeLoc, depth)
+
+			currNode.unlock()
+			parent.unlock()
+			return true
+		}
+		b.push(currNode, version, depth, nodeLoc)
+		depth += currNode.prefixLen
+
+		if depth == uint32(len(key)) {
+			if !currNode.upgradeToLock(cont, version) {
+				return false
+			}
+			if !parent.rUnlockWithNode(cont, parentVersion, currNode) {
+				return false
+			}
+			w, ok := b.t.lockedWriter(key, currNode, parent, false)
+			if !ok {
+				return false
+			}
+
+			currNode.updatePrefixLeaf(key, value, w)
+			b.updateLast(currNode, version)
+
+			currNode.unlock()
+			return true
+		}
+
+		nextNode, nextLoc, _ = currNode.findChild(key[depth])
+		if !currNode.lockCheck(cont, version) {
+			return false
+		}
+
+		// no exist key, insert it directly.
+		if nextNode == nil {
+			if currNode.isFull() {
+				if !parent.upgradeToLock(cont, parentVersion) {
+					return false
+				}
+				if !currNode.upgradeToLockWithNode(cont, version, parent) {
+					return false
+				}
+				w, ok := b.t.lockedWriter(key, currNode, parent, true)
+				if !ok {
+					return false
+				}
+
+				size := int(currNode.numChildren) + b.fanout(depth, 256-int(currNode.numChildren))
+				currNode.growToAndInsert(key[depth], w.newLeaf(key, value).toNode(), size, nodeLoc, w)
+				b.frames = b.frames[:len(b.frames)-1]
+				b.updateLast(parent, parentVersion)
+				b.pushNew(nodeLoc, depth-currNode.prefixLen)
+
+				w.retire(currNode)
+				parent.unlock()
+			} else {
+				if !currNode.upgradeToLock(cont, version) {
+					return false
+				}
+				if !parent.rUnlockWithNode(cont, parentVersion, currNode) {
+					return false
+				}
+				w, ok := b.t.lockedWriter(key, currNode, parent, false)
+				if !ok {
+					return false
+				}
+
+				currNode.insertChild(key[depth], w.newLeaf(key, value).toNode())
+				b.updateLast(currNode, version)
+
+				currNode.unlock()
+			}
+			return true
+		}
+
+		// step to next level.
+
+		if !parent.rUnlock(cont, parentVersion) {
+			return false
+		}
+
+		if nextNode.nodeType == typeLeaf {
+			if !currNode.upgradeToLock(cont, version) {
+				return false
+			}
+			w, ok := b.t.lockedWriter(key, currNode, parent, false)
+			if !ok {
+				return false
+			}
+
+			l := (*leaf)(unsafe.Pointer(nextNode))
+			l.updateOrExpand(key, value, depth+1, nextLoc, w)
+			b.updateLast(currNode, version)
+			if nextLoc.load().nodeType != typeLeaf {
+				b.pushNew(nextLoc, depth+1)
+			}
+
+			currNode.unlock()
+			return true
+		}
+
+		depth += 1
+		parent = currNode
+		parentVersion = version
+		nodeLoc = nextLoc
+		currNode = nextNode
+	}
+}
+
+// updateLast set the version of n in frames to the version after it is locked by version and then unlocked.
+func (b *batchCursor) updateLast(n *node, version uint64) {
+	if len(b.frames) > 0 && b.frames[len(b.frames)-1].n == n {
+		b.frames[len(b.frames)-1].version = version + 4
+	}
+}
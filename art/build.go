@@ -0,0 +1,137 @@
+package art
+
+import (
+	"bytes"
+	"unsafe"
+)
+
+// BuildFromSorted build a new ART from a stream of key value pairs in ascending order of key.
+// The iter is called repeatedly until it returns false, and it will panic if keys are not sorted.
+// For duplicated keys, the last value will be used.
+// The returned key and value can be reused by iter after next call, as they will be copied into the tree.
+// The tree is built bottom-up in one pass without any locking, and the returned ART can be updated as usual.
+// The opts are the same as New.
+func BuildFromSorted(iter func() (key, value []byte, ok bool), opts ...Option) *ART {
+	t := newTree(opts)
+	b := &treeBuilder{w: t.loadWriter(), stack: make([]buildFrame, 1, 16)}
+	for {
+		key, value, ok := iter()
+		if !ok {
+			break
+		}
+		b.add(key, value)
+	}
+	t.root = b.finish()
+	return t
+}
+
+// buildFrame is an inner node on the path of the last added key, which may still receive new children.
+type buildFrame struct {
+	// depth is the depth of children in this node, which equals to node's depth plus prefixLen.
+	depth      uint32
+	prefixLeaf *leaf
+	keys       []byte
+	children   []*node
+}
+
+// treeBuilder builds ART from sorted keys. The stack holds frames on the path of the last added key,
+// and the subtree contains the last added key is pending until the next key decide where to put it.
+// The first frame is the root with depth 0.
+type treeBuilder struct {
+	w     writer
+	stack []buildFrame
+	// prev is the last added key.
+	prev         []byte
+	pending      *node
+	pendingDepth uint32
+}
+
+func (b *treeBuilder) add(key, value []byte) {
+	l := b.w.newLeaf(key, value)
+	if b.pending != nil {
+		cmp := bytes.Compare(b.prev, key)
+		if cmp > 0 {
+			panic("art: keys are not in ascending order")
+		}
+		// the pending subtree is always the leaf of prev here, replace it.
+		if cmp == 0 {
+			b.w.freeLeaf((*leaf)(unsafe.Pointer(b.pending)))
+			b.pending, b.prev = l.toNode(), l.key()
+			return
+		}
+
+		var (
+			lcp uint32
+			end = min(uint32(len(b.prev)), uint32(len(key)))
+		)
+		for lcp < end && b.prev[lcp] == key[lcp] {
+			lcp++
+		}
+		b.flush(lcp)
+		if b.stack[len(b.stack)-1].depth < lcp {
+			b.push(lcp)
+		}
+		b.attach(&b.stack[len(b.stack)-1])
+	}
+	b.pending, b.prev = l.toNode(), l.key()
+}
+
+// flush pop all frames whose depth is greater than depth, and build them into nodes.
+func (b *treeBuilder) flush(depth uint32) {
+	for {
+		f := &b.stack[len(b.stack)-1]
+		if f.depth <= depth {
+			return
+		}
+		b.attach(f)
+		b.pending, b.pendingDepth = f.build(b.w), f.depth
+		b.stack = b.stack[:len(b.stack)-1]
+	}
+}
+
+func (b *treeBuilder) push(depth uint32) {
+	if len(b.stack) == cap(b.stack) {
+		b.stack = append(b.stack, buildFrame{})
+	} else {
+		b.stack = b.stack[:len(b.stack)+1]
+	}
+	f := &b.stack[len(b.stack)-1]
+	f.depth = depth
+	f.prefixLeaf = nil
+	f.keys = f.keys[:0]
+	f.children = f.children[:0]
+}
+
+// attach put the pending subtree into f, the compressed path of it is decided by f's depth.
+func (b *treeBuilder) attach(f *buildFrame) {
+	n := b.pending
+	if n.nodeType == typeLeaf {
+		if uint32(len(b.prev)) == f.depth {
+			f.prefixLeaf = (*leaf)(unsafe.Pointer(n))
+			return
+		}
+	} else {
+		n.prefixLen = b.pendingDepth - f.depth - 1
+		start := f.depth + 1
+		copy(n.prefix[:], b.prev[start:start+min(n.prefixLen, maxPrefixLen)])
+	}
+	f.keys = append(f.keys, b.prev[f.depth])
+	f.children = append(f.children, n)
+}
+
+func (b *treeBuilder) finish() *node {
+	if b.pending != nil {
+		b.flush(0)
+		b.attach(&b.stack[0])
+	}
+	return b.stack[0].build(b.w)
+}
+
+func (f *buildFrame) build(w writer) *node {
+	n := w.newNodeWithSize(len(f.children))
+	n.storePrefixLeaf(f.prefixLeaf)
+	for i, c := range f.children {
+		n.insertChild(f.keys[i], c)
+	}
+	return n
+}
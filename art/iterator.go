@@ -0,0 +1,589 @@
+package art
+
+import (
+	"bytes"
+	"unsafe"
+)
+
+// Iterator is a stateful bidirectional iterator of ART.
+// It is safe to use an iterator while other goroutines update the tree, but an iterator itself
+// must not be used by multiple goroutines concurrently.
+// The iterator holds the nodes on path from root to current key with their versions.
+// If any of these nodes is modified or obsoleted by writers, the iterator will re-seek from the current key.
+// The iterator doesn't hold a reclamation guard between calls, a reused node always has a newer version
+// than the one in the iterator, so it is handled as modified.
+type Iterator struct {
+	t     *ART
+	stack []iterFrame
+	leaf  *leaf
+	// removed is true if the current key has been deleted by Delete.
+	removed bool
+	// readOnly is true for iterators of Snapshot, whose nodes are shared with the tree.
+	readOnly bool
+}
+
+// iterFrame is a node on the path from root to current key.
+type iterFrame struct {
+	n       *node
+	version uint64
+	// depth is the depth of children in this node, which equals to node's depth plus prefixLen.
+	depth uint32
+	// key is the child key which the iterator currently at, -1 means the iterator is at the prefixLeaf.
+	key int
+}
+
+// NewIterator returns a new iterator of ART. The returned iterator is invalid until it is positioned by seek.
+func (t *ART) NewIterator() *Iterator {
+	return &Iterator{t: t}
+}
+
+// Valid returns the valid status of iterator.
+func (it *Iterator) Valid() bool {
+	return it.leaf != nil
+}
+
+// Key returns the key where the iterator at.
+// The returned slice must not be modified.
+func (it *Iterator) Key() []byte {
+	return it.leaf.key()
+}
+
+// Value returns the value where the iterator at.
+// The returned slice must not be modified.
+func (it *Iterator) Value() []byte {
+	return it.t.alloc.leafValue(it.leaf)
+}
+
+// AppendValue appends the value where the iterator at to dst, and returns the extended buffer.
+// The appended value can be modified by the caller.
+func (it *Iterator) AppendValue(dst []byte) []byte {
+	return it.t.alloc.appendLeafValue(dst, it.leaf)
+}
+
+// Seek move the iterator to the first key greater or equals to key.
+// It returns true if the iterator is positioned at the given key.
+func (it *Iterator) Seek(key []byte) bool {
+	defer it.t.enter().exit()
+	for !it.seek(key, true, false) {
+		it.t.contention.restart()
+	}
+	return it.Valid() && bytes.Equal(it.Key(), key)
+}
+
+// SeekToFirst move the iterator to the first key in ART.
+func (it *Iterator) SeekToFirst() {
+	defer it.t.enter().exit()
+	for !it.seek(nil, true, false) {
+		it.t.contention.restart()
+	}
+}
+
+// SeekToLast move the iterator to the last key in ART.
+func (it *Iterator) SeekToLast() {
+	defer it.t.enter().exit()
+	for {
+		it.reset()
+		root, version, ok := it.t.rootNode()
+		if ok && it.descendLast(root, version, 0) && (it.leaf != nil || it.prev()) {
+			return
+		}
+		it.t.contention.restart()
+	}
+}
+
+// Next move the iterator to next key.
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	defer it.t.enter().exit()
+	key := it.Key()
+	if it.next() {
+		return
+	}
+	it.t.contention.restart()
+	for !it.seek(key, false, false) {
+		it.t.contention.restart()
+	}
+}
+
+// Prev move the iterator to previous key.
+func (it *Iterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+	defer it.t.enter().exit()
+	key := it.Key()
+	if it.prev() {
+		return
+	}
+	it.t.contention.restart()
+	for !it.seek(key, false, true) {
+		it.t.contention.restart()
+	}
+}
+
+// Delete delete the key where the iterator at from the tree.
+// The iterator stays at the deleted key, so Key and Value still return the deleted key and value,
+// and Next or Prev move to its neighbours as usual.
+// The nodes on path held by the iterator are locked directly, the deletion restarts from root
+// only if any of them has been modified since the iterator moved here.
+// Delete panics on iterators of Snapshot.
+func (it *Iterator) Delete() {
+	it.checkWritable()
+	if !it.Valid() || it.removed {
+		return
+	}
+	defer it.t.enter().exit()
+	t := it.t
+	if !it.remove() {
+		t.contention.restart()
+		key := it.Key()
+		for !t.root.remove(t, key, 0, &t.dummy, t.dummy.waitUnlock(&t.contention), t.rootLink()) {
+			t.contention.restart()
+		}
+	}
+	it.removed = true
+}
+
+// Set replace the value of key where the iterator at with value, or insert the key again if it has been deleted.
+// The iterator stays at the key, and Value returns the new value.
+// Like Delete, the nodes on path held by the iterator are locked directly if they are not modified.
+// Set panics on iterators of Snapshot.
+func (it *Iterator) Set(value []byte) {
+	it.checkWritable()
+	if !it.Valid() {
+		return
+	}
+	defer it.t.enter().exit()
+	t := it.t
+	if !it.removed {
+		if it.set(value) {
+			return
+		}
+		t.contention.restart()
+	}
+	key := it.Key()
+	for !t.root.insert(t, key, value, 0, &t.dummy, t.dummy.waitUnlock(&t.contention), t.rootLink()) {
+		t.contention.restart()
+	}
+	for !it.seek(key, true, false) {
+		t.contention.restart()
+	}
+}
+
+// checkWritable panics if it is an iterator of Snapshot. The nodes of snapshot are shared with the tree,
+// and they are not frozen in the view of snapshot, so they would be modified in place.
+func (it *Iterator) checkWritable() {
+	if it.readOnly {
+		panic("art: modify the tree through an iterator of Snapshot")
+	}
+}
+
+// parentOf returns the parent of the i-th node in stack and the parent's version.
+func (it *Iterator) parentOf(i int) (*node, uint64) {
+	if i == 0 {
+		return &it.t.dummy, it.t.dummy.waitUnlock(&it.t.contention)
+	}
+	f := &it.stack[i-1]
+	return f.n, f.version
+}
+
+// nodeLoc returns the location of the i-th node in stack, its parent must be locked.
+func (it *Iterator) nodeLoc(i int) link {
+	if i == 0 {
+		return it.t.rootLink()
+	}
+	f := &it.stack[i-1]
+	_, loc, _ := f.n.findChild(byte(f.key))
+	return loc
+}
+
+// remove delete the current leaf using the nodes in stack, like node.remove.
+// It returns false if any node it needs is modified and the deletion should restart from root.
+//
+//go:norace
+func (it *Iterator) remove() bool {
+	var (
+		t          = it.t
+		key        = it.Key()
+		i          = len(it.stack) - 1
+		f          = &it.stack[i]
+		n          = f.n
+		parent, pv = it.parentOf(i)
+		shrink     bool
+	)
+	// the decision is validated when n is locked.
+	if f.key < 0 {
+		shrink = n.shouldCompress(parent)
+	} else {
+		shrink = n.shouldShrink(parent)
+	}
+
+	if shrink {
+		if !n.upgradeToLockWithParent(&it.t.contention, f.version, parent, pv, true) {
+			return false
+		}
+		w, ok := t.lockedWriter(key, n, parent, true)
+		if !ok {
+			return false
+		}
+
+		if f.key < 0 {
+			ok = (*node4)(unsafe.Pointer(n)).compressChild(0, it.nodeLoc(i), w)
+		} else {
+			ok = n.removeChildAndShrink(byte(f.key), it.nodeLoc(i), w)
+		}
+
+		if !ok {
+			n.unlock()
+		} else {
+			w.freeLeaf(it.leaf)
+			w.retire(n)
+		}
+		parent.unlock()
+		return ok
+	}
+
+	if !n.upgradeToLock(&it.t.contention, f.version) {
+		return false
+	}
+	w, ok := t.lockedWriter(key, n, parent, false)
+	if !ok {
+		return false
+	}
+	if f.key < 0 {
+		n.storePrefixLeaf(nil)
+	} else {
+		_, _, idx := n.findChild(byte(f.key))
+		n.removeChild(idx)
+	}
+	w.freeLeaf(it.leaf)
+	// the frame remains valid, as the other children are not moved.
+	f.version = n.unlockVersion()
+	return true
+}
+
+// set replace the value of current leaf using the node holds it, like node.update.
+// It returns false if the node is modified and the update should restart from root.
+//
+//go:norace
+func (it *Iterator) set(value []byte) bool {
+	var (
+		t   = it.t
+		key = it.Key()
+		f   = &it.stack[len(it.stack)-1]
+		n   = f.n
+	)
+	if !n.upgradeToLock(&it.t.contention, f.version) {
+		return false
+	}
+	w, ok := t.lockedWriter(key, n, nil, false)
+	if !ok {
+		return false
+	}
+	if f.key < 0 {
+		n.updatePrefixLeaf(key, value, w)
+		it.leaf = n.loadPrefixLeaf()
+	} else {
+		_, loc, _ := n.findChild(byte(f.key))
+		it.leaf.updateOrExpand(key, value, f.depth+1, loc, w)
+		it.leaf = (*leaf)(unsafe.Pointer(loc.load()))
+	}
+	f.version = n.unlockVersion()
+	return true
+}
+
+func (it *Iterator) reset() {
+	it.stack = it.stack[:0]
+	it.leaf = nil
+	it.removed = false
+}
+
+func (it *Iterator) push(n *node, version uint64, depth uint32, key int) {
+	it.stack = append(it.stack, iterFrame{n: n, version: version, depth: depth, key: key})
+}
+
+// seek move the iterator to the first key greater than (or equals to if inclusive) key,
+// or the last key less than (or equals to if inclusive) key when reverse is true.
+// It returns false if seek should restart due to concurrent modification.
+//
+//go:norace
+func (it *Iterator) seek(key []byte, inclusive, reverse bool) bool {
+	it.reset()
+	n, version, ok := it.t.rootNode()
+	if !ok {
+		return false
+	}
+
+	var depth uint32
+	for {
+		cmp, ok := n.comparePrefix(&it.t.contention, key, depth, version)
+		if !ok {
+			return false
+		}
+		if reverse {
+			cmp = -cmp
+		}
+		// all keys in this subtree are after key.
+		if cmp > 0 {
+			return it.descendFrom(n, version, depth, reverse)
+		}
+		// all keys in this subtree are before key, move to the next subtree.
+		if cmp < 0 {
+			return it.step(reverse)
+		}
+		depth += n.prefixLen
+
+		if uint32(len(key)) == depth {
+			l := n.loadPrefixLeaf()
+			if !n.lockCheck(&it.t.contention, version) {
+				return false
+			}
+			it.push(n, version, depth, -1)
+			if l != nil && inclusive {
+				it.leaf = l
+				return true
+			}
+			return it.step(reverse)
+		}
+
+		var (
+			child    *node
+			childKey int
+			label    = int(key[depth])
+		)
+		if reverse {
+			child, childKey = n.seekChildReverse(label)
+		} else {
+			child, childKey = n.seekChild(label)
+		}
+		if !n.lockCheck(&it.t.contention, version) {
+			return false
+		}
+		if child == nil {
+			if reverse {
+				// the prefixLeaf is the only candidate in this node.
+				it.push(n, version, depth, 0)
+			} else {
+				it.push(n, version, depth, 256)
+			}
+			return it.step(reverse)
+		}
+		it.push(n, version, depth, childKey)
+
+		if child.nodeType == typeLeaf {
+			l := (*leaf)(unsafe.Pointer(child))
+			if childKey == label {
+				cmp := bytes.Compare(l.key(), key)
+				if reverse {
+					cmp = -cmp
+				}
+				if cmp < 0 || cmp == 0 && !inclusive {
+					return it.step(reverse)
+				}
+			}
+			it.leaf = l
+			return true
+		}
+
+		childVersion, ok := child.rLock(&it.t.contention)
+		if !ok || !n.lockCheck(&it.t.contention, version) {
+			return false
+		}
+		if childKey != label {
+			return it.descendFrom(child, childVersion, depth+1, reverse)
+		}
+		n, version = child, childVersion
+		depth++
+	}
+}
+
+// descendFrom move the iterator to the first (or last if reverse is true) key in subtree of n.
+func (it *Iterator) descendFrom(n *node, version uint64, depth uint32, reverse bool) bool {
+	if reverse {
+		return it.descendLast(n, version, depth) && (it.leaf != nil || it.prev())
+	}
+	return it.descendFirst(n, version, depth) && (it.leaf != nil || it.next())
+}
+
+func (it *Iterator) step(reverse bool) bool {
+	if reverse {
+		return it.prev()
+	}
+	return it.next()
+}
+
+// descendFirst push the path to the first key in subtree of n into stack.
+// The iterator's leaf will be nil if the subtree is empty.
+//
+//go:norace
+func (it *Iterator) descendFirst(n *node, version uint64, depth uint32) bool {
+	for {
+		depth += n.prefixLen
+		l := n.loadPrefixLeaf()
+		if !n.lockCheck(&it.t.contention, version) {
+			return false
+		}
+		if l != nil {
+			it.push(n, version, depth, -1)
+			it.leaf = l
+			return true
+		}
+
+		child, key := n.seekChild(0)
+		if !n.lockCheck(&it.t.contention, version) {
+			return false
+		}
+		if child == nil {
+			return true
+		}
+		it.push(n, version, depth, key)
+		if child.nodeType == typeLeaf {
+			it.leaf = (*leaf)(unsafe.Pointer(child))
+			return true
+		}
+
+		childVersion, ok := child.rLock(&it.t.contention)
+		if !ok || !n.lockCheck(&it.t.contention, version) {
+			return false
+		}
+		n, version = child, childVersion
+		depth++
+	}
+}
+
+// descendLast push the path to the last key in subtree of n into stack.
+// The iterator's leaf will be nil if the subtree is empty.
+//
+//go:norace
+func (it *Iterator) descendLast(n *node, version uint64, depth uint32) bool {
+	for {
+		depth += n.prefixLen
+		child, key := n.seekChildReverse(255)
+		if !n.lockCheck(&it.t.contention, version) {
+			return false
+		}
+		if child == nil {
+			l := n.loadPrefixLeaf()
+			if !n.lockCheck(&it.t.contention, version) {
+				return false
+			}
+			if l != nil {
+				it.push(n, version, depth, -1)
+				it.leaf = l
+			}
+			return true
+		}
+		it.push(n, version, depth, key)
+		if child.nodeType == typeLeaf {
+			it.leaf = (*leaf)(unsafe.Pointer(child))
+			return true
+		}
+
+		childVersion, ok := child.rLock(&it.t.contention)
+		if !ok || !n.lockCheck(&it.t.contention, version) {
+			return false
+		}
+		n, version = child, childVersion
+		depth++
+	}
+}
+
+// next move the iterator to next key using the nodes in stack.
+// It returns false if any node in stack is modified and the iterator should re-seek.
+//
+//go:norace
+func (it *Iterator) next() bool {
+	it.leaf, it.removed = nil, false
+	for len(it.stack) > 0 {
+		f := &it.stack[len(it.stack)-1]
+		var (
+			child *node
+			key   int
+		)
+		if f.key < 255 {
+			child, key = f.n.seekChild(f.key + 1)
+		}
+		if !f.n.lockCheck(&it.t.contention, f.version) {
+			return false
+		}
+		if child == nil {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+
+		f.key = key
+		if child.nodeType == typeLeaf {
+			it.leaf = (*leaf)(unsafe.Pointer(child))
+			return true
+		}
+		childVersion, ok := child.rLock(&it.t.contention)
+		if !ok || !f.n.lockCheck(&it.t.contention, f.version) {
+			return false
+		}
+		if !it.descendFirst(child, childVersion, f.depth+1) {
+			return false
+		}
+		if it.leaf != nil {
+			return true
+		}
+	}
+	return true
+}
+
+// prev move the iterator to previous key using the nodes in stack.
+// It returns false if any node in stack is modified and the iterator should re-seek.
+//
+//go:norace
+func (it *Iterator) prev() bool {
+	it.leaf, it.removed = nil, false
+	for len(it.stack) > 0 {
+		f := &it.stack[len(it.stack)-1]
+		if f.key < 0 {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+
+		var (
+			child *node
+			key   int
+		)
+		if f.key > 0 {
+			child, key = f.n.seekChildReverse(f.key - 1)
+		}
+		if !f.n.lockCheck(&it.t.contention, f.version) {
+			return false
+		}
+		if child == nil {
+			l := f.n.loadPrefixLeaf()
+			if !f.n.lockCheck(&it.t.contention, f.version) {
+				return false
+			}
+			if l != nil {
+				f.key = -1
+				it.leaf = l
+				return true
+			}
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+
+		f.key = key
+		if child.nodeType == typeLeaf {
+			it.leaf = (*leaf)(unsafe.Pointer(child))
+			return true
+		}
+		childVersion, ok := child.rLock(&it.t.contention)
+		if !ok || !f.n.lockCheck(&it.t.contention, f.version) {
+			return false
+		}
+		if !it.descendLast(child, childVersion, f.depth+1) {
+			return false
+		}
+		if it.leaf != nil {
+			return true
+		}
+	}
+	return true
+}
@@ -1,52 +1,126 @@
 package art
 
 import (
-	"runtime"
 	"sync/atomic"
+	"time"
 )
 
-const spinCount = 30
+// contention holds the backoff policy of a tree, and counts the optimistic lock contention if enabled.
+// A nil contention is valid, it counts nothing and uses the default backoff.
+type contention struct {
+	backoff Backoff
+	// counters is nil if the tree is not created WithContentionStats.
+	counters *contentionCounters
+}
+
+// contentionCounters are updated by all operations concurrently, so each of them is padded to its own cache line.
+type contentionCounters struct {
+	restarts paddedCounter
+	failures paddedCounter
+	spins    paddedCounter
+	waitTime paddedCounter
+}
+
+type paddedCounter struct {
+	n int64
+	_ [56]byte
+}
+
+// restart records an operation restarted due to concurrent modification.
+func (c *contention) restart() {
+	if c != nil && c.counters != nil {
+		atomic.AddInt64(&c.counters.restarts.n, 1)
+	}
+}
+
+// fail records a failed version validation.
+func (c *contention) fail() {
+	if c != nil && c.counters != nil {
+		atomic.AddInt64(&c.counters.failures.n, 1)
+	}
+}
+
+func (c *contention) stats() ContentionStats {
+	if c.counters == nil {
+		return ContentionStats{}
+	}
+	return ContentionStats{
+		Restarts:           atomic.LoadInt64(&c.counters.restarts.n),
+		ValidationFailures: atomic.LoadInt64(&c.counters.failures.n),
+		Spins:              atomic.LoadInt64(&c.counters.spins.n),
+		LockWait:           time.Duration(atomic.LoadInt64(&c.counters.waitTime.n)),
+	}
+}
 
-func (n *node) rLock() (uint64, bool) {
-	v := n.waitUnlock()
-	return v, v&1 != 1
+func (n *node) rLock(c *contention) (uint64, bool) {
+	v := n.waitUnlock(c)
+	if v&1 == 1 {
+		c.fail()
+		return v, false
+	}
+	return v, true
 }
 
-func (n *node) lockCheck(version uint64) bool {
-	return n.rUnlock(version)
+func (n *node) lockCheck(c *contention, version uint64) bool {
+	return n.rUnlock(c, version)
 }
 
-func (n *node) rUnlock(version uint64) bool {
-	return version == atomic.LoadUint64(&n.version)
+func (n *node) rUnlock(c *contention, version uint64) bool {
+	if version != atomic.LoadUint64(&n.version) {
+		c.fail()
+		return false
+	}
+	return true
 }
 
-func (n *node) rUnlockWithNode(version uint64, lockedNode *node) bool {
+func (n *node) rUnlockWithNode(c *contention, version uint64, lockedNode *node) bool {
 	if version != atomic.LoadUint64(&n.version) {
+		c.fail()
 		lockedNode.unlock()
 		return false
 	}
 	return true
 }
 
-func (n *node) upgradeToLock(version uint64) bool {
-	return atomic.CompareAndSwapUint64(&n.version, version, version+2)
+func (n *node) upgradeToLock(c *contention, version uint64) bool {
+	if !atomic.CompareAndSwapUint64(&n.version, version, version+2) {
+		c.fail()
+		return false
+	}
+	return true
 }
 
-func (n *node) upgradeToLockWithNode(version uint64, lockedNode *node) bool {
+func (n *node) upgradeToLockWithNode(c *contention, version uint64, lockedNode *node) bool {
 	if !atomic.CompareAndSwapUint64(&n.version, version, version+2) {
+		c.fail()
 		lockedNode.unlock()
 		return false
 	}
 	return true
 }
 
-func (n *node) lock() bool {
+// upgradeToLockWithParent upgrade n to locked, parent will be locked too if lockParent is true,
+// otherwise parent's version is checked after n is locked.
+func (n *node) upgradeToLockWithParent(c *contention, version uint64, parent *node, parentVersion uint64, lockParent bool) bool {
+	if lockParent {
+		if !parent.upgradeToLock(c, parentVersion) {
+			return false
+		}
+		return n.upgradeToLockWithNode(c, version, parent)
+	}
+	if !n.upgradeToLock(c, version) {
+		return false
+	}
+	return parent.rUnlockWithNode(c, parentVersion, n)
+}
+
+func (n *node) lock(c *contention) bool {
 	for {
-		version, ok := n.rLock()
+		version, ok := n.rLock(c)
 		if !ok {
 			return false
 		}
-		if n.upgradeToLock(version) {
+		if n.upgradeToLock(c, version) {
 			break
 		}
 	}
@@ -58,20 +132,44 @@ func (n *node) unlock() {
 	atomic.AddUint64(&n.version, 2)
 }
 
+// unlockVersion unlock n and returns the new version of n, which is valid until n is modified again.
+func (n *node) unlockVersion() uint64 {
+	return atomic.AddUint64(&n.version, 2)
+}
+
 func (n *node) unlockObsolete() {
 	atomic.AddUint64(&n.version, 3)
 }
 
-func (n *node) waitUnlock() uint64 {
+// waitUnlock waits until n is not locked with the backoff of c, and returns the version of n.
+func (n *node) waitUnlock(c *contention) uint64 {
 	v := atomic.LoadUint64(&n.version)
-	count := spinCount
-	for v&2 == 2 {
-		if count <= 0 {
-			runtime.Gosched()
-			count = spinCount
+	if v&2 != 2 {
+		return v
+	}
+
+	var (
+		b        = defaultBackoff
+		counters *contentionCounters
+		start    time.Time
+	)
+	if c != nil {
+		if c.backoff != nil {
+			b = c.backoff
+		}
+		if counters = c.counters; counters != nil {
+			start = time.Now()
 		}
-		count--
+	}
+	var attempt int
+	for v&2 == 2 {
+		b.Wait(attempt)
+		attempt++
 		v = atomic.LoadUint64(&n.version)
 	}
+	if counters != nil {
+		atomic.AddInt64(&counters.spins.n, int64(attempt))
+		atomic.AddInt64(&counters.waitTime.n, int64(time.Since(start)))
+	}
 	return v
 }
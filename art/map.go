@@ -0,0 +1,156 @@
+package art
+
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/bobotu/myk/keyenc"
+)
+
+// Codec converts values of type T from and to the bytes stored in ART.
+type Codec[T any] interface {
+	// Encode appends the encoded v to buf and returns the extended buffer.
+	// The result may share memory with v, as ART copies keys and values on write.
+	Encode(buf []byte, v T) []byte
+	// Decode returns the value encoded in b, b is always produced by Encode.
+	// The result may share memory with b, which is owned by ART and must not be modified.
+	Decode(b []byte) T
+}
+
+// Codecs for keys, the encoded keys are memcomparable so the Map is ordered as the key type.
+// The numbers are encoded by package keyenc. Strings and bytes are the whole key of Map,
+// so they are stored as is without the escaping of keyenc.
+var (
+	Int64Key   Codec[int64]   = int64Key{}
+	Uint64Key  Codec[uint64]  = uint64Key{}
+	Float64Key Codec[float64] = float64Key{}
+	StringKey  Codec[string]  = stringKey{}
+	BytesKey   Codec[[]byte]  = bytesKey{}
+)
+
+// Codecs for values, they are stored as is without encoding.
+var (
+	StringValue Codec[string] = stringValue{}
+	BytesValue  Codec[[]byte] = bytesValue{}
+)
+
+type int64Key struct{}
+
+func (int64Key) Encode(buf []byte, v int64) []byte { return keyenc.AppendInt64(buf, v) }
+
+func (int64Key) Decode(b []byte) int64 { return mustDecode(keyenc.DecodeInt64(b)) }
+
+type uint64Key struct{}
+
+func (uint64Key) Encode(buf []byte, v uint64) []byte { return keyenc.AppendUint64(buf, v) }
+
+func (uint64Key) Decode(b []byte) uint64 { return mustDecode(keyenc.DecodeUint64(b)) }
+
+type float64Key struct{}
+
+func (float64Key) Encode(buf []byte, v float64) []byte { return keyenc.AppendFloat64(buf, v) }
+
+func (float64Key) Decode(b []byte) float64 { return mustDecode(keyenc.DecodeFloat64(b)) }
+
+func mustDecode[T any](v T, rest []byte, err error) T {
+	if err != nil || len(rest) != 0 {
+		panic("art: decode a key not encoded by the codec")
+	}
+	return v
+}
+
+type stringKey struct{}
+
+func (stringKey) Encode(buf []byte, v string) []byte { return append(buf, v...) }
+
+func (stringKey) Decode(b []byte) string { return string(b) }
+
+type bytesKey struct{}
+
+func (bytesKey) Encode(buf []byte, v []byte) []byte { return append(buf, v...) }
+
+func (bytesKey) Decode(b []byte) []byte { return b }
+
+type stringValue struct{}
+
+// Encode returns the bytes of v without copy.
+func (stringValue) Encode(buf []byte, v string) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer((*reflect.StringHeader)(unsafe.Pointer(&v)).Data)), len(v))
+}
+
+// Decode returns a string share memory with b, the values returned by ART are never modified.
+func (stringValue) Decode(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+type bytesValue struct{}
+
+func (bytesValue) Encode(buf []byte, v []byte) []byte { return v }
+
+func (bytesValue) Decode(b []byte) []byte { return b }
+
+// Map is a typed ordered map backed by ART. Keys and values are converted by the codecs of Map,
+// keys should use an order-preserving codec, so Scan visits keys in the order of K.
+// It is thread safe as ART.
+type Map[K, V any] struct {
+	t      *ART
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// NewMap returns a new Map using the given codecs, the opts are the same as New.
+func NewMap[K, V any](keys Codec[K], values Codec[V], opts ...Option) *Map[K, V] {
+	return &Map[K, V]{t: New(opts...), keys: keys, values: values}
+}
+
+// Tree returns the ART backing m, the keys and values in it are encoded by codecs of m.
+func (m *Map[K, V]) Tree() *ART {
+	return m.t
+}
+
+// Len returns the number of keys in m.
+func (m *Map[K, V]) Len() int {
+	return m.t.Len()
+}
+
+// Get returns the value associated with key.
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	var buf [32]byte
+	v, ok := m.t.Get(m.keys.Encode(buf[:0], key))
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	return m.values.Decode(v), true
+}
+
+// Put puts the key and value into m.
+func (m *Map[K, V]) Put(key K, value V) {
+	var kb, vb [32]byte
+	m.t.Put(m.keys.Encode(kb[:0], key), m.values.Encode(vb[:0], value))
+}
+
+// Delete deletes key from m.
+func (m *Map[K, V]) Delete(key K) {
+	var buf [32]byte
+	m.t.Delete(m.keys.Encode(buf[:0], key))
+}
+
+// Scan calls fn for each key in range [start, end) in ascending order, until fn return true.
+// A nil start or end means the range is unbounded at that side.
+func (m *Map[K, V]) Scan(start, end *K, fn func(key K, value V) (end bool)) {
+	var s, e []byte
+	if start != nil {
+		s = m.keys.Encode(nil, *start)
+	}
+	if end != nil {
+		e = m.keys.Encode(nil, *end)
+		// no key is less than an empty key, while an empty end means unbounded to ART.Scan.
+		if len(e) == 0 {
+			return
+		}
+	}
+	m.t.Scan(s, e, func(key, value []byte) bool {
+		return fn(m.keys.Decode(key), m.values.Decode(value))
+	})
+}
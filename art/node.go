@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"math/bits"
 	"reflect"
+	"runtime"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -35,12 +37,20 @@ type node struct {
 	// numChildren is number of children except prefixLeaf.
 	numChildren uint8
 
+	// arena is true if this node is allocated from arena, its slots of children and prefixLeaf hold
+	// arenaRef instead of Go pointers, so they must be accessed by link.
+	arena bool
+
 	// prefixLen and prefix is the optimistic path compression.
 	prefixLen uint32
 
 	// version is the optimistic lock.
 	version uint64
 
+	// epoch is the snapshot epoch when this node is created.
+	// A node created before the latest alive snapshot is frozen, and must not be modified in place.
+	epoch uint64
+
 	// prefixLeaf store value of key which is prefix of other keys.
 	// eg. [1]'s value will store here when [1, 0] exist.
 	prefixLeaf *leaf
@@ -48,6 +58,82 @@ type node struct {
 	prefix [maxPrefixLen]byte
 }
 
+// link is the location of a reference to node, which is a slot of an inner node or the root of tree.
+type link struct {
+	p **node
+	// ref is true if the slot holds arenaRef.
+	ref bool
+}
+
+func (l link) load() *node {
+	if l.ref {
+		return (*node)((*(*arenaRef)(unsafe.Pointer(l.p))).pointer())
+	}
+	return *l.p
+}
+
+func (l link) store(n *node) {
+	if l.ref {
+		*(*arenaRef)(unsafe.Pointer(l.p)) = refOf(unsafe.Pointer(n))
+		return
+	}
+	*l.p = n
+}
+
+// slot returns the link of p, which must be a slot of n.
+func (n *node) slot(p **node) link {
+	return link{p: p, ref: n.arena}
+}
+
+func (n *node) prefixLeafSlot() **node {
+	return (**node)(unsafe.Pointer(&n.prefixLeaf))
+}
+
+func (n *node) loadPrefixLeaf() *leaf {
+	return (*leaf)(unsafe.Pointer(n.slot(n.prefixLeafSlot()).load()))
+}
+
+func (n *node) storePrefixLeaf(l *leaf) {
+	n.slot(n.prefixLeafSlot()).store(l.toNode())
+}
+
+// copySlots copies the slots of src to dst, they must be slots of n or nodes allocated by the same tree.
+// The arenaRef are copied as is, so GC never sees them.
+func (n *node) copySlots(dst, src []*node) {
+	if !n.arena {
+		copy(dst, src)
+		return
+	}
+	if len(dst) > 0 && len(src) > 0 {
+		copy(unsafe.Slice((*arenaRef)(unsafe.Pointer(&dst[0])), len(dst)), unsafe.Slice((*arenaRef)(unsafe.Pointer(&src[0])), len(src)))
+	}
+}
+
+// copySlot copies the slot src to dst, like copySlots.
+func (n *node) copySlot(dst, src **node) {
+	if !n.arena {
+		*dst = *src
+		return
+	}
+	*(*arenaRef)(unsafe.Pointer(dst)) = *(*arenaRef)(unsafe.Pointer(src))
+}
+
+// clearSlots clears the slots s of n.
+func (n *node) clearSlots(s []*node) {
+	if !n.arena {
+		for i := range s {
+			s[i] = nil
+		}
+		return
+	}
+	if len(s) > 0 {
+		refs := unsafe.Slice((*arenaRef)(unsafe.Pointer(&s[0])), len(s))
+		for i := range refs {
+			refs[i] = 0
+		}
+	}
+}
+
 func (n *node) isFull() bool {
 	switch n.nodeType {
 	case typeNode4:
@@ -148,7 +234,15 @@ type leaf struct {
 }
 
 func newLeaf(key []byte, value []byte) *leaf {
-	mem := make([]byte, 1+4+4+len(key)+len(value))
+	return initLeaf(make([]byte, leafSize(key, value)), key, value)
+}
+
+func leafSize(key []byte, value []byte) int {
+	return 1 + 4 + 4 + len(key) + len(value)
+}
+
+// initLeaf writes key and value into mem, which must have leafSize bytes.
+func initLeaf(mem []byte, key []byte, value []byte) *leaf {
 	mem[0] = byte(typeLeaf)
 	cursor := 1
 	*(*uint32)(unsafe.Pointer(&mem[cursor])) = uint32(len(key))
@@ -194,6 +288,94 @@ func (l *leaf) match(key []byte) bool {
 	return bytes.Equal(l.key(), key)
 }
 
+// size returns the bytes allocated by newLeaf for this leaf.
+func (l *leaf) size() int64 {
+	kl := int64(*(*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(l)) + 1)))
+	vl := int64(*(*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(l)) + uintptr(kl+5))))
+	return 1 + 4 + 4 + kl + vl
+}
+
+// leafHeader is stored right before the leaves of trees which update values in place.
+// The leaf layout after the header is the same as immutable leaves, so the key can be read as usual.
+// The value is followed by spare bytes up to capacity, a new value which fits in them overwrites the old one.
+type leafHeader struct {
+	// version is odd while a writer is overwriting the value, readers copy the value
+	// and retry if version is changed, so they never see a torn value.
+	version uint64
+	// epoch is the epoch of the writer created the leaf, see writer.frozen.
+	epoch uint64
+	// capacity is the bytes reserved for the value.
+	capacity uint32
+	_        uint32
+}
+
+const leafHeaderSize = int(unsafe.Sizeof(leafHeader{}))
+
+// mutableLeafSize returns the bytes of a leaf with header which holds key and value,
+// the size is rounded up to 16 bytes and the rest is reserved for growing value.
+func mutableLeafSize(key []byte, value []byte) int {
+	return (leafHeaderSize + leafSize(key, value) + 15) &^ 15
+}
+
+// allocMutableLeaf returns zeroed memory of size bytes aligned to 8 bytes from Go heap.
+// The header holds no pointer, so the memory can also be allocated from arena.
+func allocMutableLeaf(size int) []byte {
+	buf := make([]uint64, (size+7)/8)
+	return unsafe.Slice((*byte)(unsafe.Pointer(&buf[0])), size)
+}
+
+// initMutableLeaf writes header, key and value into mem, which must have at least leafHeaderSize+leafSize bytes.
+// The bytes after value are reserved for later updates.
+func initMutableLeaf(mem []byte, key []byte, value []byte, epoch uint64) *leaf {
+	h := (*leafHeader)(unsafe.Pointer(&mem[0]))
+	h.epoch = epoch
+	h.capacity = uint32(len(mem) - leafHeaderSize - leafSize(key, nil))
+	return initLeaf(mem[leafHeaderSize:], key, value)
+}
+
+func (l *leaf) header() *leafHeader {
+	return (*leafHeader)(unsafe.Pointer(uintptr(unsafe.Pointer(l)) - uintptr(leafHeaderSize)))
+}
+
+// mutableSize returns the bytes allocated for a leaf with header.
+func (l *leaf) mutableSize() int64 {
+	kl := int64(*(*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(l)) + 1)))
+	return int64(leafHeaderSize) + 1 + 4 + 4 + kl + int64(l.header().capacity)
+}
+
+// overwriteValue replaces the value of a leaf with header, value must fit in the capacity.
+// The caller must hold the lock of the node which holds the leaf.
+func (l *leaf) overwriteValue(value []byte) {
+	h := l.header()
+	atomic.AddUint64(&h.version, 1)
+	kl := uintptr(*(*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(l)) + 1)))
+	*(*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(l)) + kl + 5)) = uint32(len(value))
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(l))+kl+9)), len(value)), value)
+	atomic.AddUint64(&h.version, 1)
+}
+
+// appendValue appends the current value of a leaf with header to dst.
+func (l *leaf) appendValue(dst []byte) []byte {
+	h := l.header()
+	for {
+		version := atomic.LoadUint64(&h.version)
+		if version&1 == 1 {
+			runtime.Gosched()
+			continue
+		}
+		n := len(dst)
+		// the length maybe torn by a concurrent writer, it is validated by version before use.
+		v := l.value()
+		if len(v) <= int(h.capacity) {
+			dst = append(dst, v...)
+		}
+		if atomic.LoadUint64(&h.version) == version {
+			return dst
+		}
+		dst = dst[:n]
+	}
+}
+
 func (n *node) insertChild(key byte, child *node) {
 	switch n.nodeType {
 	case typeNode4:
@@ -209,38 +391,53 @@ func (n *node) insertChild(key byte, child *node) {
 	}
 }
 
+// insertChild of node4 and node16 keep keys in ascending order, so range scan can visit children in order.
 func (n *node4) insertChild(key byte, child *node) {
-	n.keys[n.numChildren] = key
-	n.children[n.numChildren] = child
+	num := int(n.numChildren)
+	i := 0
+	for i < num && n.keys[i] < key {
+		i++
+	}
+	copy(n.keys[i+1:], n.keys[i:num])
+	n.copySlots(n.children[i+1:], n.children[i:num])
+	n.keys[i] = key
+	n.slot(&n.children[i]).store(child)
 	n.numChildren++
 }
 
 func (n *node16) insertChild(key byte, child *node) {
-	n.keys[n.numChildren] = key
-	n.children[n.numChildren] = child
+	num := int(n.numChildren)
+	i := 0
+	for i < num && n.keys[i] < key {
+		i++
+	}
+	copy(n.keys[i+1:], n.keys[i:num])
+	n.copySlots(n.children[i+1:], n.children[i:num])
+	n.keys[i] = key
+	n.slot(&n.children[i]).store(child)
 	n.numChildren++
 }
 
 func (n *node48) insertChild(key byte, child *node) {
 	pos := n.allocSlot()
-	n.children[pos] = child
+	n.slot(&n.children[pos]).store(child)
 	n.index[key] = int8(pos + 1)
 	n.numChildren++
 }
 
 func (n *node256) insertChild(key byte, child *node) {
-	n.children[key] = child
+	n.slot(&n.children[key]).store(child)
 	n.numChildren++
 }
 
-func (n *node) growAndInsert(key byte, child *node, nodeLoc **node) {
+func (n *node) growAndInsert(key byte, child *node, nodeLoc link, w writer) {
 	switch n.nodeType {
 	case typeNode4:
-		(*node4)(unsafe.Pointer(n)).growAndInsert(key, child, nodeLoc)
+		(*node4)(unsafe.Pointer(n)).growAndInsert(key, child, nodeLoc, w)
 	case typeNode16:
-		(*node16)(unsafe.Pointer(n)).growAndInsert(key, child, nodeLoc)
+		(*node16)(unsafe.Pointer(n)).growAndInsert(key, child, nodeLoc, w)
 	case typeNode48:
-		(*node48)(unsafe.Pointer(n)).growAndInsert(key, child, nodeLoc)
+		(*node48)(unsafe.Pointer(n)).growAndInsert(key, child, nodeLoc, w)
 	default:
 		panic("unreachable code")
 	}
@@ -250,40 +447,77 @@ func copyNode(newNode, n *node) {
 	newNode.numChildren = n.numChildren
 	newNode.prefixLen = n.prefixLen
 	newNode.prefix = n.prefix
-	newNode.prefixLeaf = n.prefixLeaf
+	newNode.copySlot(newNode.prefixLeafSlot(), n.prefixLeafSlot())
 }
 
-func (n *node4) growAndInsert(key byte, child *node, nodeLoc **node) {
-	newNode := newNode16()
+func (n *node4) growAndInsert(key byte, child *node, nodeLoc link, w writer) {
+	newNode := w.newNode16()
 	copy(newNode.keys[:], n.keys[:])
-	copy(newNode.children[:], n.children[:])
+	n.copySlots(newNode.children[:], n.children[:])
 	copyNode(newNode.toNode(), n.toNode())
 	newNode.insertChild(key, child)
-	*nodeLoc = newNode.toNode()
+	nodeLoc.store(newNode.toNode())
 }
 
-func (n *node16) growAndInsert(key byte, child *node, nodeLoc **node) {
-	newNode := newNode48()
-	copy(newNode.children[:], n.children[:])
+func (n *node16) growAndInsert(key byte, child *node, nodeLoc link, w writer) {
+	newNode := w.newNode48()
+	n.copySlots(newNode.children[:], n.children[:])
 	newNode.slots = node48GrowSlots
 	for idx, k := range n.keys {
 		newNode.index[k] = int8(idx) + 1
 	}
 	copyNode(newNode.toNode(), n.toNode())
 	newNode.insertChild(key, child)
-	*nodeLoc = newNode.toNode()
+	nodeLoc.store(newNode.toNode())
 }
 
-func (n *node48) growAndInsert(key byte, child *node, nodeLoc **node) {
-	newNode := newNode256()
+func (n *node48) growAndInsert(key byte, child *node, nodeLoc link, w writer) {
+	newNode := w.newNode256()
 	for i := range newNode.children {
 		if idx := n.index[i]; idx > 0 {
-			newNode.children[i] = n.children[idx-1]
+			n.copySlot(&newNode.children[i], &n.children[idx-1])
 		}
 	}
 	copyNode(newNode.toNode(), n.toNode())
 	newNode.insertChild(key, child)
-	*nodeLoc = newNode.toNode()
+	nodeLoc.store(newNode.toNode())
+}
+
+// nodeTypeWithSize returns the type of the smallest node which can hold size children.
+func nodeTypeWithSize(size int) uint8 {
+	switch {
+	case size > 48:
+		return typeNode256
+	case size > 16:
+		return typeNode48
+	case size > 4:
+		return typeNode16
+	default:
+		return typeNode4
+	}
+}
+
+// growToAndInsert is like growAndInsert, but the new node is large enough to hold size children,
+// so a node which will receive many children is not grown again and again.
+func (n *node) growToAndInsert(key byte, child *node, size int, nodeLoc link, w writer) {
+	if nodeTypeWithSize(size) <= n.nodeType+1 {
+		n.growAndInsert(key, child, nodeLoc, w)
+		return
+	}
+
+	newNode := w.newNodeWithSize(size)
+	copyNode(newNode, n)
+	newNode.numChildren = 0
+	for k := 0; k < 256; k++ {
+		c, ck := n.seekChild(k)
+		if c == nil {
+			break
+		}
+		newNode.insertChild(byte(ck), c)
+		k = ck
+	}
+	newNode.insertChild(key, child)
+	nodeLoc.store(newNode)
 }
 
 func min(a, b uint32) uint32 {
@@ -294,9 +528,13 @@ func min(a, b uint32) uint32 {
 	}
 }
 
-func (l *leaf) updateOrExpand(key []byte, value []byte, depth uint32, nodeLoc **node) {
+func (l *leaf) updateOrExpand(key []byte, value []byte, depth uint32, nodeLoc link, w writer) {
 	if l.match(key) {
-		*nodeLoc = newLeaf(key, value).toNode()
+		if w.updateLeaf(l, value) {
+			return
+		}
+		nodeLoc.store(w.newLeaf(key, value).toNode())
+		w.freeLeaf(l)
 		return
 	}
 
@@ -306,7 +544,7 @@ func (l *leaf) updateOrExpand(key []byte, value []byte, depth uint32, nodeLoc **
 		lkey      = l.key()
 		lkeyLen   = uint32(len(lkey))
 		prefixLen = min(keyLen, lkeyLen)
-		newNode   = newNode4()
+		newNode   = w.newNode4()
 	)
 	for missPos = depth; missPos < prefixLen; missPos++ {
 		if lkey[missPos] != key[missPos] {
@@ -317,20 +555,26 @@ func (l *leaf) updateOrExpand(key []byte, value []byte, depth uint32, nodeLoc **
 	copy(newNode.prefix[:], key[depth:missPos])
 
 	if missPos == lkeyLen {
-		newNode.prefixLeaf = l
+		newNode.storePrefixLeaf(l)
 	} else {
 		newNode.insertChild(lkey[missPos], l.toNode())
 	}
 	if missPos == keyLen {
-		newNode.prefixLeaf = newLeaf(key, value)
+		newNode.storePrefixLeaf(w.newLeaf(key, value))
 	} else {
-		newNode.insertChild(key[missPos], newLeaf(key, value).toNode())
+		newNode.insertChild(key[missPos], w.newLeaf(key, value).toNode())
 	}
-	*nodeLoc = newNode.toNode()
+	nodeLoc.store(newNode.toNode())
 }
 
-func (n *node) updatePrefixLeaf(key []byte, value []byte) {
-	n.prefixLeaf = newLeaf(key, value)
+func (n *node) updatePrefixLeaf(key []byte, value []byte, w writer) {
+	if l := n.loadPrefixLeaf(); l != nil {
+		if w.updateLeaf(l, value) {
+			return
+		}
+		w.freeLeaf(l)
+	}
+	n.storePrefixLeaf(w.newLeaf(key, value))
 }
 
 func (n *node) removeChild(i int) {
@@ -338,25 +582,25 @@ func (n *node) removeChild(i int) {
 	case typeNode4:
 		n4 := (*node4)(unsafe.Pointer(n))
 		copy(n4.keys[i:], n4.keys[i+1:])
-		copy(n4.children[i:], n4.children[i+1:])
+		n.copySlots(n4.children[i:], n4.children[i+1:])
 		n4.numChildren--
-		n4.children[n4.numChildren] = nil
+		n.slot(&n4.children[n4.numChildren]).store(nil)
 	case typeNode16:
 		n16 := (*node16)(unsafe.Pointer(n))
 		copy(n16.keys[i:], n16.keys[i+1:])
-		copy(n16.children[i:], n16.children[i+1:])
+		n.copySlots(n16.children[i:], n16.children[i+1:])
 		n16.numChildren--
-		n16.children[n16.numChildren] = nil
+		n.slot(&n16.children[n16.numChildren]).store(nil)
 	case typeNode48:
 		n48 := (*node48)(unsafe.Pointer(n))
 		pos := int(n48.index[i] - 1)
 		n48.index[i] = 0
-		n48.children[pos] = nil
+		n.slot(&n48.children[pos]).store(nil)
 		n48.freeSlot(pos)
 		n48.numChildren--
 	case typeNode256:
 		n256 := (*node256)(unsafe.Pointer(n))
-		n256.children[i] = nil
+		n.slot(&n256.children[i]).store(nil)
 		n256.numChildren--
 	}
 }
@@ -367,7 +611,7 @@ func (n *node) shouldShrink(parent *node) bool {
 		if parent.nodeType == typeDummy {
 			return false
 		}
-		if n.prefixLeaf == nil {
+		if n.loadPrefixLeaf() == nil {
 			return n.numChildren <= 2
 		}
 		return n.numChildren <= 1
@@ -384,42 +628,44 @@ func (n *node) shouldShrink(parent *node) bool {
 	}
 }
 
-func (n *node) removeChildAndShrink(key byte, nodeLoc **node) bool {
+func (n *node) removeChildAndShrink(key byte, nodeLoc link, w writer) bool {
 	switch n.nodeType {
 	case typeNode4:
-		return (*node4)(unsafe.Pointer(n)).removeChildAndShrink(key, nodeLoc)
+		return (*node4)(unsafe.Pointer(n)).removeChildAndShrink(key, nodeLoc, w)
 	case typeNode16:
-		return (*node16)(unsafe.Pointer(n)).removeChildAndShrink(key, nodeLoc)
+		return (*node16)(unsafe.Pointer(n)).removeChildAndShrink(key, nodeLoc, w)
 	case typeNode48:
-		return (*node48)(unsafe.Pointer(n)).removeChildAndShrink(key, nodeLoc)
+		return (*node48)(unsafe.Pointer(n)).removeChildAndShrink(key, nodeLoc, w)
 	case typeNode256:
-		return (*node256)(unsafe.Pointer(n)).removeChildAndShrink(key, nodeLoc)
+		return (*node256)(unsafe.Pointer(n)).removeChildAndShrink(key, nodeLoc, w)
 	default:
 		panic("unreachable code")
 	}
 }
 
-func (n *node4) removeChildAndShrink(key byte, nodeLoc **node) bool {
-	if n.prefixLeaf != nil {
-		*nodeLoc = n.prefixLeaf.toNode()
+func (n *node4) removeChildAndShrink(key byte, nodeLoc link, w writer) bool {
+	if l := n.loadPrefixLeaf(); l != nil {
+		nodeLoc.store(l.toNode())
 		return true
 	}
 
 	if n.numChildren == 1 {
-		*nodeLoc = newNode4().toNode()
+		nodeLoc.store(w.newNode4().toNode())
 		return true
 	}
 
 	if n.keys[0] == key {
-		return n.compressChild(1, nodeLoc)
+		return n.compressChild(1, nodeLoc, w)
 	}
-	return n.compressChild(0, nodeLoc)
+	return n.compressChild(0, nodeLoc, w)
 }
 
-func (n *node4) compressChild(idx int, nodeLoc **node) bool {
-	child := n.children[idx]
+// compressChild replace n with its child at idx, and merge n's prefix into the child.
+// A frozen child is still used by snapshots, so the merged prefix is written into a copy of it.
+func (n *node4) compressChild(idx int, nodeLoc link, w writer) bool {
+	child := n.slot(&n.children[idx]).load()
 	if child.nodeType != typeLeaf {
-		if !child.lock() {
+		if !child.lock(w.contention) {
 			return false
 		}
 		prefixLen := n.prefixLen
@@ -435,58 +681,66 @@ func (n *node4) compressChild(idx int, nodeLoc **node) bool {
 
 		var tmp [maxPrefixLen]byte
 		copy(tmp[:], n.prefix[:min(prefixLen, maxPrefixLen)])
+		frozen := w.frozen(child)
+		if frozen {
+			old := child
+			child = w.clone(old)
+			w.retire(old)
+		}
 		child.prefix = tmp
 		child.prefixLen += n.prefixLen + 1
-		child.unlock()
+		if !frozen {
+			child.unlock()
+		}
 	}
-	*nodeLoc = child
+	nodeLoc.store(child)
 	return true
 }
 
-func (n *node16) removeChildAndShrink(key byte, nodeLoc **node) bool {
-	newNode := newNode4()
+func (n *node16) removeChildAndShrink(key byte, nodeLoc link, w writer) bool {
+	newNode := w.newNode4()
 	idx := 0
 	for i := 0; i < int(n.numChildren); i++ {
 		if n.keys[i] != key {
 			newNode.keys[idx] = n.keys[i]
-			newNode.children[idx] = n.children[i]
+			n.copySlot(&newNode.children[idx], &n.children[i])
 			idx++
 		}
 	}
 	copyNode(newNode.toNode(), n.toNode())
 	newNode.numChildren = node16MinSize - 1
-	*nodeLoc = newNode.toNode()
+	nodeLoc.store(newNode.toNode())
 	return true
 }
 
-func (n *node48) removeChildAndShrink(key byte, nodeLoc **node) bool {
-	newNode := newNode16()
+func (n *node48) removeChildAndShrink(key byte, nodeLoc link, w writer) bool {
+	newNode := w.newNode16()
 	idx := 0
 	for i := 0; i < 256; i++ {
 		if i != int(key) && n.index[i] != 0 {
 			newNode.keys[idx] = uint8(i)
-			newNode.children[idx] = n.children[n.index[i]-1]
+			n.copySlot(&newNode.children[idx], &n.children[n.index[i]-1])
 			idx++
 		}
 	}
 	copyNode(newNode.toNode(), n.toNode())
 	newNode.numChildren = node48MinSize - 1
-	*nodeLoc = newNode.toNode()
+	nodeLoc.store(newNode.toNode())
 	return true
 }
 
-func (n *node256) removeChildAndShrink(key byte, nodeLoc **node) bool {
-	newNode := newNode48()
+func (n *node256) removeChildAndShrink(key byte, nodeLoc link, w writer) bool {
+	newNode := w.newNode48()
 	for i := 0; i < 256; i++ {
-		if i != int(key) && n.children[i] != nil {
+		if i != int(key) && n.slot(&n.children[i]).load() != nil {
 			pos := newNode.allocSlot()
 			newNode.index[i] = int8(pos) + 1
-			newNode.children[pos] = n.children[i]
+			n.copySlot(&newNode.children[pos], &n.children[i])
 		}
 	}
 	copyNode(newNode.toNode(), n.toNode())
 	newNode.numChildren = node256MinSize - 1
-	*nodeLoc = newNode.toNode()
+	nodeLoc.store(newNode.toNode())
 	return true
 }
 
@@ -514,40 +768,44 @@ func (n *node) checkPrefix(key []byte, depth uint32) (uint32, bool) {
 	return nextPos, k == p
 }
 
-func (n *node) findChild(key byte) (child *node, nodeLoc **node, position int) {
+func (n *node) findChild(key byte) (child *node, nodeLoc link, position int) {
 	switch n.nodeType {
 	case typeNode4:
 		n4 := (*node4)(unsafe.Pointer(n))
 		for i := 0; i < int(n4.numChildren); i++ {
 			if n4.keys[i] == key {
-				return n4.children[i], &n4.children[i], i
+				l := n.slot(&n4.children[i])
+				return l.load(), l, i
 			}
 		}
 	case typeNode16:
 		n16 := (*node16)(unsafe.Pointer(n))
 		if i := bytes.IndexByte(n16.keys[:], key); i >= 0 && i < int(n.numChildren) {
-			return n16.children[i], &n16.children[i], i
+			l := n.slot(&n16.children[i])
+			return l.load(), l, i
 		}
 	case typeNode48:
 		n48 := (*node48)(unsafe.Pointer(n))
 		if idx := n48.index[key]; idx > 0 {
-			return n48.children[idx-1], &n48.children[idx-1], int(key)
+			l := n.slot(&n48.children[idx-1])
+			return l.load(), l, int(key)
 		}
 	case typeNode256:
 		n256 := (*node256)(unsafe.Pointer(n))
-		return n256.children[key], &n256.children[key], int(key)
+		l := n.slot(&n256.children[key])
+		return l.load(), l, int(key)
 	}
 
 	// Not found.
-	return nil, nil, 0
+	return nil, link{}, 0
 }
 
-func (n *node) insertSplitPrefix(key, fullKey []byte, value []byte, depth uint32, prefixLen uint32, nodeLoc **node) {
-	newNode := newNode4()
+func (n *node) insertSplitPrefix(key, fullKey []byte, value []byte, depth uint32, prefixLen uint32, nodeLoc link, w writer) {
+	newNode := w.newNode4()
 	if depth := depth + prefixLen; uint32(len(key)) == depth {
-		newNode.prefixLeaf = newLeaf(key, value)
+		newNode.storePrefixLeaf(w.newLeaf(key, value))
 	} else {
-		newNode.insertChild(key[depth], newLeaf(key, value).toNode())
+		newNode.insertChild(key[depth], w.newLeaf(key, value).toNode())
 	}
 
 	newNode.prefixLen = prefixLen
@@ -569,34 +827,33 @@ func (n *node) insertSplitPrefix(key, fullKey []byte, value []byte, depth uint32
 	newNode.insertChild(pos, n)
 	n.prefix = tmp
 
-	*nodeLoc = newNode.toNode()
+	nodeLoc.store(newNode.toNode())
 }
 
-func (n *node) fullKey(version uint64) ([]byte, bool) {
+func (n *node) fullKey(cont *contention, version uint64) ([]byte, bool) {
 	curr := n
 	for {
-		if curr.prefixLeaf != nil {
-			l := curr.prefixLeaf
-			if !curr.rUnlock(version) {
+		if l := curr.loadPrefixLeaf(); l != nil {
+			if !curr.rUnlock(cont, version) {
 				return nil, false
 			}
 			return l.key(), true
 		}
 
 		next := curr.firstChild()
-		if !curr.lockCheck(version) {
+		if !curr.lockCheck(cont, version) {
 			return nil, false
 		}
 
 		if next.nodeType == typeLeaf {
 			l := (*leaf)(unsafe.Pointer(next))
-			if !curr.rUnlock(version) {
+			if !curr.rUnlock(cont, version) {
 				return nil, false
 			}
 			return l.key(), true
 		}
 
-		v, ok := next.rLock()
+		v, ok := next.rLock(cont)
 		if !ok {
 			return nil, false
 		}
@@ -607,7 +864,7 @@ func (n *node) fullKey(version uint64) ([]byte, bool) {
 }
 
 // TODO: maybe we can tweak bytes comparison in this function.
-func (n *node) prefixMismatch(key []byte, depth uint32, parent *node, version, parentVersion uint64) (uint32, []byte, bool) {
+func (n *node) prefixMismatch(cont *contention, key []byte, depth uint32, parent *node, version, parentVersion uint64) (uint32, []byte, bool) {
 	if n.prefixLen <= maxPrefixLen {
 		l := min(uint32(len(key))-depth, n.prefixLen)
 		var idx uint32
@@ -625,13 +882,13 @@ func (n *node) prefixMismatch(key []byte, depth uint32, parent *node, version, p
 		ok      bool
 	)
 	for {
-		if !n.lockCheck(version) || !parent.lockCheck(parentVersion) {
+		if !n.lockCheck(cont, version) || !parent.lockCheck(cont, parentVersion) {
 			return 0, nil, false
 		}
 		if ok {
 			break
 		}
-		fullKey, ok = n.fullKey(version)
+		fullKey, ok = n.fullKey(cont, version)
 	}
 
 	i, l := depth, min(uint32(len(key)), depth+n.prefixLen)
@@ -0,0 +1,241 @@
+package art
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The serialized ART is a sorted dump of key value pairs.
+//
+//	header:  magic "ARTD" | version uint32
+//	entries: uvarint(len(key)+1) | key | uvarint(len(value)) | value
+//	trailer: uvarint(0) | count uint64 | crc32 uint32
+//
+// Integers are little endian, the checksum is CRC-32C of all bytes between header and checksum.
+const (
+	dumpMagic   = "ARTD"
+	dumpVersion = 1
+)
+
+var (
+	// ErrInvalidDump is returned by Load when the input is not a serialized ART.
+	ErrInvalidDump = errors.New("art: invalid dump")
+	// ErrChecksumMismatch is returned by Load when the input is corrupted.
+	ErrChecksumMismatch = errors.New("art: dump checksum mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteTo serialize a point-in-time view of this tree to w, it returns the number of bytes written.
+// Writers are not blocked during serialization, see Snapshot.
+// This operation is thread safe.
+func (t *ART) WriteTo(w io.Writer) (int64, error) {
+	s := t.Snapshot()
+	defer s.Release()
+	return s.WriteTo(w)
+}
+
+// WriteTo serialize this snapshot to w, it returns the number of bytes written.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	dw := &dumpWriter{w: bufio.NewWriter(w), crc: crc32.New(crcTable)}
+	var hdr [8]byte
+	copy(hdr[:], dumpMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], dumpVersion)
+	dw.write(hdr[:], false)
+
+	var count uint64
+	s.Scan(nil, nil, func(key, value []byte) bool {
+		dw.writeUvarint(uint64(len(key)) + 1)
+		dw.write(key, true)
+		dw.writeUvarint(uint64(len(value)))
+		dw.write(value, true)
+		count++
+		return dw.err != nil
+	})
+
+	dw.writeUvarint(0)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], count)
+	dw.write(buf[:], true)
+	binary.LittleEndian.PutUint32(buf[:4], dw.crc.Sum32())
+	dw.write(buf[:4], false)
+	if dw.err == nil {
+		dw.err = dw.w.Flush()
+	}
+	return dw.n, dw.err
+}
+
+type dumpWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	n   int64
+	err error
+}
+
+func (dw *dumpWriter) write(b []byte, checksum bool) {
+	if dw.err != nil {
+		return
+	}
+	n, err := dw.w.Write(b)
+	dw.n += int64(n)
+	dw.err = err
+	if checksum {
+		_, _ = dw.crc.Write(b)
+	}
+}
+
+func (dw *dumpWriter) writeUvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	dw.write(buf[:binary.PutUvarint(buf[:], x)], true)
+}
+
+// Load builds a new ART from the data serialized by WriteTo.
+// It reads r to EOF, and returns ErrInvalidDump if there is any data after the dump.
+// r is buffered unless it implements io.ByteReader.
+// The opts are the same as New.
+func Load(r io.Reader, opts ...Option) (*ART, error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	dr := &dumpReader{r: br, crc: crc32.New(crcTable)}
+	var hdr [8]byte
+	if _, err := io.ReadFull(dr.r, hdr[:]); err != nil {
+		return nil, dumpError(err)
+	}
+	if string(hdr[:4]) != dumpMagic {
+		return nil, ErrInvalidDump
+	}
+	if v := binary.LittleEndian.Uint32(hdr[4:]); v != dumpVersion {
+		return nil, fmt.Errorf("art: unsupported dump version %d", v)
+	}
+
+	var (
+		count uint64
+		prev  []byte
+	)
+	t := BuildFromSorted(func() ([]byte, []byte, bool) {
+		key, value, ok := dr.next()
+		if !ok {
+			return nil, nil, false
+		}
+		if count > 0 && bytes.Compare(prev, key) >= 0 {
+			dr.err = ErrInvalidDump
+			return nil, nil, false
+		}
+		count++
+		prev = append(prev[:0], key...)
+		return key, value, true
+	}, opts...)
+	if dr.err != nil {
+		return nil, dr.err
+	}
+
+	var buf [12]byte
+	if _, err := io.ReadFull(dr.r, buf[:]); err != nil {
+		return nil, dumpError(err)
+	}
+	_, _ = dr.crc.Write(buf[:8])
+	if binary.LittleEndian.Uint64(buf[:8]) != count {
+		return nil, ErrInvalidDump
+	}
+	if binary.LittleEndian.Uint32(buf[8:]) != dr.crc.Sum32() {
+		return nil, ErrChecksumMismatch
+	}
+	if _, err := dr.r.ReadByte(); err != io.EOF {
+		if err == nil {
+			err = ErrInvalidDump
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type dumpReader struct {
+	r   byteReader
+	crc hash.Hash32
+	buf []byte
+	err error
+}
+
+// next reads the next key value pair, it returns false at the end of entries or on error.
+// The returned slices are valid until the next call.
+func (dr *dumpReader) next() (key, value []byte, ok bool) {
+	kl, ok := dr.readUvarint()
+	if !ok || kl == 0 {
+		return nil, nil, false
+	}
+	kl--
+	if kl > maxDumpLen {
+		dr.err = ErrInvalidDump
+		return nil, nil, false
+	}
+	key, ok = dr.readAppend(int(kl), 0)
+	if !ok {
+		return nil, nil, false
+	}
+	// key is in dr.buf, keep it while reading value.
+	kb := len(key)
+	vl, ok := dr.readUvarint()
+	if !ok {
+		return nil, nil, false
+	}
+	if vl > maxDumpLen {
+		dr.err = ErrInvalidDump
+		return nil, nil, false
+	}
+	kv, ok := dr.readAppend(int(vl), kb)
+	if !ok {
+		return nil, nil, false
+	}
+	return kv[:kb], kv[kb:], true
+}
+
+// maxDumpLen is the max length of key and value, as leaves use uint32 to store them.
+const maxDumpLen = 1<<32 - 1
+
+func (dr *dumpReader) readUvarint() (uint64, bool) {
+	x, err := binary.ReadUvarint(dr.r)
+	if err != nil {
+		dr.err = dumpError(err)
+		return 0, false
+	}
+	var buf [binary.MaxVarintLen64]byte
+	_, _ = dr.crc.Write(buf[:binary.PutUvarint(buf[:], x)])
+	return x, true
+}
+
+// readAppend reads n bytes after the first off bytes of buf, and returns buf[:off+n].
+// The buffer grows with the data actually read, so a corrupted length will not allocate a huge buffer.
+func (dr *dumpReader) readAppend(n int, off int) ([]byte, bool) {
+	buf := bytes.NewBuffer(dr.buf[:off])
+	if _, err := buf.ReadFrom(io.LimitReader(dr.r, int64(n))); err != nil {
+		dr.err = err
+		return nil, false
+	}
+	dr.buf = buf.Bytes()
+	if len(dr.buf) != off+n {
+		dr.err = ErrInvalidDump
+		return nil, false
+	}
+	_, _ = dr.crc.Write(dr.buf[off:])
+	return dr.buf, true
+}
+
+func dumpError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidDump
+	}
+	return err
+}
@@ -1,15 +1,510 @@
 package art
 
-import "unsafe"
+import (
+	"bytes"
+	"unsafe"
+)
 
+// Scan calls fn for each key in range [start, end) in ascending order, until fn return true.
+// A nil or empty start means scan from the first key, and a nil or empty end means scan to the last key.
+// The key and value passed to fn must not be modified.
+// This operation is thread safe, keys inserted or deleted during the scan may or may not be visited,
+// but the visited keys are always in order and each of them is visited at most once.
+func (t *ART) Scan(start, end []byte, fn OpFunc) {
+	it := rangeIter{start: start, end: end, fn: fn}
+	it.bound, it.hasBound, it.inclusive = start, len(start) != 0, true
+	t.scan(&it)
+}
+
+// ReverseScan calls fn for each key in range [start, end) in descending order, until fn return true.
+// A nil or empty start means scan to the first key, and a nil or empty end means scan from the last key.
+// The key and value passed to fn must not be modified.
+// This operation is thread safe, and has the same consistency guarantee as Scan.
+func (t *ART) ReverseScan(start, end []byte, fn OpFunc) {
+	it := rangeIter{start: start, end: end, fn: fn, reverse: true}
+	it.bound, it.hasBound, it.inclusive = end, len(end) != 0, false
+	t.scan(&it)
+}
+
+// ScanPrefix calls fn for each key which has the given prefix in ascending order, until fn return true.
+// The scan descends along prefix using the compressed path in each node, so it jumps to the subtree
+// contains the prefix directly.
+// This operation is thread safe, and has the same consistency guarantee as Scan.
+func (t *ART) ScanPrefix(prefix []byte, fn OpFunc) {
+	it := rangeIter{prefix: prefix, fn: fn}
+	it.bound, it.hasBound, it.inclusive = prefix, len(prefix) != 0, true
+	t.scan(&it)
+}
+
+func (t *ART) scan(it *rangeIter) {
+	defer t.enter().exit()
+	it.alloc, it.contention = &t.alloc, &t.contention
+	for {
+		root, version, ok := t.rootNode()
+		if ok && it.scanNode(root, version, 0, it.hasBound) {
+			return
+		}
+		t.contention.restart()
+	}
+}
+
+// rootNode returns the read locked root of this tree.
+func (t *ART) rootNode() (*node, uint64, bool) {
+	dummyVersion := t.dummy.waitUnlock(&t.contention)
+	root := t.root
+	version, ok := root.rLock(&t.contention)
+	if !ok || !t.dummy.rUnlock(&t.contention, dummyVersion) {
+		return nil, 0, false
+	}
+	return root, version, true
+}
+
+// Min returns the smallest key in this tree and its value, ok is false if the tree is empty.
+// This operation is thread safe.
+func (t *ART) Min() (key, value []byte, ok bool) {
+	return t.nearest(func(root *node, version uint64) (*leaf, bool) {
+		return root.minLeaf(&t.contention, version)
+	})
+}
+
+// Max returns the largest key in this tree and its value, ok is false if the tree is empty.
+// This operation is thread safe.
+func (t *ART) Max() (key, value []byte, ok bool) {
+	return t.nearest(func(root *node, version uint64) (*leaf, bool) {
+		return root.maxLeaf(&t.contention, version)
+	})
+}
+
+// Floor returns the largest key less than or equal to key and its value, ok is false if there is no such key.
+// The lookup descends along key once, and records the nearest smaller subtree on the path,
+// so it doesn't need to go back to root when key's path ends.
+// This operation is thread safe, keys inserted or deleted during the lookup may or may not be observed.
+func (t *ART) Floor(key []byte) (k, value []byte, ok bool) {
+	return t.nearest(func(root *node, version uint64) (*leaf, bool) {
+		return root.seekLeaf(&t.contention, key, version, true)
+	})
+}
+
+// Ceil returns the smallest key greater than or equal to key and its value, ok is false if there is no such key.
+// This operation is thread safe, and has the same consistency guarantee as Floor.
+func (t *ART) Ceil(key []byte) (k, value []byte, ok bool) {
+	return t.nearest(func(root *node, version uint64) (*leaf, bool) {
+		return root.seekLeaf(&t.contention, key, version, false)
+	})
+}
+
+// nearest calls find with the read locked root until it succeeded, and returns the key and value of the found leaf.
+func (t *ART) nearest(find func(root *node, version uint64) (*leaf, bool)) ([]byte, []byte, bool) {
+	defer t.enter().exit()
+	for {
+		root, version, ok := t.rootNode()
+		if ok {
+			if l, ok := find(root, version); ok {
+				if l == nil {
+					return nil, nil, false
+				}
+				return l.key(), t.alloc.leafValue(l), true
+			}
+		}
+		t.contention.restart()
+	}
+}
+
+// rangeIter holds the states of a range scan.
+// When a concurrent modification is detected, the scan will restart from root with bound set to last visited key,
+// so the restarted scan can skip all visited keys efficiently.
+type rangeIter struct {
+	start, end []byte
+	prefix     []byte
+	reverse    bool
+	fn         OpFunc
+	done       bool
+	alloc      *allocator
+	contention *contention
+
+	// bound is lower bound for forward scan, or upper bound for reverse scan.
+	// The subtrees out of bound will be pruned when scanning.
+	bound     []byte
+	hasBound  bool
+	inclusive bool
+}
+
+// scanNode visit all keys in subtree of n, the n must be read locked by caller.
+// It returns false if scan should restart due to concurrent modification.
+//
+//go:norace
+func (it *rangeIter) scanNode(n *node, version uint64, depth uint32, bounded bool) bool {
+	if bounded {
+		cmp, ok := n.comparePrefix(it.contention, it.bound, depth, version)
+		if !ok {
+			return false
+		}
+		if it.reverse {
+			cmp = -cmp
+		}
+		// all keys in this subtree are out of bound.
+		if cmp < 0 {
+			return n.lockCheck(it.contention, version)
+		}
+		// all keys in this subtree are in bound.
+		if cmp > 0 {
+			bounded = false
+		}
+	}
+	depth += n.prefixLen
+
+	// bounded means the bound key goes through this node, so len(it.bound) >= depth.
+	// If the bound ends at this node, the prefixLeaf equals to bound and all children are larger than bound.
+	boundEnd := bounded && uint32(len(it.bound)) == depth
+	if !it.reverse {
+		l := n.loadPrefixLeaf()
+		if !n.lockCheck(it.contention, version) {
+			return false
+		}
+		if l != nil && (!bounded || boundEnd) && it.emit(l, bounded) {
+			return true
+		}
+		if boundEnd {
+			bounded = false
+		}
+	} else if boundEnd {
+		return it.scanPrefixLeaf(n, version)
+	}
+
+	from, step := 0, 1
+	if it.reverse {
+		from, step = 255, -1
+	}
+	if bounded {
+		from = int(it.bound[depth])
+	}
+	for from >= 0 && from < 256 {
+		var (
+			child *node
+			key   int
+		)
+		if it.reverse {
+			child, key = n.seekChildReverse(from)
+		} else {
+			child, key = n.seekChild(from)
+		}
+		if !n.lockCheck(it.contention, version) {
+			return false
+		}
+		if child == nil {
+			break
+		}
+
+		childBounded := bounded && key == int(it.bound[depth])
+		if child.nodeType == typeLeaf {
+			if it.emit((*leaf)(unsafe.Pointer(child)), childBounded) {
+				return true
+			}
+		} else {
+			childVersion, ok := child.rLock(it.contention)
+			if !ok || !n.lockCheck(it.contention, version) {
+				return false
+			}
+			if !it.scanNode(child, childVersion, depth+1, childBounded) {
+				return false
+			}
+			if it.done {
+				return true
+			}
+		}
+		from = key + step
+	}
+
+	if it.reverse {
+		return it.scanPrefixLeaf(n, version)
+	}
+	return true
+}
+
+func (it *rangeIter) scanPrefixLeaf(n *node, version uint64) bool {
+	l := n.loadPrefixLeaf()
+	if !n.lockCheck(it.contention, version) {
+		return false
+	}
+	if l != nil {
+		it.emit(l, true)
+	}
+	return true
+}
+
+// emit check the leaf's key with range and call the callback function.
+// It returns true when the scan is done.
+func (it *rangeIter) emit(l *leaf, bounded bool) bool {
+	key := l.key()
+	if bounded && it.hasBound {
+		cmp := bytes.Compare(key, it.bound)
+		if it.reverse {
+			cmp = -cmp
+		}
+		if cmp < 0 || cmp == 0 && !it.inclusive {
+			return false
+		}
+	}
+
+	if it.reverse {
+		it.done = len(it.start) != 0 && bytes.Compare(key, it.start) < 0
+	} else {
+		it.done = len(it.end) != 0 && bytes.Compare(key, it.end) >= 0
+	}
+	// keys have the same prefix are continuous, so the first key doesn't match means the scan is done.
+	if len(it.prefix) != 0 && !bytes.HasPrefix(key, it.prefix) {
+		it.done = true
+	}
+	if !it.done {
+		it.done = it.fn(key, it.alloc.leafValue(l))
+		it.bound, it.hasBound, it.inclusive = key, true, false
+	}
+	return it.done
+}
+
+// comparePrefix compares the prefix of n with key[depth:depth+n.prefixLen].
+// If key is shorter than the prefix and key[depth:] is a prefix of n's prefix,
+// the n's prefix is considered as greater than key.
+func (n *node) comparePrefix(cont *contention, key []byte, depth uint32, version uint64) (int, bool) {
+	prefix, ok := n.loadPrefix(cont, depth, version)
+	if !ok {
+		return 0, false
+	}
+
+	prefixLen := uint32(len(prefix))
+	end := depth + prefixLen
+	if uint32(len(key)) < end {
+		end = uint32(len(key))
+	}
+	if cmp := bytes.Compare(prefix[:end-depth], key[depth:end]); cmp != 0 {
+		return cmp, true
+	}
+	if end-depth < prefixLen {
+		return 1, true
+	}
+	return 0, true
+}
+
+// loadPrefix returns the full compressed path of n, the depth is the depth of n.
+// If the prefix exceed maxPrefixLen, it will be loaded from any leaf under n.
+func (n *node) loadPrefix(cont *contention, depth uint32, version uint64) ([]byte, bool) {
+	prefixLen := n.prefixLen
+	if prefixLen == 0 {
+		return nil, true
+	}
+
+	var prefix []byte
+	if prefixLen <= maxPrefixLen {
+		p := n.prefix
+		prefix = p[:prefixLen]
+	} else {
+		fullKey, ok := n.fullKey(cont, version)
+		if !ok || uint32(len(fullKey)) < depth+prefixLen {
+			return nil, false
+		}
+		prefix = fullKey[depth : depth+prefixLen]
+	}
+	if !n.lockCheck(cont, version) {
+		return nil, false
+	}
+	return prefix, true
+}
+
+// minLeaf returns the smallest leaf in subtree of n, or nil if the subtree is empty.
+// It returns false if the lookup should restart due to concurrent modification.
+//
+//go:norace
+func (n *node) minLeaf(cont *contention, version uint64) (*leaf, bool) {
+	for {
+		next := n.loadPrefixLeaf().toNode()
+		if next == nil {
+			next = n.firstChild()
+		}
+		l, nextVersion, ok := n.step(cont, version, next)
+		if l != nil || !ok || next == nil {
+			return l, ok
+		}
+		n, version = next, nextVersion
+	}
+}
+
+// maxLeaf returns the largest leaf in subtree of n, or nil if the subtree is empty.
+// It returns false if the lookup should restart due to concurrent modification.
+//
+//go:norace
+func (n *node) maxLeaf(cont *contention, version uint64) (*leaf, bool) {
+	for {
+		next := n.lastChild()
+		if next == nil {
+			next = n.loadPrefixLeaf().toNode()
+		}
+		l, nextVersion, ok := n.step(cont, version, next)
+		if l != nil || !ok || next == nil {
+			return l, ok
+		}
+		n, version = next, nextVersion
+	}
+}
+
+// seekLeaf returns the first leaf greater than or equal to key in subtree of n,
+// or the last leaf less than or equal to key if reverse is true.
+// It returns false if the lookup should restart due to concurrent modification.
+//
+//go:norace
+func (n *node) seekLeaf(cont *contention, key []byte, version uint64, reverse bool) (*leaf, bool) {
+	var (
+		depth uint32
+		// alt is the nearest subtree after (or before if reverse) key found on path, altParent holds it.
+		// It is the result if the path of key ends without a match.
+		alt              *node
+		altParent        *node
+		altParentVersion uint64
+	)
+	for {
+		cmp, ok := n.comparePrefix(cont, key, depth, version)
+		if !ok {
+			return nil, false
+		}
+		if reverse {
+			cmp = -cmp
+		}
+		// all keys in this subtree are after key.
+		if cmp > 0 {
+			return n.edgeLeaf(cont, version, reverse)
+		}
+		// all keys in this subtree are before key.
+		if cmp < 0 {
+			return altParent.edgeLeafOf(cont, alt, altParentVersion, reverse)
+		}
+		depth += n.prefixLen
+
+		if uint32(len(key)) == depth {
+			// the prefixLeaf equals to key, and all children are after key.
+			l := n.loadPrefixLeaf()
+			if !n.lockCheck(cont, version) {
+				return nil, false
+			}
+			if l != nil {
+				return l, true
+			}
+			if reverse {
+				return altParent.edgeLeafOf(cont, alt, altParentVersion, reverse)
+			}
+			return n.edgeLeaf(cont, version, reverse)
+		}
+
+		// the alt of this node is the nearest sibling of the child on key's path,
+		// or the prefixLeaf if reverse and there is no smaller sibling.
+		var (
+			child      *node
+			childLabel int
+			label      = int(key[depth])
+		)
+		if reverse {
+			child, childLabel = n.seekChildReverse(label)
+			next := n.loadPrefixLeaf().toNode()
+			if child != nil && childLabel == label && label > 0 {
+				if c, _ := n.seekChildReverse(label - 1); c != nil {
+					next = c
+				}
+			}
+			if next != nil {
+				alt, altParent, altParentVersion = next, n, version
+			}
+		} else {
+			child, childLabel = n.seekChild(label)
+			if child != nil && childLabel == label && label < 255 {
+				if next, _ := n.seekChild(label + 1); next != nil {
+					alt, altParent, altParentVersion = next, n, version
+				}
+			}
+		}
+		if !n.lockCheck(cont, version) {
+			return nil, false
+		}
+		if child == nil {
+			return altParent.edgeLeafOf(cont, alt, altParentVersion, reverse)
+		}
+		if childLabel != label {
+			return n.edgeLeafOf(cont, child, version, reverse)
+		}
+
+		if child.nodeType == typeLeaf {
+			l := (*leaf)(unsafe.Pointer(child))
+			cmp := bytes.Compare(l.key(), key)
+			if reverse {
+				cmp = -cmp
+			}
+			if cmp >= 0 {
+				return l, true
+			}
+			return altParent.edgeLeafOf(cont, alt, altParentVersion, reverse)
+		}
+
+		childVersion, ok := child.rLock(cont)
+		if !ok || !n.lockCheck(cont, version) {
+			return nil, false
+		}
+		n, version = child, childVersion
+		depth++
+	}
+}
+
+// edgeLeaf returns the smallest leaf in subtree of n, or the largest one if reverse is true.
+func (n *node) edgeLeaf(cont *contention, version uint64, reverse bool) (*leaf, bool) {
+	if reverse {
+		return n.maxLeaf(cont, version)
+	}
+	return n.minLeaf(cont, version)
+}
+
+// edgeLeafOf returns the edgeLeaf of child, which is a leaf or an inner node held by n.
+// A nil child means there is no such leaf.
+func (n *node) edgeLeafOf(cont *contention, child *node, version uint64, reverse bool) (*leaf, bool) {
+	if child == nil {
+		return nil, true
+	}
+	l, childVersion, ok := n.step(cont, version, child)
+	if l != nil || !ok {
+		return l, ok
+	}
+	return child.edgeLeaf(cont, childVersion, reverse)
+}
+
+// step validates n after its child next is loaded. It returns next as a leaf,
+// or the version of next if it's a read locked inner node.
+func (n *node) step(cont *contention, version uint64, next *node) (*leaf, uint64, bool) {
+	if !n.lockCheck(cont, version) {
+		return nil, 0, false
+	}
+	if next == nil {
+		return nil, 0, true
+	}
+	if next.nodeType == typeLeaf {
+		return (*leaf)(unsafe.Pointer(next)), 0, true
+	}
+	nextVersion, ok := next.rLock(cont)
+	if !ok || !n.lockCheck(cont, version) {
+		return nil, 0, false
+	}
+	return nil, nextVersion, true
+}
+
+// firstChild returns the child with the smallest key, or nil if n has no child.
 func (n *node) firstChild() *node {
 	switch n.nodeType {
 	case typeNode4:
 		n4 := (*node4)(unsafe.Pointer(n))
-		return n4.children[0]
+		if n4.numChildren == 0 {
+			return nil
+		}
+		return n.slot(&n4.children[0]).load()
 	case typeNode16:
 		n16 := (*node16)(unsafe.Pointer(n))
-		return n16.children[0]
+		if n16.numChildren == 0 {
+			return nil
+		}
+		return n.slot(&n16.children[0]).load()
 	case typeNode48:
 		n48 := (*node48)(unsafe.Pointer(n))
 		for i := 0; i < 256; i++ {
@@ -17,27 +512,32 @@ func (n *node) firstChild() *node {
 			if pos == 0 {
 				continue
 			}
-			return n48.children[pos-1]
+			return n.slot(&n48.children[pos-1]).load()
 		}
 	case typeNode256:
 		n256 := (*node256)(unsafe.Pointer(n))
 		for i := 0; i < 256; i++ {
-			if c := n256.children[i]; c != nil {
+			if c := n.slot(&n256.children[i]).load(); c != nil {
 				return c
 			}
 		}
 	}
-	panic("unreachable code.")
+	return nil
 }
 
+// lastChild returns the child with the largest key, or nil if n has no child.
 func (n *node) lastChild() *node {
 	switch n.nodeType {
 	case typeNode4:
 		n4 := (*node4)(unsafe.Pointer(n))
-		return n4.children[n4.numChildren-1]
+		if num := n4.numChildren; num > 0 {
+			return n.slot(&n4.children[num-1]).load()
+		}
 	case typeNode16:
 		n16 := (*node16)(unsafe.Pointer(n))
-		return n16.children[n16.numChildren-1]
+		if num := n16.numChildren; num > 0 {
+			return n.slot(&n16.children[num-1]).load()
+		}
 	case typeNode48:
 		n48 := (*node48)(unsafe.Pointer(n))
 		for i := 255; i >= 0; i-- {
@@ -45,17 +545,89 @@ func (n *node) lastChild() *node {
 			if pos == 0 {
 				continue
 			}
-			if c := n48.children[pos-1]; c != nil {
+			if c := n.slot(&n48.children[pos-1]).load(); c != nil {
 				return c
 			}
 		}
 	case typeNode256:
 		n256 := (*node256)(unsafe.Pointer(n))
 		for i := 255; i >= 0; i-- {
-			if c := n256.children[i]; c != nil {
+			if c := n.slot(&n256.children[i]).load(); c != nil {
 				return c
 			}
 		}
 	}
-	panic("unreachable code.")
+	return nil
+}
+
+// seekChild returns the first child whose key is greater than or equal to k, and the key of that child.
+// If there is no such child, a nil child is returned.
+func (n *node) seekChild(k int) (*node, int) {
+	switch n.nodeType {
+	case typeNode4:
+		n4 := (*node4)(unsafe.Pointer(n))
+		for i := 0; i < int(n4.numChildren); i++ {
+			if int(n4.keys[i]) >= k {
+				return n.slot(&n4.children[i]).load(), int(n4.keys[i])
+			}
+		}
+	case typeNode16:
+		n16 := (*node16)(unsafe.Pointer(n))
+		for i := 0; i < int(n16.numChildren); i++ {
+			if int(n16.keys[i]) >= k {
+				return n.slot(&n16.children[i]).load(), int(n16.keys[i])
+			}
+		}
+	case typeNode48:
+		n48 := (*node48)(unsafe.Pointer(n))
+		for i := k; i < 256; i++ {
+			if pos := n48.index[i]; pos > 0 {
+				return n.slot(&n48.children[pos-1]).load(), i
+			}
+		}
+	case typeNode256:
+		n256 := (*node256)(unsafe.Pointer(n))
+		for i := k; i < 256; i++ {
+			if c := n.slot(&n256.children[i]).load(); c != nil {
+				return c, i
+			}
+		}
+	}
+	return nil, 0
+}
+
+// seekChildReverse returns the last child whose key is less than or equal to k, and the key of that child.
+// If there is no such child, a nil child is returned.
+func (n *node) seekChildReverse(k int) (*node, int) {
+	switch n.nodeType {
+	case typeNode4:
+		n4 := (*node4)(unsafe.Pointer(n))
+		for i := int(n4.numChildren) - 1; i >= 0; i-- {
+			if int(n4.keys[i]) <= k {
+				return n.slot(&n4.children[i]).load(), int(n4.keys[i])
+			}
+		}
+	case typeNode16:
+		n16 := (*node16)(unsafe.Pointer(n))
+		for i := int(n16.numChildren) - 1; i >= 0; i-- {
+			if int(n16.keys[i]) <= k {
+				return n.slot(&n16.children[i]).load(), int(n16.keys[i])
+			}
+		}
+	case typeNode48:
+		n48 := (*node48)(unsafe.Pointer(n))
+		for i := k; i >= 0; i-- {
+			if pos := n48.index[i]; pos > 0 {
+				return n.slot(&n48.children[pos-1]).load(), i
+			}
+		}
+	case typeNode256:
+		n256 := (*node256)(unsafe.Pointer(n))
+		for i := k; i >= 0; i-- {
+			if c := n.slot(&n256.children[i]).load(); c != nil {
+				return c, i
+			}
+		}
+	}
+	return nil, 0
 }
@@ -0,0 +1,142 @@
+package art
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	guardStripes = 64
+	// maxFreeNodes is the max number of nodes in each free list, the extra nodes are left to GC.
+	maxFreeNodes = 4096
+)
+
+// reclaimer reuses the retired inner nodes with epoch-based reclamation.
+//
+// Every operation enters a guard which pins the global epoch it observed. A node retired in epoch e
+// is put into the limbo list of e, the global epoch can only advance from e to e+1 when there is no guard
+// pinned e-1, so the limbo list of e-1 is moved to free lists when epoch advanced to e+1, as no operation
+// can still see these nodes.
+//
+// The free lists are typed, and the version of a reused node keeps increasing. So the holders of stale
+// node pointers across operations, like iterators, will only see an obsoleted version and restart.
+// Leaves may be held by users and iterators, they are never reused.
+type reclaimer struct {
+	epoch  uint64
+	guards [guardStripes]guardStripe
+
+	mu    sync.Mutex
+	limbo [3][]*node
+	free  [typeNode256 + 1][]*node
+}
+
+// guardStripe counts the guards pinned each epoch, padded to avoid false sharing.
+type guardStripe struct {
+	counts [3]int64
+	_      [40]byte
+}
+
+// guard is an entered guard, the zero value is a no-op guard.
+type guard struct {
+	s     *guardStripe
+	epoch uint64
+}
+
+// enter pins the current epoch, nodes retired after enter will not be reused until the guard exited.
+// It returns a no-op guard if r is nil.
+func (r *reclaimer) enter() guard {
+	if r == nil {
+		return guard{}
+	}
+	// goroutines have different stacks, use address of a local variable to choose stripe.
+	var x byte
+	s := &r.guards[(uintptr(unsafe.Pointer(&x))>>10)%guardStripes]
+	for {
+		e := atomic.LoadUint64(&r.epoch)
+		atomic.AddInt64(&s.counts[e%3], 1)
+		if atomic.LoadUint64(&r.epoch) == e {
+			return guard{s: s, epoch: e}
+		}
+		atomic.AddInt64(&s.counts[e%3], -1)
+	}
+}
+
+func (g guard) exit() {
+	if g.s != nil {
+		atomic.AddInt64(&g.s.counts[g.epoch%3], -1)
+	}
+}
+
+// retire put n into limbo list, n must have been removed from tree and marked as obsolete.
+func (r *reclaimer) retire(n *node) {
+	r.mu.Lock()
+	e := atomic.LoadUint64(&r.epoch)
+	r.limbo[e%3] = append(r.limbo[e%3], n)
+	r.tryAdvance(e)
+	r.mu.Unlock()
+}
+
+// tryAdvance advance the global epoch from e to e+1 if there is no guard pinned e-1,
+// and move the limbo list of e-1 to free lists. It must be called with mu held.
+func (r *reclaimer) tryAdvance(e uint64) {
+	prev := (e + 2) % 3
+	for i := range r.guards {
+		if atomic.LoadInt64(&r.guards[i].counts[prev]) != 0 {
+			return
+		}
+	}
+	atomic.StoreUint64(&r.epoch, e+1)
+
+	for i, n := range r.limbo[prev] {
+		if len(r.free[n.nodeType]) < maxFreeNodes {
+			n.reset()
+			r.free[n.nodeType] = append(r.free[n.nodeType], n)
+		}
+		r.limbo[prev][i] = nil
+	}
+	r.limbo[prev] = r.limbo[prev][:0]
+}
+
+// alloc returns a reset node of nodeType from free list, or nil if the free list is empty.
+func (r *reclaimer) alloc(nodeType uint8) *node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	free := r.free[nodeType]
+	if len(free) == 0 {
+		return nil
+	}
+	n := free[len(free)-1]
+	free[len(free)-1] = nil
+	r.free[nodeType] = free[:len(free)-1]
+	return n
+}
+
+// reset clears an obsoleted node for reuse, only the type, the version and whether it's in arena are kept.
+// The version is increased to an unlocked version, so stale holders of n will fail to validate it.
+func (n *node) reset() {
+	switch n.nodeType {
+	case typeNode4:
+		n4 := (*node4)(unsafe.Pointer(n))
+		n4.keys = [4]byte{}
+		n.clearSlots(n4.children[:])
+	case typeNode16:
+		n16 := (*node16)(unsafe.Pointer(n))
+		n16.keys = [16]byte{}
+		n.clearSlots(n16.children[:])
+	case typeNode48:
+		n48 := (*node48)(unsafe.Pointer(n))
+		n48.index = [256]int8{}
+		n.clearSlots(n48.children[:])
+		n48.slots = node48EmptySlots
+	case typeNode256:
+		n256 := (*node256)(unsafe.Pointer(n))
+		n.clearSlots(n256.children[:])
+	}
+	n.numChildren = 0
+	n.prefixLen = 0
+	n.prefix = [maxPrefixLen]byte{}
+	n.storePrefixLeaf(nil)
+	n.epoch = 0
+	atomic.AddUint64(&n.version, 3)
+}
@@ -0,0 +1,218 @@
+package art
+
+import "sync/atomic"
+
+// Snapshot is a read-only point-in-time view of ART.
+// It keeps returning the same values while writers continue updating the tree.
+//
+// Snapshot is implemented by copy-on-write. Every node records the epoch when it is created,
+// and nodes created before an alive snapshot are frozen. Writers copy the frozen nodes on the path
+// from root instead of modifying them in place, so the old nodes are kept alive for snapshots.
+// Snapshot must be released after use, otherwise writers will keep copying nodes.
+type Snapshot struct {
+	t     *ART
+	view  *ART
+	epoch uint64
+}
+
+// Snapshot returns a point-in-time view of this tree.
+// The writes finished before Snapshot are visible in the snapshot, and the writes started
+// after Snapshot are not. A write concurrent with Snapshot maybe visible or not.
+// This operation is thread safe.
+func (t *ART) Snapshot() *Snapshot {
+	t.snapMu.Lock()
+	defer t.snapMu.Unlock()
+
+	// lock dummy node, so no one can replace root.
+	t.dummy.lock(&t.contention)
+	epoch := atomic.LoadUint64(&t.epoch) + 1
+	// writers load epoch before frozenEpoch, see loadWriter.
+	atomic.StoreUint64(&t.frozenEpoch, epoch)
+	atomic.StoreUint64(&t.epoch, epoch)
+	root := t.root
+	t.dummy.unlock()
+
+	t.snapshots = append(t.snapshots, epoch)
+	view := &ART{dummy: node{nodeType: typeDummy}, root: root}
+	// iterators of view must keep the slabs alive, and guard the nodes from reuse.
+	view.alloc.arena = t.alloc.arena
+	view.alloc.reclaim = t.alloc.reclaim
+	view.alloc.inPlace = t.alloc.inPlace
+	view.contention.backoff = t.contention.backoff
+	return &Snapshot{
+		t:     t,
+		view:  view,
+		epoch: epoch,
+	}
+}
+
+// Release release this snapshot, the snapshot must not be used after release.
+func (s *Snapshot) Release() {
+	t := s.t
+	t.snapMu.Lock()
+	defer t.snapMu.Unlock()
+
+	var frozenEpoch uint64
+	for i := 0; i < len(t.snapshots); i++ {
+		if t.snapshots[i] == s.epoch {
+			t.snapshots = append(t.snapshots[:i], t.snapshots[i+1:]...)
+			i--
+			continue
+		}
+		if t.snapshots[i] > frozenEpoch {
+			frozenEpoch = t.snapshots[i]
+		}
+	}
+	atomic.StoreUint64(&t.frozenEpoch, frozenEpoch)
+}
+
+// Get lookup this snapshot, and return the value associate with the given key.
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	return s.view.Get(key)
+}
+
+// Scan calls fn for each key in [start, end) of this snapshot in ascending order, until fn return true.
+func (s *Snapshot) Scan(start, end []byte, fn OpFunc) {
+	s.view.Scan(start, end, fn)
+}
+
+// ReverseScan calls fn for each key in [start, end) of this snapshot in descending order, until fn return true.
+func (s *Snapshot) ReverseScan(start, end []byte, fn OpFunc) {
+	s.view.ReverseScan(start, end, fn)
+}
+
+// ScanPrefix calls fn for each key which has the given prefix in this snapshot in ascending order, until fn return true.
+func (s *Snapshot) ScanPrefix(prefix []byte, fn OpFunc) {
+	s.view.ScanPrefix(prefix, fn)
+}
+
+// Min returns the smallest key in this snapshot and its value.
+func (s *Snapshot) Min() (key, value []byte, ok bool) {
+	return s.view.Min()
+}
+
+// Max returns the largest key in this snapshot and its value.
+func (s *Snapshot) Max() (key, value []byte, ok bool) {
+	return s.view.Max()
+}
+
+// Floor returns the largest key less than or equal to key in this snapshot and its value.
+func (s *Snapshot) Floor(key []byte) (k, value []byte, ok bool) {
+	return s.view.Floor(key)
+}
+
+// Ceil returns the smallest key greater than or equal to key in this snapshot and its value.
+func (s *Snapshot) Ceil(key []byte) (k, value []byte, ok bool) {
+	return s.view.Ceil(key)
+}
+
+// NewIterator returns a new iterator of this snapshot, Delete and Set of the iterator panic.
+func (s *Snapshot) NewIterator() *Iterator {
+	it := s.view.NewIterator()
+	it.readOnly = true
+	return it
+}
+
+// writer is the context of a writer after it has locked all nodes it will modify.
+// Snapshot readers wait for the locks, so a writer observed the old frozenEpoch happens before the snapshot.
+type writer struct {
+	alloc      *allocator
+	contention *contention
+	// epoch is the epoch of nodes created by the writer.
+	epoch uint64
+	// frozenEpoch is the epoch of the latest alive snapshot.
+	frozenEpoch uint64
+}
+
+func (t *ART) loadWriter() writer {
+	// Snapshot store frozenEpoch before epoch, so the nodes created with an old epoch
+	// are always frozen by the new snapshot.
+	epoch := atomic.LoadUint64(&t.epoch)
+	return writer{alloc: &t.alloc, contention: &t.contention, epoch: epoch, frozenEpoch: atomic.LoadUint64(&t.frozenEpoch)}
+}
+
+// frozen returns whether n maybe reachable from alive snapshots, n must be an inner node.
+func (w writer) frozen(n *node) bool {
+	return n.nodeType != typeDummy && n.epoch < w.frozenEpoch
+}
+
+// lockedWriter must be called after writer locked n (and parent if parentLocked), to check nodes will be modified are not frozen.
+// Otherwise, the locks are released and the frozen nodes on the path of key are copied, the writer should restart.
+func (t *ART) lockedWriter(key []byte, n, parent *node, parentLocked bool) (writer, bool) {
+	w := t.loadWriter()
+	if !w.frozen(n) && !(parentLocked && w.frozen(parent)) {
+		return w, true
+	}
+
+	n.unlock()
+	if parentLocked {
+		parent.unlock()
+	}
+	t.unshare(key)
+	return w, false
+}
+
+// unshare copies the frozen nodes on the path of key, so writers can modify them in place.
+func (t *ART) unshare(key []byte) {
+	for !t.root.unshare(t, key, 0, &t.dummy, t.dummy.waitUnlock(&t.contention), t.rootLink()) {
+	}
+}
+
+// unshare replace the first frozen node on the path of key with a copy of it.
+// It returns true if there is no frozen node on the path.
+//
+//go:norace
+func (n *node) unshare(t *ART, key []byte, depth uint32, parent *node, parentVersion uint64, nodeLoc link) bool {
+	var (
+		version  uint64
+		ok       bool
+		currNode = n
+		cont     = &t.contention
+	)
+
+	for {
+		if version, ok = currNode.rLock(cont); !ok {
+			return false
+		}
+		if !parent.rUnlock(cont, parentVersion) {
+			return false
+		}
+
+		if t.loadWriter().frozen(currNode) {
+			if !parent.upgradeToLock(cont, parentVersion) {
+				return false
+			}
+			if !currNode.upgradeToLockWithNode(cont, version, parent) {
+				return false
+			}
+
+			// parent maybe frozen by a new snapshot, restart from root to copy it first.
+			if w := t.loadWriter(); !w.frozen(parent) {
+				nodeLoc.store(w.clone(currNode))
+				w.retire(currNode)
+			} else {
+				currNode.unlock()
+			}
+			parent.unlock()
+			return false
+		}
+
+		if depth, ok = currNode.checkPrefix(key, depth); !ok || depth >= uint32(len(key)) {
+			return currNode.rUnlock(cont, version)
+		}
+
+		nextNode, nextLoc, _ := currNode.findChild(key[depth])
+		if !currNode.lockCheck(cont, version) {
+			return false
+		}
+		if nextNode == nil || nextNode.nodeType == typeLeaf {
+			return true
+		}
+
+		depth += 1
+		parent = currNode
+		parentVersion = version
+		nodeLoc = nextLoc
+		currNode = nextNode
+	}
+}
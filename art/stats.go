@@ -0,0 +1,140 @@
+package art
+
+import "time"
+
+// Stats is the shape of ART, and the lock contention of operations on it.
+type Stats struct {
+	Node4   int64
+	Node16  int64
+	Node48  int64
+	Node256 int64
+	Leaves  int64
+	// PrefixLeaves is the number of leaves stored as prefixLeaf, whose keys are prefix of other keys.
+	PrefixLeaves int64
+	// Depth[d] is the number of leaves which have d inner nodes on the path from root.
+	Depth []int64
+	// PrefixLen[l] is the number of inner nodes whose compressed path is l bytes.
+	PrefixLen []int64
+
+	ContentionStats
+}
+
+// ContentionStats is the lock contention of operations on ART since the tree is created.
+// The contention is only counted by trees created WithContentionStats, it is always zero for other trees.
+type ContentionStats struct {
+	// Restarts is the number of operations restarted due to concurrent modification.
+	Restarts int64
+	// ValidationFailures is the number of failed version checks and lock upgrades,
+	// an operation may fail several times before it restarts or finishes.
+	ValidationFailures int64
+	// Spins is the number of times operations wait on locked nodes.
+	Spins int64
+	// LockWait is the total time operations wait on locked nodes.
+	LockWait time.Duration
+}
+
+// Stats walks the whole tree and returns its statistics.
+// The nodes are visited one by one without blocking writers, so the result maybe inconsistent
+// under concurrent update.
+// This operation is thread safe.
+func (t *ART) Stats() Stats {
+	defer t.enter().exit()
+	var s Stats
+	for {
+		root, version, ok := t.rootNode()
+		if ok {
+			s.walk(root, version, 0, &t.contention)
+			break
+		}
+		t.contention.restart()
+	}
+	s.ContentionStats = t.contention.stats()
+	return s
+}
+
+// WithContentionStats makes the tree count the lock contention of operations, which is reported by
+// Stats and Contention. Every restart, failed validation and wait on locked nodes updates shared counters,
+// so it adds a little cost to the contended operations.
+func WithContentionStats() Option {
+	return func(t *ART) {
+		t.contention.counters = new(contentionCounters)
+	}
+}
+
+// Contention returns the lock contention counters of this tree, it is much cheaper than Stats.
+// This operation is thread safe.
+func (t *ART) Contention() ContentionStats {
+	return t.contention.stats()
+}
+
+// walk adds the subtree of n into s, n is an inner node at depth d.
+// A node modified during the walk is loaded again, and a node obsoleted is skipped.
+//
+//go:norace
+func (s *Stats) walk(n *node, version uint64, d int, cont *contention) {
+	var (
+		children    [256]*node
+		numChildren int
+		prefixLen   uint32
+		prefixLeaf  bool
+		ok          bool
+	)
+	for {
+		numChildren, prefixLen, prefixLeaf = 0, n.prefixLen, n.loadPrefixLeaf() != nil
+		for k := 0; k < 256; k++ {
+			c, ck := n.seekChild(k)
+			if c == nil {
+				break
+			}
+			children[numChildren] = c
+			numChildren++
+			k = ck
+		}
+		if n.lockCheck(cont, version) {
+			break
+		}
+		if version, ok = n.rLock(cont); !ok {
+			return
+		}
+	}
+
+	switch n.nodeType {
+	case typeNode4:
+		s.Node4++
+	case typeNode16:
+		s.Node16++
+	case typeNode48:
+		s.Node48++
+	case typeNode256:
+		s.Node256++
+	}
+	s.PrefixLen = addHistogram(s.PrefixLen, int(prefixLen))
+	if prefixLeaf {
+		s.PrefixLeaves++
+		s.addLeaf(d + 1)
+	}
+
+	for _, c := range children[:numChildren] {
+		if c.nodeType == typeLeaf {
+			s.addLeaf(d + 1)
+			continue
+		}
+		if v, ok := c.rLock(cont); ok {
+			s.walk(c, v, d+1, cont)
+		}
+	}
+}
+
+func (s *Stats) addLeaf(d int) {
+	s.Leaves++
+	s.Depth = addHistogram(s.Depth, d)
+}
+
+// addHistogram increase h[i] by one, h is extended if it is too short.
+func addHistogram(h []int64, i int) []int64 {
+	for len(h) <= i {
+		h = append(h, 0)
+	}
+	h[i]++
+	return h
+}
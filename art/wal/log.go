@@ -0,0 +1,262 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A log segment is a sequence of records, each record is a mutation.
+//
+//	record:  crc32 uint32 | length uint32 | lengthCRC uint32 | payload
+//	payload: op byte | uvarint(len(key)) | key | value
+//
+// Integers are little endian, crc32 is CRC-32C of length and payload, lengthCRC is CRC-32C of length.
+// The length is checked by its own checksum, so a corrupted length is never taken as a record running past EOF.
+const (
+	recordHeaderSize = 12
+
+	opPut    byte = 1
+	opDelete byte = 2
+
+	segmentExt    = ".log"
+	checkpointExt = ".ckpt"
+)
+
+// ErrCorrupted is returned by Open when a log segment is corrupted, except for a torn tail of the last segment.
+var ErrCorrupted = errors.New("wal: log segment is corrupted")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%016d%s", seq, segmentExt)
+}
+
+func checkpointName(seq uint64) string {
+	return fmt.Sprintf("%016d%s", seq, checkpointExt)
+}
+
+// listFiles returns the sequences of log segments and checkpoints in dir in ascending order.
+func listFiles(dir string) (segments, checkpoints []uint64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if ext != segmentExt && ext != checkpointExt {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		if ext == segmentExt {
+			segments = append(segments, seq)
+		} else {
+			checkpoints = append(checkpoints, seq)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i] < checkpoints[j] })
+	return segments, checkpoints, nil
+}
+
+func appendRecord(buf []byte, op byte, key, value []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize)...)
+	buf = append(buf, op)
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(key)))]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+
+	rec := buf[start:]
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(rec)-recordHeaderSize))
+	binary.LittleEndian.PutUint32(rec[8:], crc32.Checksum(rec[4:8], crcTable))
+	binary.LittleEndian.PutUint32(rec, recordCRC(rec[4:8], rec[recordHeaderSize:]))
+	return buf
+}
+
+func recordCRC(length, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(length, crcTable), crcTable, payload)
+}
+
+func decodePayload(payload []byte) (op byte, key, value []byte, ok bool) {
+	if len(payload) == 0 {
+		return 0, nil, nil, false
+	}
+	op = payload[0]
+	kl, n := binary.Uvarint(payload[1:])
+	if n <= 0 || kl > uint64(len(payload)-1-n) || op != opPut && op != opDelete {
+		return 0, nil, nil, false
+	}
+	key = payload[1+n : 1+n+int(kl)]
+	value = payload[1+n+int(kl):]
+	return op, key, value, true
+}
+
+// readSegment calls fn for each mutation in the segment in order.
+// It returns the size of valid records, and whether the segment has a torn tail written by a crashed write.
+// A record fails to verify is a torn tail only if its verified length runs past EOF or nothing is written after it,
+// otherwise the segment is corrupted and ErrCorrupted is returned.
+func readSegment(path string, fn func(op byte, key, value []byte)) (valid int64, torn bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := fi.Size()
+
+	r := bufio.NewReader(f)
+	var (
+		hdr     [recordHeaderSize]byte
+		payload []byte
+	)
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return valid, false, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return valid, true, nil
+			}
+			return valid, false, err
+		}
+		if crc32.Checksum(hdr[4:8], crcTable) != binary.LittleEndian.Uint32(hdr[8:]) {
+			return valid, true, checkUnwritten(r)
+		}
+		length := binary.LittleEndian.Uint32(hdr[4:])
+		if valid+recordHeaderSize+int64(length) > size {
+			// the length is verified, so all the rest bytes belong to this record.
+			return valid, true, nil
+		}
+		if int(length) > cap(payload) {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return valid, true, nil
+			}
+			return valid, false, err
+		}
+		if recordCRC(hdr[4:8], payload) != binary.LittleEndian.Uint32(hdr[:]) {
+			return valid, true, checkUnwritten(r)
+		}
+		op, key, value, ok := decodePayload(payload)
+		if !ok {
+			return valid, true, checkUnwritten(r)
+		}
+		fn(op, key, value)
+		valid += recordHeaderSize + int64(length)
+	}
+}
+
+// checkUnwritten returns ErrCorrupted if any of the rest bytes in r is not zero.
+// The file system may extend a file with zeros before the data of a crashed write reaches disk,
+// but a non-zero byte means there are records written after a corrupted one.
+func checkUnwritten(r io.Reader) error {
+	var buf [4096]byte
+	for {
+		n, err := r.Read(buf[:])
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return ErrCorrupted
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// logWriter appends records to the current log segment.
+type logWriter struct {
+	dir  string
+	seq  uint64
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func openLogWriter(dir string, seq uint64) (*logWriter, error) {
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(seq)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &logWriter{dir: dir, seq: seq, f: f, w: bufio.NewWriterSize(f, 64<<10)}, nil
+}
+
+func (l *logWriter) write(records []byte, sync bool) error {
+	if _, err := l.w.Write(records); err != nil {
+		return err
+	}
+	l.size += int64(len(records))
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+// rotate closes current segment and starts a new segment.
+func (l *logWriter) rotate(sync bool) error {
+	if err := l.close(sync); err != nil {
+		return err
+	}
+	next, err := openLogWriter(l.dir, l.seq+1)
+	if err != nil {
+		return err
+	}
+	*l = *next
+	return nil
+}
+
+func (l *logWriter) close(sync bool) error {
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	if sync {
+		if err := l.f.Sync(); err != nil {
+			l.f.Close()
+			return err
+		}
+	}
+	return l.f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
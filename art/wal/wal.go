@@ -0,0 +1,402 @@
+// Package wal implements a write-ahead log for art.ART, which turns the tree into a small embedded persistent KV store.
+//
+// Every mutation is appended to a checksummed log segment before it is applied to the tree. Concurrent writes
+// can be committed together by group commit, so they share a single write and sync of the log.
+// Checkpoint dumps a snapshot of the tree, and removes the log segments which are covered by the checkpoint.
+// Open loads the latest checkpoint and replays the log segments after it.
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bobotu/myk/art"
+)
+
+// ErrClosed is returned when write to a closed DB.
+var ErrClosed = errors.New("wal: db is closed")
+
+const (
+	defaultSegmentSize = 64 << 20
+	checkpointTmp      = "checkpoint.tmp"
+)
+
+type options struct {
+	sync           bool
+	maxGroup       int
+	segmentSize    int64
+	checkpointSize int64
+	treeOpts       []art.Option
+}
+
+// Option configures the DB opened by Open.
+type Option func(o *options)
+
+// WithSync sets whether the log is synced to disk before a write returns, it is true by default.
+// Without sync, the writes in OS page cache maybe lost if machine crashed.
+func WithSync(sync bool) Option {
+	return func(o *options) {
+		o.sync = sync
+	}
+}
+
+// WithGroupCommit enables group commit, at most maxGroup concurrent writes are written and synced together.
+// The group commit is disabled by default.
+func WithGroupCommit(maxGroup int) Option {
+	return func(o *options) {
+		o.maxGroup = maxGroup
+	}
+}
+
+// WithSegmentSize sets the size of log segments, a new segment is started after current segment exceed size.
+func WithSegmentSize(size int64) Option {
+	return func(o *options) {
+		o.segmentSize = size
+	}
+}
+
+// WithCheckpointSize makes DB checkpoint in background once the log written since the last checkpoint exceed size.
+func WithCheckpointSize(size int64) Option {
+	return func(o *options) {
+		o.checkpointSize = size
+	}
+}
+
+// WithTreeOptions sets the options used to create the tree.
+func WithTreeOptions(opts ...art.Option) Option {
+	return func(o *options) {
+		o.treeOpts = opts
+	}
+}
+
+// DB is an ART with write-ahead log.
+// The reads are served by the tree directly, and the writes are serialized by the log.
+type DB struct {
+	dir  string
+	opts options
+	tree *art.ART
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	writers []*request
+	log     *logWriter
+	closed  bool
+	// logErr is the first error of writing log, the log maybe partially written after it,
+	// so all the following commits fail with it. It is only accessed by the leader.
+	logErr error
+	// logSize is the bytes written to log since the last checkpoint.
+	logSize int64
+	// checkpointing is true if a background checkpoint is running.
+	checkpointing bool
+	bgErr         error
+
+	checkpointMu sync.Mutex
+	bg           sync.WaitGroup
+	buf          []byte
+}
+
+// request is a write waiting in the queue, or an exclusive operation on log if fn is not nil.
+type request struct {
+	op         byte
+	key, value []byte
+	fn         func() error
+
+	done bool
+	err  error
+}
+
+// Open opens the DB in dir, the dir is created if not exist.
+// The tree is recovered from the latest checkpoint and the log segments after it.
+// An incomplete record at the end of the last segment is discarded, as it is written by a crashed write.
+// A corrupted record followed by other data is not discarded, Open returns ErrCorrupted instead.
+func Open(dir string, opts ...Option) (*DB, error) {
+	db := &DB{
+		dir:  dir,
+		opts: options{sync: true, maxGroup: 1, segmentSize: defaultSegmentSize},
+	}
+	for _, opt := range opts {
+		opt(&db.opts)
+	}
+	db.cond = sync.NewCond(&db.mu)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, checkpoints, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastSeq uint64
+	if len(checkpoints) > 0 {
+		lastSeq = checkpoints[len(checkpoints)-1]
+		if db.tree, err = loadCheckpoint(filepath.Join(dir, checkpointName(lastSeq)), db.opts.treeOpts); err != nil {
+			return nil, err
+		}
+	} else {
+		db.tree = art.New(db.opts.treeOpts...)
+	}
+
+	for i, seq := range segments {
+		if seq <= lastSeq {
+			continue
+		}
+		path := filepath.Join(dir, segmentName(seq))
+		valid, torn, err := readSegment(path, db.apply)
+		if err != nil {
+			return nil, err
+		}
+		if torn {
+			if i != len(segments)-1 {
+				return nil, ErrCorrupted
+			}
+			if err := os.Truncate(path, valid); err != nil {
+				return nil, err
+			}
+		}
+		db.logSize += valid
+		lastSeq = seq
+	}
+
+	if db.log, err = openLogWriter(dir, lastSeq+1); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func loadCheckpoint(path string, opts []art.Option) (*art.ART, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return art.Load(f, opts...)
+}
+
+func (db *DB) apply(op byte, key, value []byte) {
+	if op == opPut {
+		db.tree.Put(key, value)
+	} else {
+		db.tree.Delete(key)
+	}
+}
+
+// Get lookup the tree, and return the value associate with the given key.
+func (db *DB) Get(key []byte) ([]byte, bool) {
+	return db.tree.Get(key)
+}
+
+// Scan calls fn for each key in range [start, end) in ascending order, until fn return true.
+func (db *DB) Scan(start, end []byte, fn art.OpFunc) {
+	db.tree.Scan(start, end, fn)
+}
+
+// NewIterator returns a new iterator of the tree.
+func (db *DB) NewIterator() *art.Iterator {
+	return db.tree.NewIterator()
+}
+
+// Snapshot returns a point-in-time view of the tree.
+func (db *DB) Snapshot() *art.Snapshot {
+	return db.tree.Snapshot()
+}
+
+// Put put the given key and value into DB, the value is visible after the write is logged.
+func (db *DB) Put(key, value []byte) error {
+	return db.write(&request{op: opPut, key: key, value: value})
+}
+
+// Delete delete the given key from DB.
+func (db *DB) Delete(key []byte) error {
+	return db.write(&request{op: opDelete, key: key})
+}
+
+// write queue the request, and wait until it is committed by itself or a group leader.
+// The first request in queue is the leader, it takes the following writes as a group, and writes them
+// into log and tree in order, so the order of log is always the same as tree.
+func (db *DB) write(r *request) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	db.writers = append(db.writers, r)
+	for !r.done && db.writers[0] != r {
+		db.cond.Wait()
+	}
+	if r.done {
+		db.mu.Unlock()
+		return r.err
+	}
+	if db.closed {
+		db.writers = db.writers[1:]
+		db.cond.Broadcast()
+		db.mu.Unlock()
+		return ErrClosed
+	}
+
+	group := db.writers[:1]
+	if r.fn == nil {
+		for _, w := range db.writers[1:] {
+			if len(group) >= db.opts.maxGroup || w.fn != nil {
+				break
+			}
+			group = db.writers[:len(group)+1]
+		}
+	}
+	db.mu.Unlock()
+
+	var err error
+	if r.fn != nil {
+		err = r.fn()
+	} else {
+		err = db.commit(group)
+	}
+
+	db.mu.Lock()
+	for _, w := range group {
+		w.done, w.err = true, err
+	}
+	db.writers = db.writers[len(group):]
+	db.cond.Broadcast()
+	db.mu.Unlock()
+	return err
+}
+
+// commit writes the group into log, and applies it to tree. Only the leader can call it.
+// Once the log fails to write or sync, the log is poisoned and all the following commits fail.
+func (db *DB) commit(group []*request) error {
+	if db.logErr != nil {
+		return db.logErr
+	}
+	if db.log.size >= db.opts.segmentSize {
+		if err := db.log.rotate(db.opts.sync); err != nil {
+			db.logErr = err
+			return err
+		}
+	}
+
+	db.buf = db.buf[:0]
+	for _, w := range group {
+		db.buf = appendRecord(db.buf, w.op, w.key, w.value)
+	}
+	if err := db.log.write(db.buf, db.opts.sync); err != nil {
+		db.logErr = err
+		return err
+	}
+	for _, w := range group {
+		db.apply(w.op, w.key, w.value)
+	}
+
+	db.mu.Lock()
+	db.logSize += int64(len(db.buf))
+	if db.opts.checkpointSize > 0 && db.logSize >= db.opts.checkpointSize && !db.checkpointing {
+		db.checkpointing = true
+		db.bg.Add(1)
+		go db.backgroundCheckpoint()
+	}
+	db.mu.Unlock()
+	return nil
+}
+
+func (db *DB) backgroundCheckpoint() {
+	defer db.bg.Done()
+	err := db.Checkpoint()
+	db.mu.Lock()
+	if err != nil && err != ErrClosed && db.bgErr == nil {
+		db.bgErr = err
+	}
+	db.checkpointing = false
+	db.mu.Unlock()
+}
+
+// Checkpoint dumps a snapshot of the tree into dir, and removes the log segments covered by it.
+// Writes are only blocked while the log segment is rotated.
+func (db *DB) Checkpoint() error {
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+
+	var (
+		seq  uint64
+		snap *art.Snapshot
+	)
+	err := db.write(&request{fn: func() error {
+		if db.logErr != nil {
+			return db.logErr
+		}
+		seq = db.log.seq
+		if err := db.log.rotate(db.opts.sync); err != nil {
+			db.logErr = err
+			return err
+		}
+		snap = db.tree.Snapshot()
+		db.mu.Lock()
+		db.logSize = 0
+		db.mu.Unlock()
+		return nil
+	}})
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	tmp := filepath.Join(db.dir, checkpointTmp)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = snap.WriteTo(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(db.dir, checkpointName(seq))); err != nil {
+		return err
+	}
+	if err := syncDir(db.dir); err != nil {
+		return err
+	}
+
+	segments, checkpoints, err := listFiles(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s <= seq {
+			if err := os.Remove(filepath.Join(db.dir, segmentName(s))); err != nil {
+				return err
+			}
+		}
+	}
+	for _, c := range checkpoints {
+		if c < seq {
+			if err := os.Remove(filepath.Join(db.dir, checkpointName(c))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close waits for the running checkpoint, and closes the log.
+// It returns the error of background checkpoints if any.
+func (db *DB) Close() error {
+	err := db.write(&request{fn: func() error {
+		db.mu.Lock()
+		db.closed = true
+		db.mu.Unlock()
+		return db.log.close(db.opts.sync)
+	}})
+	if err != nil {
+		return err
+	}
+	db.bg.Wait()
+	return db.bgErr
+}
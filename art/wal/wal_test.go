@@ -0,0 +1,286 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bobotu/myk/art"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wal")
+	require.Nil(t, err)
+	return dir
+}
+
+func checkDB(t *testing.T, db *DB, expected map[string]string) {
+	n := 0
+	db.Scan(nil, nil, func(key, value []byte) bool {
+		v, ok := expected[string(key)]
+		require.True(t, ok, "unexpected key %q", key)
+		require.Equal(t, v, string(value))
+		n++
+		return false
+	})
+	require.Equal(t, len(expected), n)
+}
+
+func TestRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(1024))
+	require.Nil(t, err)
+	expected := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		k, v := fmt.Sprintf("key-%d", i%300), fmt.Sprintf("value-%d", i)
+		if i%7 == 0 {
+			require.Nil(t, db.Delete([]byte(k)))
+			delete(expected, k)
+		} else {
+			require.Nil(t, db.Put([]byte(k), []byte(v)))
+			expected[k] = v
+		}
+	}
+	require.Nil(t, db.Put(nil, []byte("empty key")))
+	expected[""] = "empty key"
+	checkDB(t, db, expected)
+	require.Nil(t, db.Close())
+	require.Equal(t, ErrClosed, db.Put([]byte("k"), nil))
+
+	segments, _, err := listFiles(dir)
+	require.Nil(t, err)
+	require.True(t, len(segments) > 1)
+
+	db, err = Open(dir, WithTreeOptions(art.WithArena(0)))
+	require.Nil(t, err)
+	checkDB(t, db, expected)
+	require.Nil(t, db.Put([]byte("after-reopen"), []byte("v")))
+	expected["after-reopen"] = "v"
+	require.Nil(t, db.Close())
+
+	db, err = Open(dir)
+	require.Nil(t, err)
+	checkDB(t, db, expected)
+	require.Nil(t, db.Close())
+}
+
+func TestTornTail(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+	require.Nil(t, db.Close())
+
+	segments, _, err := listFiles(dir)
+	require.Nil(t, err)
+	path := filepath.Join(dir, segmentName(segments[len(segments)-1]))
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Nil(t, os.Truncate(path, fi.Size()-3))
+
+	db, err = Open(dir)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, ok := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		require.Equal(t, i < 9, ok)
+	}
+	require.Nil(t, db.Put([]byte("key-9"), []byte("value")))
+	require.Nil(t, db.Close())
+
+	// the truncated segment is not the last one now, it must be still readable.
+	db, err = Open(dir)
+	require.Nil(t, err)
+	_, ok := db.Get([]byte("key-9"))
+	require.True(t, ok)
+	require.Nil(t, db.Close())
+
+	// corruption in the middle of log is an error.
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	data[len(data)/2] ^= 0xff
+	require.Nil(t, ioutil.WriteFile(path, data, 0644))
+	_, err = Open(dir)
+	require.Equal(t, ErrCorrupted, err)
+}
+
+func TestCorruptedLastSegment(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+	require.Nil(t, db.Close())
+
+	segments, _, err := listFiles(dir)
+	require.Nil(t, err)
+	path := filepath.Join(dir, segmentName(segments[len(segments)-1]))
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+
+	// the records after a corrupted one are committed, they must not be truncated.
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	require.Nil(t, ioutil.WriteFile(path, corrupted, 0644))
+	_, err = Open(dir)
+	require.Equal(t, ErrCorrupted, err)
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(data)), fi.Size())
+
+	// a torn record followed by zeros is a crashed write, which is discarded.
+	torn := append([]byte(nil), data...)
+	torn[len(torn)-1] ^= 0xff
+	torn = append(torn, make([]byte, 100)...)
+	require.Nil(t, ioutil.WriteFile(path, torn, 0644))
+	db, err = Open(dir)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, ok := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		require.Equal(t, i < 9, ok)
+	}
+	require.Nil(t, db.Close())
+}
+
+func TestCorruptedRecordLength(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+	require.Nil(t, db.Close())
+
+	segments, _, err := listFiles(dir)
+	require.Nil(t, err)
+	path := filepath.Join(dir, segmentName(segments[len(segments)-1]))
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+
+	// a bit flip makes the length of a record in the middle run past EOF,
+	// the records after it are committed, so it must not be taken as a torn tail.
+	recSize := len(appendRecord(nil, opPut, []byte("key-0"), []byte("value")))
+	corrupted := append([]byte(nil), data...)
+	corrupted[4*recSize+6] ^= 0x10
+	require.Nil(t, ioutil.WriteFile(path, corrupted, 0644))
+	_, err = Open(dir)
+	require.Equal(t, ErrCorrupted, err)
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(data)), fi.Size())
+}
+
+func TestPoisonedLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir)
+	require.Nil(t, err)
+	require.Nil(t, db.Put([]byte("k1"), []byte("v1")))
+
+	require.Nil(t, db.log.f.Close())
+	err = db.Put([]byte("k2"), []byte("v2"))
+	require.NotNil(t, err)
+
+	// the failed write maybe partially in log, the following writes must fail even if the log is writable again.
+	db.log, err = openLogWriter(dir, db.log.seq+1)
+	require.Nil(t, err)
+	require.NotNil(t, db.Put([]byte("k3"), []byte("v3")))
+	require.NotNil(t, db.Checkpoint())
+	_, ok := db.Get([]byte("k3"))
+	require.False(t, ok)
+	require.Nil(t, db.Close())
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithSegmentSize(512))
+	require.Nil(t, err)
+	expected := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		require.Nil(t, db.Put([]byte(k), []byte(k)))
+		expected[k] = k
+	}
+	require.Nil(t, db.Checkpoint())
+	segments, checkpoints, err := listFiles(dir)
+	require.Nil(t, err)
+	require.Len(t, checkpoints, 1)
+	require.Len(t, segments, 1)
+	require.True(t, segments[0] > checkpoints[0])
+
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("key-%d", i)
+		require.Nil(t, db.Delete([]byte(k)))
+		delete(expected, k)
+	}
+	require.Nil(t, db.Checkpoint())
+	require.Nil(t, db.Put([]byte("after-checkpoint"), []byte("v")))
+	expected["after-checkpoint"] = "v"
+	require.Nil(t, db.Close())
+
+	_, checkpoints, err = listFiles(dir)
+	require.Nil(t, err)
+	require.Len(t, checkpoints, 1)
+
+	db, err = Open(dir)
+	require.Nil(t, err)
+	checkDB(t, db, expected)
+	require.Nil(t, db.Close())
+}
+
+func TestGroupCommitWithConcurrentWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, WithGroupCommit(32), WithSegmentSize(4096), WithCheckpointSize(16<<10))
+	require.Nil(t, err)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				k := []byte(fmt.Sprintf("key-%d", i%100))
+				if i%5 == 0 {
+					require.Nil(t, db.Delete(k))
+				} else {
+					require.Nil(t, db.Put(k, []byte(fmt.Sprintf("%d-%d", g, i))))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	expected := make(map[string]string)
+	db.Scan(nil, nil, func(key, value []byte) bool {
+		expected[string(key)] = string(value)
+		return false
+	})
+	require.Nil(t, db.Close())
+
+	_, checkpoints, err := listFiles(dir)
+	require.Nil(t, err)
+	require.NotEmpty(t, checkpoints)
+
+	db, err = Open(dir)
+	require.Nil(t, err)
+	checkDB(t, db, expected)
+	require.Nil(t, db.Close())
+}
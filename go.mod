@@ -1,6 +1,6 @@
 module github.com/bobotu/myk
 
-go 1.13
+go 1.18
 
 require (
 	github.com/brianvoe/gofakeit v3.18.0+incompatible
@@ -8,9 +8,35 @@ require (
 	github.com/coocood/bbloom v0.0.0-20180518162752-7774d68761e5
 	github.com/dgryski/go-farm v0.0.0-20190104051053-3adb47b1fb0f
 	github.com/klauspost/cpuid v1.2.1
+	github.com/ngaut/log v0.0.0-20180314031856-b8e36e7ba5ac
 	github.com/pingcap/failpoint v0.0.0-20190708053854-e7b1061e6e81
 	github.com/pingcap/tidb v0.0.0-20190325083614-d6490c1cab3a
 	github.com/stretchr/testify v1.3.0
 )
 
+require (
+	github.com/coocood/rtutil v0.0.0-20190304133409-c84515f646f2 // indirect
+	github.com/cznic/mathutil v0.0.0-20181122101859-297441e03548 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.3.0 // indirect
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
+	github.com/pingcap/errors v0.11.1 // indirect
+	github.com/pingcap/goleveldb v0.0.0-20171020122428-b9ff6c35079e // indirect
+	github.com/pingcap/log v0.0.0-20190307075452-bd41d9273596 // indirect
+	github.com/pingcap/parser v0.0.0-20190325012055-cc0fa08f99ca // indirect
+	github.com/pingcap/tipb v0.0.0-20190107072121-abbec73437b7 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20170806203942-52369c62f446 // indirect
+	github.com/shirou/gopsutil v2.18.10+incompatible // indirect
+	github.com/sirupsen/logrus v1.2.0 // indirect
+	go.uber.org/atomic v1.3.2 // indirect
+	go.uber.org/multierr v1.1.0 // indirect
+	go.uber.org/zap v1.9.1 // indirect
+	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793 // indirect
+	golang.org/x/sys v0.0.0-20190303192550-c2f5717e611c // indirect
+	golang.org/x/text v0.3.0 // indirect
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
+)
+
 replace github.com/stretchr/testify => github.com/bobotu/testify v1.3.1-0.20190730155233-067b303304a8
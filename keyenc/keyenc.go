@@ -0,0 +1,209 @@
+// Package keyenc implements memcomparable encodings of typed keys.
+//
+// The encoded keys compare in the same order as their values by bytes.Compare, so they can be used as keys
+// of art.ART and surf.SuRF directly. Every encoding is self-delimited and no encoded value is a prefix of
+// another encoded value of the same type, so the concatenation of encoded fields is ordered as a tuple.
+package keyenc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInvalidKey is returned when decoding a malformed key.
+var ErrInvalidKey = errors.New("keyenc: invalid encoded key")
+
+const (
+	bytesEscape    = 0x00
+	bytesEscaped   = 0xff
+	bytesTerminate = 0x01
+
+	signMask = 1 << 63
+)
+
+// AppendUint64 appends the encoded v to b, the encoding is 8 bytes big endian.
+func AppendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// DecodeUint64 decodes an uint64 from the beginning of b, and returns the rest bytes.
+func DecodeUint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, ErrInvalidKey
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+// AppendInt64 appends the encoded v to b. The sign bit is flipped, so negative numbers sort before positive numbers.
+func AppendInt64(b []byte, v int64) []byte {
+	return AppendUint64(b, uint64(v)^signMask)
+}
+
+// DecodeInt64 decodes an int64 from the beginning of b, and returns the rest bytes.
+func DecodeInt64(b []byte) (int64, []byte, error) {
+	u, rest, err := DecodeUint64(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(u ^ signMask), rest, nil
+}
+
+// AppendFloat64 appends the encoded v to b. The sign bit of positive numbers is flipped,
+// and all bits of negative numbers are flipped, so larger negative numbers sort before smaller ones.
+// -0 is encoded as 0, and all NaNs are encoded as math.NaN(), which sorts after +Inf.
+func AppendFloat64(b []byte, v float64) []byte {
+	if v == 0 {
+		v = 0
+	} else if math.IsNaN(v) {
+		v = math.NaN()
+	}
+	u := math.Float64bits(v)
+	if u&signMask != 0 {
+		u = ^u
+	} else {
+		u |= signMask
+	}
+	return AppendUint64(b, u)
+}
+
+// DecodeFloat64 decodes a float64 from the beginning of b, and returns the rest bytes.
+func DecodeFloat64(b []byte) (float64, []byte, error) {
+	u, rest, err := DecodeUint64(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if u&signMask != 0 {
+		u &^= signMask
+	} else {
+		u = ^u
+	}
+	return math.Float64frombits(u), rest, nil
+}
+
+// AppendBytes appends the encoded v to b. Every 0x00 in v is escaped as 0x00 0xff,
+// and the encoded value is terminated by 0x00 0x01, so a value sorts before the values it is a prefix of.
+func AppendBytes(b []byte, v []byte) []byte {
+	for _, c := range v {
+		if c == bytesEscape {
+			b = append(b, bytesEscape, bytesEscaped)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return append(b, bytesEscape, bytesTerminate)
+}
+
+// DecodeBytes decodes a byte slice from the beginning of b, and returns the rest bytes.
+// The returned slice is newly allocated.
+func DecodeBytes(b []byte) ([]byte, []byte, error) {
+	var v []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] != bytesEscape {
+			v = append(v, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			return nil, nil, ErrInvalidKey
+		}
+		switch b[i+1] {
+		case bytesEscaped:
+			v = append(v, bytesEscape)
+			i++
+		case bytesTerminate:
+			if v == nil {
+				v = []byte{}
+			}
+			return v, b[i+2:], nil
+		default:
+			return nil, nil, ErrInvalidKey
+		}
+	}
+	return nil, nil, ErrInvalidKey
+}
+
+// AppendString appends the encoded v to b, it's the same as AppendBytes.
+func AppendString(b []byte, v string) []byte {
+	return AppendBytes(b, []byte(v))
+}
+
+// DecodeString decodes a string from the beginning of b, and returns the rest bytes.
+func DecodeString(b []byte) (string, []byte, error) {
+	v, rest, err := DecodeBytes(b)
+	return string(v), rest, err
+}
+
+// The type tags of tuple fields, fields of different types at the same position are ordered by their tags.
+const (
+	tagNil byte = iota + 1
+	tagBytes
+	tagString
+	tagInt64
+	tagUint64
+	tagFloat64
+)
+
+// AppendTuple appends the encoded tuple to b. Each field is encoded with a type tag, so a tuple can be
+// decoded without knowing its schema. The supported field types are nil, []byte, string, int64, int, uint64 and float64.
+// Tuples are ordered by their fields from left to right, and a tuple sorts before the tuples it is a prefix of.
+func AppendTuple(b []byte, fields ...interface{}) ([]byte, error) {
+	for _, f := range fields {
+		switch v := f.(type) {
+		case nil:
+			b = append(b, tagNil)
+		case []byte:
+			b = AppendBytes(append(b, tagBytes), v)
+		case string:
+			b = AppendString(append(b, tagString), v)
+		case int64:
+			b = AppendInt64(append(b, tagInt64), v)
+		case int:
+			b = AppendInt64(append(b, tagInt64), int64(v))
+		case uint64:
+			b = AppendUint64(append(b, tagUint64), v)
+		case float64:
+			b = AppendFloat64(append(b, tagFloat64), v)
+		default:
+			return nil, fmt.Errorf("keyenc: unsupported tuple field type %T", f)
+		}
+	}
+	return b, nil
+}
+
+// DecodeTuple decodes all fields of the tuple encoded in b.
+// An int field is decoded as int64.
+func DecodeTuple(b []byte) ([]interface{}, error) {
+	var (
+		fields []interface{}
+		f      interface{}
+		err    error
+	)
+	for len(b) > 0 {
+		tag := b[0]
+		b = b[1:]
+		switch tag {
+		case tagNil:
+			f = nil
+		case tagBytes:
+			f, b, err = DecodeBytes(b)
+		case tagString:
+			f, b, err = DecodeString(b)
+		case tagInt64:
+			f, b, err = DecodeInt64(b)
+		case tagUint64:
+			f, b, err = DecodeUint64(b)
+		case tagFloat64:
+			f, b, err = DecodeFloat64(b)
+		default:
+			return nil, ErrInvalidKey
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
@@ -0,0 +1,219 @@
+package keyenc_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/bobotu/myk/art"
+	"github.com/bobotu/myk/keyenc"
+	"github.com/bobotu/myk/surf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInt64(t *testing.T) {
+	vals := []int64{math.MinInt64, math.MinInt64 + 1, -1 << 32, -256, -1, 0, 1, 255, 256, 1 << 40, math.MaxInt64}
+	for i := 0; i < 1000; i++ {
+		vals = append(vals, int64(rand.Uint64()))
+	}
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+
+	keys := make([][]byte, len(vals))
+	for i, v := range vals {
+		keys[i] = keyenc.AppendInt64(nil, v)
+		d, rest, err := keyenc.DecodeInt64(keys[i])
+		require.Nil(t, err)
+		require.Empty(t, rest)
+		require.Equal(t, v, d)
+	}
+	checkSorted(t, keys)
+
+	d, rest, err := keyenc.DecodeInt64(keys[0][:7])
+	require.Equal(t, keyenc.ErrInvalidKey, err)
+	require.Nil(t, rest)
+	require.Zero(t, d)
+}
+
+func TestUint64(t *testing.T) {
+	vals := []uint64{0, 1, 255, 256, 1 << 32, math.MaxUint64}
+	for i := 0; i < 1000; i++ {
+		vals = append(vals, rand.Uint64())
+	}
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+
+	keys := make([][]byte, len(vals))
+	for i, v := range vals {
+		keys[i] = keyenc.AppendUint64(nil, v)
+		d, rest, err := keyenc.DecodeUint64(keys[i])
+		require.Nil(t, err)
+		require.Empty(t, rest)
+		require.Equal(t, v, d)
+	}
+	checkSorted(t, keys)
+}
+
+func TestFloat64(t *testing.T) {
+	vals := []float64{math.Inf(-1), -math.MaxFloat64, -1e10, -1, -math.SmallestNonzeroFloat64, 0,
+		math.SmallestNonzeroFloat64, 1, 1e10, math.MaxFloat64, math.Inf(1)}
+	for i := 0; i < 1000; i++ {
+		vals = append(vals, rand.NormFloat64()*1e6)
+	}
+	sort.Float64s(vals)
+
+	keys := make([][]byte, len(vals))
+	for i, v := range vals {
+		keys[i] = keyenc.AppendFloat64(nil, v)
+		d, rest, err := keyenc.DecodeFloat64(keys[i])
+		require.Nil(t, err)
+		require.Empty(t, rest)
+		require.Equal(t, v, d)
+	}
+	checkSorted(t, keys)
+
+	require.Equal(t, keyenc.AppendFloat64(nil, 0), keyenc.AppendFloat64(nil, math.Copysign(0, -1)))
+	nan := keyenc.AppendFloat64(nil, math.NaN())
+	require.True(t, bytes.Compare(nan, keyenc.AppendFloat64(nil, math.Inf(1))) > 0)
+	d, _, err := keyenc.DecodeFloat64(nan)
+	require.Nil(t, err)
+	require.True(t, math.IsNaN(d))
+	// a NaN with sign bit set sorts after +Inf too.
+	require.Equal(t, nan, keyenc.AppendFloat64(nil, math.Copysign(math.NaN(), -1)))
+	require.Equal(t, nan, keyenc.AppendFloat64(nil, math.Float64frombits(0xfff0000000000001)))
+}
+
+func TestBytes(t *testing.T) {
+	vals := [][]byte{{}, {0}, {0, 0}, {0, 1}, {0, 0xff}, {1}, {1, 0}, {1, 0, 0}, {1, 1}, {0xff}, {0xff, 0}, {0xff, 0xff}}
+	for i := 0; i < 1000; i++ {
+		v := make([]byte, rand.Intn(8))
+		for j := range v {
+			// make zeros and 0xff more frequent.
+			v[j] = []byte{0, 1, 0xfe, 0xff}[rand.Intn(4)]
+		}
+		vals = append(vals, v)
+	}
+	sort.Slice(vals, func(i, j int) bool { return bytes.Compare(vals[i], vals[j]) < 0 })
+
+	keys := make([][]byte, len(vals))
+	for i, v := range vals {
+		keys[i] = keyenc.AppendBytes(nil, v)
+		d, rest, err := keyenc.DecodeBytes(keys[i])
+		require.Nil(t, err)
+		require.Empty(t, rest)
+		require.Equal(t, v, d)
+	}
+	checkSorted(t, keys)
+
+	s, rest, err := keyenc.DecodeString(keyenc.AppendString([]byte{}, "a\x00b"))
+	require.Nil(t, err)
+	require.Empty(t, rest)
+	require.Equal(t, "a\x00b", s)
+
+	for _, b := range [][]byte{nil, {0}, {1, 0}, {0, 2}, {1, 2}} {
+		_, _, err := keyenc.DecodeBytes(b)
+		require.Equal(t, keyenc.ErrInvalidKey, err)
+	}
+}
+
+func TestTuple(t *testing.T) {
+	tuples := [][]interface{}{
+		{},
+		{nil},
+		{[]byte("a")},
+		{"a"},
+		{"a", nil},
+		{"a", int64(-1)},
+		{"a", int64(0)},
+		{"a", int64(0), "x"},
+		{"a", int64(1)},
+		{"a\x00"},
+		{"a\x00", int64(-1)},
+		{"b"},
+		{int64(math.MinInt64)},
+		{int64(5), uint64(1)},
+		{int64(5), float64(-1.5)},
+		{uint64(0)},
+		{float64(-1)},
+		{float64(1)},
+	}
+	keys := make([][]byte, len(tuples))
+	for i, tuple := range tuples {
+		key, err := keyenc.AppendTuple(nil, tuple...)
+		require.Nil(t, err)
+		keys[i] = key
+		fields, err := keyenc.DecodeTuple(key)
+		require.Nil(t, err)
+		require.Equal(t, len(tuple), len(fields))
+		for j := range tuple {
+			require.Equal(t, tuple[j], fields[j])
+		}
+	}
+	checkSorted(t, keys)
+
+	key, err := keyenc.AppendTuple(nil, 1)
+	require.Nil(t, err)
+	fields, err := keyenc.DecodeTuple(key)
+	require.Nil(t, err)
+	require.Equal(t, []interface{}{int64(1)}, fields)
+
+	_, err = keyenc.AppendTuple(nil, int32(1))
+	require.NotNil(t, err)
+	_, err = keyenc.DecodeTuple([]byte{0xff})
+	require.Equal(t, keyenc.ErrInvalidKey, err)
+	key, err = keyenc.AppendTuple(nil, int64(1))
+	require.Nil(t, err)
+	_, err = keyenc.DecodeTuple(key[:2])
+	require.Equal(t, keyenc.ErrInvalidKey, err)
+}
+
+func TestOrderInARTAndSuRF(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 2000; i++ {
+		key, err := keyenc.AppendTuple(nil, []string{"", "a", "a\x00", "b"}[rand.Intn(4)], rand.Int63n(200)-100, rand.NormFloat64())
+		require.Nil(t, err)
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	uniq := keys[:1]
+	for _, k := range keys[1:] {
+		if !bytes.Equal(k, uniq[len(uniq)-1]) {
+			uniq = append(uniq, k)
+		}
+	}
+	keys = uniq
+
+	// insert in random order, and assign each key its rank in sorted order as value.
+	tree := art.New()
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		vals[i] = make([]byte, 4)
+		binary.LittleEndian.PutUint32(vals[i], uint32(i))
+	}
+	for _, i := range rand.Perm(len(keys)) {
+		tree.Put(keys[i], vals[i])
+	}
+	var n int
+	tree.Scan(nil, nil, func(key, value []byte) bool {
+		require.Equal(t, keys[n], key)
+		n++
+		return false
+	})
+	require.Equal(t, len(keys), n)
+
+	s := surf.NewBuilder(4, 0, 64).Build(keys, vals, 64)
+	it := s.NewIterator()
+	n = 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, vals[n], it.Value())
+		n++
+	}
+	require.Equal(t, len(keys), n)
+}
+
+func checkSorted(t *testing.T, keys [][]byte) {
+	for i := 1; i < len(keys); i++ {
+		require.True(t, bytes.Compare(keys[i-1], keys[i]) <= 0, "%d: %x > %x", i, keys[i-1], keys[i])
+	}
+}
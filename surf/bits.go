@@ -101,6 +101,26 @@ func setBit(bs []uint64, pos uint32) {
 	bs[wordOff] |= uint64(1) << bitsOff
 }
 
+// appendBits appends the first m bits of src to dst which holds n bits, the bits of dst after n must be zero.
+// The returned slice has the words to hold n+m bits, and the bits after them are zero.
+func appendBits(dst []uint64, n uint32, src []uint64, m uint32) []uint64 {
+	dst = dst[:(n+wordSize-1)/wordSize]
+	bitsOff := n % wordSize
+	for i := uint32(0); i*wordSize < m; i++ {
+		w := src[i]
+		if remain := m - i*wordSize; remain < wordSize {
+			w &= uint64(1)<<remain - 1
+		}
+		if bitsOff == 0 {
+			dst = append(dst, w)
+			continue
+		}
+		dst[len(dst)-1] |= w << bitsOff
+		dst = append(dst, w>>(wordSize-bitsOff))
+	}
+	return dst[:(n+m+wordSize-1)/wordSize]
+}
+
 func align(off int64) int64 {
 	return (off + 7) & ^int64(7)
 }
@@ -151,3 +171,52 @@ func bytesToU32Slice(b []byte) []uint32 {
 	hdr.Data = uintptr(unsafe.Pointer(&b[0]))
 	return u32s
 }
+
+// decoder reads the vectors serialized by writeTo, the returned slices alias the input.
+// If the input is too short, err is set and all following reads return zero values.
+type decoder struct {
+	buf []byte
+	off int64
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrInvalidFormat
+	}
+}
+
+func (d *decoder) bytes(n int64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > int64(len(d.buf)) {
+		d.fail()
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	d.off += n
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return endian.Uint32(b)
+}
+
+func (d *decoder) u64s(n int64) []uint64 {
+	return bytesToU64Slice(d.bytes(n * 8))
+}
+
+func (d *decoder) u32s(n int64) []uint32 {
+	return bytesToU32Slice(d.bytes(n * 4))
+}
+
+// align skips the padding after a vector.
+func (d *decoder) align() {
+	d.bytes(align(d.off) - d.off)
+}
@@ -3,6 +3,7 @@ package surf
 import (
 	"bytes"
 	"io"
+	"math"
 	"math/bits"
 	"sort"
 
@@ -67,6 +68,22 @@ func (v *bitVector) Init(bitsPerLevel [][]uint64, numBitsPerLevel []uint32) {
 	}
 }
 
+// validPadding returns whether the bits after numBits are zero, they are counted by rank and select.
+func (v *bitVector) validPadding() bool {
+	if v.numBits%wordSize == 0 {
+		return true
+	}
+	return v.bits[len(v.bits)-1]>>(v.numBits%wordSize) == 0
+}
+
+func (v *bitVector) ones() uint32 {
+	var n uint32
+	for _, w := range v.bits {
+		n += uint32(bits.OnesCount64(w))
+	}
+	return n
+}
+
 func (v *bitVector) IsSet(pos uint32) bool {
 	return readBit(v.bits, pos)
 }
@@ -132,9 +149,15 @@ func (v *bitVector) DistanceToPrevSetBit(pos uint32) uint32 {
 	return distance
 }
 
+// variableValueSize is the valueSize of valueVector which stores variable-length values.
+const variableValueSize = math.MaxUint32
+
 type valueVector struct {
 	bytes     []byte
 	valueSize uint32
+	// offsets[i] is the start of i-th value in bytes, the last one is the end of all values.
+	// It is only used by variable-length values.
+	offsets []uint32
 }
 
 func (v *valueVector) Init(valuesPerLevel [][]byte, valueSize uint32) {
@@ -152,7 +175,39 @@ func (v *valueVector) Init(valuesPerLevel [][]byte, valueSize uint32) {
 	}
 }
 
+// InitVariable init v with variable-length values,
+// offsetsPerLevel[l][i] is the start of i-th value in valuesPerLevel[l].
+func (v *valueVector) InitVariable(valuesPerLevel [][]byte, offsetsPerLevel [][]uint32) {
+	v.Init(valuesPerLevel, variableValueSize)
+
+	var numValues int
+	for _, offsets := range offsetsPerLevel {
+		numValues += len(offsets)
+	}
+	v.offsets = make([]uint32, 0, numValues+1)
+
+	var base uint32
+	for l, offsets := range offsetsPerLevel {
+		for _, off := range offsets {
+			v.offsets = append(v.offsets, base+off)
+		}
+		base += uint32(len(valuesPerLevel[l]))
+	}
+	v.offsets = append(v.offsets, base)
+}
+
+// holds returns whether v has exactly n values.
+func (v *valueVector) holds(n uint32) bool {
+	if v.valueSize == variableValueSize {
+		return uint64(len(v.offsets)) == uint64(n)+1
+	}
+	return uint64(len(v.bytes)) == uint64(n)*uint64(v.valueSize)
+}
+
 func (v *valueVector) Get(pos uint32) []byte {
+	if v.valueSize == variableValueSize {
+		return v.bytes[v.offsets[pos]:v.offsets[pos+1]]
+	}
 	off := pos * v.valueSize
 	return v.bytes[off : off+v.valueSize]
 }
@@ -162,10 +217,14 @@ func (v *valueVector) MarshalSize() int64 {
 }
 
 func (v *valueVector) rawMarshalSize() int64 {
-	return 8 + int64(len(v.bytes))
+	sz := 8 + int64(len(v.bytes))
+	if v.valueSize == variableValueSize {
+		sz += 8 + int64(len(v.offsets)*4)
+	}
+	return sz
 }
 
-func (v *valueVector) WriteTo(w io.Writer) error {
+func (v *valueVector) writeTo(w io.Writer) error {
 	var bs [4]byte
 	endian.PutUint32(bs[:], uint32(len(v.bytes)))
 	if _, err := w.Write(bs[:]); err != nil {
@@ -177,6 +236,17 @@ func (v *valueVector) WriteTo(w io.Writer) error {
 		return err
 	}
 
+	if v.valueSize == variableValueSize {
+		var length [8]byte
+		endian.PutUint32(length[:4], uint32(len(v.offsets)*4))
+		if _, err := w.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(u32SliceToBytes(v.offsets)); err != nil {
+			return err
+		}
+	}
+
 	if _, err := w.Write(v.bytes); err != nil {
 		return err
 	}
@@ -187,18 +257,38 @@ func (v *valueVector) WriteTo(w io.Writer) error {
 	return err
 }
 
-func (v *valueVector) Unmarshal(buf []byte) []byte {
-	var cursor int64
-	sz := int64(endian.Uint32(buf))
-	cursor += 4
-
-	v.valueSize = endian.Uint32(buf[cursor:])
-	cursor += 4
-
-	v.bytes = buf[cursor : cursor+sz]
-	cursor = align(cursor + sz)
+func (v *valueVector) Unmarshal(d *decoder) {
+	sz := int64(d.uint32())
+	v.valueSize = d.uint32()
+	v.offsets = nil
+	if v.valueSize == variableValueSize {
+		offsetsLen := int64(d.uint32())
+		d.uint32()
+		if offsetsLen%4 != 0 {
+			d.fail()
+		}
+		v.offsets = d.u32s(offsetsLen / 4)
+	}
+	v.bytes = d.bytes(sz)
+	d.align()
+	if d.err != nil {
+		return
+	}
 
-	return buf[cursor:]
+	if v.valueSize == variableValueSize {
+		if len(v.offsets) == 0 || v.offsets[len(v.offsets)-1] != uint32(sz) {
+			d.fail()
+			return
+		}
+		for i := 1; i < len(v.offsets); i++ {
+			if v.offsets[i] < v.offsets[i-1] {
+				d.fail()
+				return
+			}
+		}
+	} else if v.valueSize != 0 && sz%int64(v.valueSize) != 0 {
+		d.fail()
+	}
 }
 
 const selectSampleInterval = 64
@@ -234,6 +324,29 @@ func (v *selectVector) Init(bitsPerLevel [][]uint64, numBitsPerLevel []uint32) *
 	return v
 }
 
+// validLut returns whether numOnes and selectLut agree with bits.
+func (v *selectVector) validLut() bool {
+	if !v.validPadding() || v.ones() != v.numOnes || v.selectLut[0] != 0 {
+		return false
+	}
+	idx := 1
+	sampledOnes := selectSampleInterval
+	onesUptoWord := 0
+	for i, w := range v.bits {
+		ones := bits.OnesCount64(w)
+		for sampledOnes <= onesUptoWord+ones {
+			diff := sampledOnes - onesUptoWord
+			if v.selectLut[idx] != uint32(i*wordSize+int(select64(w, int64(diff)))) {
+				return false
+			}
+			idx++
+			sampledOnes += selectSampleInterval
+		}
+		onesUptoWord += ones
+	}
+	return true
+}
+
 func (v *selectVector) lutSize() uint32 {
 	return (v.numOnes/selectSampleInterval + 1) * 4
 }
@@ -282,7 +395,7 @@ func (v *selectVector) rawMarshalSize() int64 {
 	return 4 + 4 + int64(v.bitsSize()) + int64(v.lutSize())
 }
 
-func (v *selectVector) WriteTo(w io.Writer) error {
+func (v *selectVector) writeTo(w io.Writer) error {
 	var buf [4]byte
 	endian.PutUint32(buf[:], v.numBits)
 	if _, err := w.Write(buf[:]); err != nil {
@@ -305,21 +418,15 @@ func (v *selectVector) WriteTo(w io.Writer) error {
 	return err
 }
 
-func (v *selectVector) Unmarshal(buf []byte) []byte {
-	var cursor int64
-	v.numBits = endian.Uint32(buf)
-	cursor += 4
-	v.numOnes = endian.Uint32(buf[cursor:])
-	cursor += 4
-
-	bitsSize := int64(v.bitsSize())
-	v.bits = bytesToU64Slice(buf[cursor : cursor+bitsSize])
-	cursor += bitsSize
-
-	lutSize := int64(v.lutSize())
-	v.selectLut = bytesToU32Slice(buf[cursor : cursor+lutSize])
-	cursor = align(cursor + lutSize)
-	return buf[cursor:]
+func (v *selectVector) Unmarshal(d *decoder) {
+	v.numBits = d.uint32()
+	v.numOnes = d.uint32()
+	if v.numOnes > v.numBits {
+		d.fail()
+	}
+	v.bits = d.u64s(int64(v.numWords()))
+	v.selectLut = d.u32s(int64(v.lutSize() / 4))
+	d.align()
 }
 
 const (
@@ -349,6 +456,24 @@ func (v *rankVector) init(blockSize uint32, bitsPerLevel [][]uint64, numBitsPerL
 	return v
 }
 
+// validLut returns whether rankLut agrees with bits.
+func (v *rankVector) validLut() bool {
+	if !v.validPadding() {
+		return false
+	}
+	wordPerBlk := v.blockSize / wordSize
+	var totalRank uint32
+	for i := range v.rankLut {
+		if v.rankLut[i] != totalRank {
+			return false
+		}
+		if i < len(v.rankLut)-1 {
+			totalRank += popcountBlock(v.bits, uint32(i)*wordPerBlk, v.blockSize)
+		}
+	}
+	return true
+}
+
 func (v *rankVector) lutSize() uint32 {
 	return (v.numBits/v.blockSize + 1) * 4
 }
@@ -361,7 +486,7 @@ func (v *rankVector) rawMarshalSize() int64 {
 	return 4 + 4 + int64(v.bitsSize()) + int64(v.lutSize())
 }
 
-func (v *rankVector) WriteTo(w io.Writer) error {
+func (v *rankVector) writeTo(w io.Writer) error {
 	var buf [4]byte
 	endian.PutUint32(buf[:], v.numBits)
 	if _, err := w.Write(buf[:]); err != nil {
@@ -384,21 +509,16 @@ func (v *rankVector) WriteTo(w io.Writer) error {
 	return err
 }
 
-func (v *rankVector) Unmarshal(buf []byte) []byte {
-	var cursor int64
-	v.numBits = endian.Uint32(buf)
-	cursor += 4
-	v.blockSize = endian.Uint32(buf[cursor:])
-	cursor += 4
-
-	bitsSize := int64(v.bitsSize())
-	v.bits = bytesToU64Slice(buf[cursor : cursor+bitsSize])
-	cursor += bitsSize
-
-	lutSize := int64(v.lutSize())
-	v.rankLut = bytesToU32Slice(buf[cursor : cursor+lutSize])
-	cursor = align(cursor + lutSize)
-	return buf[cursor:]
+func (v *rankVector) unmarshal(d *decoder, blockSize uint32) {
+	v.numBits = d.uint32()
+	v.blockSize = d.uint32()
+	if v.blockSize != blockSize {
+		d.fail()
+		return
+	}
+	v.bits = d.u64s(int64(v.numWords()))
+	v.rankLut = d.u32s(int64(v.lutSize() / 4))
+	d.align()
 }
 
 type rankVectorDense struct {
@@ -409,6 +529,10 @@ func (v *rankVectorDense) Init(bitsPerLevel [][]uint64, numBitsPerLevel []uint32
 	v.rankVector.init(rankDenseBlockSize, bitsPerLevel, numBitsPerLevel)
 }
 
+func (v *rankVectorDense) Unmarshal(d *decoder) {
+	v.rankVector.unmarshal(d, rankDenseBlockSize)
+}
+
 func (v *rankVectorDense) Rank(pos uint32) uint32 {
 	wordPreBlk := uint32(rankDenseBlockSize / wordSize)
 	blockOff := pos / rankDenseBlockSize
@@ -417,6 +541,14 @@ func (v *rankVectorDense) Rank(pos uint32) uint32 {
 	return v.rankLut[blockOff] + popcountBlock(v.bits, blockOff*wordPreBlk, bitsOff+1)
 }
 
+// rankBefore returns the number of 1 bits before pos, pos can be numBits.
+func (v *rankVectorDense) rankBefore(pos uint32) uint32 {
+	if pos == 0 {
+		return 0
+	}
+	return v.Rank(pos - 1)
+}
+
 type rankVectorSparse struct {
 	rankVector
 }
@@ -425,6 +557,10 @@ func (v *rankVectorSparse) Init(bitsPerLevel [][]uint64, numBitsPerLevel []uint3
 	v.rankVector.init(rankSparseBlockSize, bitsPerLevel, numBitsPerLevel)
 }
 
+func (v *rankVectorSparse) Unmarshal(d *decoder) {
+	v.rankVector.unmarshal(d, rankSparseBlockSize)
+}
+
 func (v *rankVectorSparse) Rank(pos uint32) uint32 {
 	wordPreBlk := uint32(rankSparseBlockSize / wordSize)
 	blockOff := pos / rankSparseBlockSize
@@ -433,6 +569,14 @@ func (v *rankVectorSparse) Rank(pos uint32) uint32 {
 	return v.rankLut[blockOff] + popcountBlock(v.bits, blockOff*wordPreBlk, bitsOff+1)
 }
 
+// rankBefore returns the number of 1 bits before pos, pos can be numBits.
+func (v *rankVectorSparse) rankBefore(pos uint32) uint32 {
+	if pos == 0 {
+		return 0
+	}
+	return v.Rank(pos - 1)
+}
+
 const labelTerminator = 0xff
 
 type labelVector struct {
@@ -496,7 +640,7 @@ func (v *labelVector) rawMarshalSize() int64 {
 	return 4 + int64(len(v.labels))
 }
 
-func (v *labelVector) WriteTo(w io.Writer) error {
+func (v *labelVector) writeTo(w io.Writer) error {
 	var bs [4]byte
 	endian.PutUint32(bs[:], uint32(len(v.labels)))
 	if _, err := w.Write(bs[:]); err != nil {
@@ -512,10 +656,10 @@ func (v *labelVector) WriteTo(w io.Writer) error {
 	return err
 }
 
-func (v *labelVector) Unmarshal(buf []byte) []byte {
-	l := endian.Uint32(buf)
-	v.labels = buf[4 : 4+l]
-	return buf[align(int64(4+l)):]
+func (v *labelVector) Unmarshal(d *decoder) {
+	l := d.uint32()
+	v.labels = d.bytes(int64(l))
+	d.align()
 }
 
 const (
@@ -589,10 +733,10 @@ func (v *suffixVector) MarshalSize() int64 {
 }
 
 func (v *suffixVector) rawMarshalSize() int64 {
-	return 4 + 4 + 4 + int64(v.bitsSize())
+	return 4 + 4 + 4 + 4 + int64(v.bitsSize())
 }
 
-func (v *suffixVector) WriteTo(w io.Writer) error {
+func (v *suffixVector) writeTo(w io.Writer) error {
 	var buf [4]byte
 	endian.PutUint32(buf[:], v.numBits)
 	if _, err := w.Write(buf[:]); err != nil {
@@ -606,6 +750,11 @@ func (v *suffixVector) WriteTo(w io.Writer) error {
 	if _, err := w.Write(buf[:]); err != nil {
 		return err
 	}
+	// keep bits aligned.
+	endian.PutUint32(buf[:], 0)
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
 	if _, err := w.Write(u64SliceToBytes(v.bits)); err != nil {
 		return err
 	}
@@ -616,21 +765,17 @@ func (v *suffixVector) WriteTo(w io.Writer) error {
 	return err
 }
 
-func (v *suffixVector) Unmarshal(buf []byte) []byte {
-	var cursor int64
-	v.numBits = endian.Uint32(buf)
-	cursor += 4
-	v.hashSuffixLen = endian.Uint32(buf[cursor:])
-	cursor += 4
-	v.realSuffixLen = endian.Uint32(buf[cursor:])
-	cursor += 4
-	if v.hasSuffix() {
-		bitsSize := int64(v.bitsSize())
-		v.bits = bytesToU64Slice(buf[cursor : cursor+bitsSize])
-		cursor += bitsSize
+func (v *suffixVector) Unmarshal(d *decoder) {
+	v.numBits = d.uint32()
+	v.hashSuffixLen = d.uint32()
+	v.realSuffixLen = d.uint32()
+	d.uint32()
+	if uint64(v.hashSuffixLen)+uint64(v.realSuffixLen) > wordSize || (!v.hasSuffix() && v.numBits != 0) {
+		d.fail()
+		return
 	}
-	cursor = align(cursor)
-	return buf[cursor:]
+	v.bits = d.u64s(int64(v.numWords()))
+	d.align()
 }
 
 func (v *suffixVector) read(idx uint32) uint64 {
@@ -647,6 +792,11 @@ func (v *suffixVector) read(idx uint32) uint64 {
 	return result
 }
 
+// holds returns whether v has exactly n suffixes.
+func (v *suffixVector) holds(n uint32) bool {
+	return uint64(v.numBits) == uint64(n)*uint64(v.suffixLen())
+}
+
 func (v *suffixVector) suffixLen() uint32 {
 	return v.hashSuffixLen + v.realSuffixLen
 }
@@ -759,6 +909,11 @@ func (v *prefixVector) CheckPrefix(key []byte, depth uint32, nodeID uint32) (uin
 	return uint32(len(prefix)), true
 }
 
+// holds returns whether v has the prefix bits of exactly n nodes, and a prefix for each set bit.
+func (v *prefixVector) holds(n uint32) bool {
+	return v.hasPrefixVec.numBits == n && v.hasPrefixVec.validLut() && uint32(len(v.prefixOffsets)) == v.hasPrefixVec.ones()
+}
+
 func (v *prefixVector) GetPrefix(nodeID uint32) []byte {
 	if !v.hasPrefixVec.IsSet(nodeID) {
 		return nil
@@ -773,8 +928,8 @@ func (v *prefixVector) GetPrefix(nodeID uint32) []byte {
 	return v.prefixData[start:end]
 }
 
-func (v *prefixVector) WriteTo(w io.Writer) error {
-	if err := v.hasPrefixVec.WriteTo(w); err != nil {
+func (v *prefixVector) writeTo(w io.Writer) error {
+	if err := v.hasPrefixVec.writeTo(w); err != nil {
 		return err
 	}
 
@@ -798,19 +953,26 @@ func (v *prefixVector) WriteTo(w io.Writer) error {
 	return err
 }
 
-func (v *prefixVector) Unmarshal(b []byte) []byte {
-	buf1 := v.hasPrefixVec.Unmarshal(b)
-	var cursor int64
-	offsetsLen := int64(endian.Uint32(buf1[cursor:]))
-	cursor += 4
-	dataLen := int64(endian.Uint32(buf1[cursor:]))
-	cursor += 4
-
-	v.prefixOffsets = bytesToU32Slice(buf1[cursor : cursor+offsetsLen])
-	cursor += offsetsLen
-	v.prefixData = buf1[cursor : cursor+dataLen]
+func (v *prefixVector) Unmarshal(d *decoder) {
+	v.hasPrefixVec.Unmarshal(d)
+	offsetsLen := int64(d.uint32())
+	dataLen := int64(d.uint32())
+	if offsetsLen%4 != 0 {
+		d.fail()
+	}
+	v.prefixOffsets = d.u32s(offsetsLen / 4)
+	v.prefixData = d.bytes(dataLen)
+	d.align()
+	if d.err != nil {
+		return
+	}
 
-	return b[v.MarshalSize():]
+	for i, off := range v.prefixOffsets {
+		if off > uint32(dataLen) || (i > 0 && off < v.prefixOffsets[i-1]) {
+			d.fail()
+			return
+		}
+	}
 }
 
 func (v *prefixVector) rawMarshalSize() int64 {
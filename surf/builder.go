@@ -1,5 +1,22 @@
 package surf
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrUnsortedKeys is returned by builder when keys are not in ascending order.
+	ErrUnsortedKeys = errors.New("surf: keys are not sorted")
+	// ErrDuplicateKey is returned by builder when a key appears more than once, see WithDeduplicate.
+	ErrDuplicateKey = errors.New("surf: duplicate key")
+	// ErrLengthMismatch is returned by BuildChecked when keys and vals have different length.
+	ErrLengthMismatch = errors.New("surf: keys and vals have different length")
+	// ErrShortValue is returned by builder when a value is shorter than valueSize.
+	ErrShortValue = errors.New("surf: value is shorter than valueSize")
+)
+
 // Builder is builder of SuRF.
 type Builder struct {
 	sparseStartLevel uint32
@@ -25,6 +42,10 @@ type Builder struct {
 	// value
 	values      [][]byte
 	valueCounts []uint32
+	// valueOffsets[l][i] is the start of i-th value in values[l], only used by variable-length values.
+	valueOffsets   [][]uint32
+	variableValues bool
+	deduplicate    bool
 
 	// prefix
 	hasPrefix [][]uint64
@@ -32,23 +53,132 @@ type Builder struct {
 
 	nodeCounts           []uint32
 	isLastItemTerminator []bool
+
+	// streaming build, see Add.
+	frames []buildFrame
+	// top is the scope of root, its chunks are concatenated into levels by Finish.
+	top          buildScope
+	freeLevels   []int
+	freeScopes   []*buildScope
+	lastKey      []byte
+	pendingKey   []byte
+	pendingValue []byte
+	pendingLcp   int
+	hasPending   bool
+}
+
+// Option is the option of SuRF builder.
+type Option func(b *Builder)
+
+// WithVariableValues stores values with their own length instead of the fixed valueSize,
+// the valueSize of NewBuilder is ignored.
+// Each value costs 4 more bytes for its offset.
+func WithVariableValues() Option {
+	return func(b *Builder) {
+		b.variableValues = true
+	}
+}
+
+// WithDeduplicate keeps the last value of duplicate keys instead of returning ErrDuplicateKey.
+func WithDeduplicate() Option {
+	return func(b *Builder) {
+		b.deduplicate = true
+	}
 }
 
 // NewBuilder returns a new SuRF builder.
-func NewBuilder(valueSize uint32, hashSuffixLen, realSuffixLen uint32) *Builder {
-	return &Builder{
+func NewBuilder(valueSize uint32, hashSuffixLen, realSuffixLen uint32, opts ...Option) *Builder {
+	b := &Builder{
 		valueSize:     valueSize,
 		hashSuffixLen: hashSuffixLen,
 		realSuffixLen: realSuffixLen,
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
 }
 
-// Build returns the SuRF for added kv pairs.
+// Build returns the SuRF for the given kv pairs, the keys must be sorted in ascending order.
 // The bitsPerKeyHint is a size hint used when determine how many levels can use the dense-loudes format.
 // The dense-loudes format is faster than sparse-loudes format, but may consume more space.
+// It panics if the input is invalid, use BuildChecked to get the error instead.
 func (b *Builder) Build(keys, vals [][]byte, bitsPerKeyHint int) *SuRF {
+	surf, err := b.BuildChecked(keys, vals, bitsPerKeyHint)
+	if err != nil {
+		panic(err)
+	}
+	return surf
+}
+
+// BuildChecked is the same as Build, but it returns an error if the keys are not sorted and unique,
+// the keys and vals have different length, or a value is shorter than valueSize.
+// The input is validated before building, the keys and vals are not modified.
+func (b *Builder) BuildChecked(keys, vals [][]byte, bitsPerKeyHint int) (*SuRF, error) {
+	keys, vals, err := b.checkInput(keys, vals)
+	if err != nil {
+		return nil, err
+	}
+
 	b.totalCount = len(keys)
-	b.buildNodes(keys, vals, 0, 0, 0)
+	if len(keys) != 0 {
+		b.buildNodes(keys, vals, 0, 0, 0)
+	}
+	return b.finish(bitsPerKeyHint), nil
+}
+
+// checkInput checks keys are sorted and unique, and every key has a valid value.
+// If deduplicate is set, the duplicate keys are removed from the returned copy of keys and vals.
+func (b *Builder) checkInput(keys, vals [][]byte) ([][]byte, [][]byte, error) {
+	if len(keys) != len(vals) {
+		return nil, nil, fmt.Errorf("%w: %d keys and %d vals", ErrLengthMismatch, len(keys), len(vals))
+	}
+
+	var uniqKeys, uniqVals [][]byte
+	for i := range keys {
+		if err := b.checkValue(vals[i]); err != nil {
+			return nil, nil, fmt.Errorf("%w at %d", err, i)
+		}
+		if i == 0 {
+			continue
+		}
+
+		cmp := bytes.Compare(keys[i-1], keys[i])
+		if cmp > 0 {
+			return nil, nil, fmt.Errorf("%w at %d", ErrUnsortedKeys, i)
+		}
+		if cmp < 0 {
+			if uniqKeys != nil {
+				uniqKeys = append(uniqKeys, keys[i])
+				uniqVals = append(uniqVals, vals[i])
+			}
+			continue
+		}
+
+		if !b.deduplicate {
+			return nil, nil, fmt.Errorf("%w at %d", ErrDuplicateKey, i)
+		}
+		if uniqKeys == nil {
+			uniqKeys = append(make([][]byte, 0, len(keys)), keys[:i]...)
+			uniqVals = append(make([][]byte, 0, len(vals)), vals[:i]...)
+		}
+		uniqVals[len(uniqVals)-1] = vals[i]
+	}
+
+	if uniqKeys != nil {
+		return uniqKeys, uniqVals, nil
+	}
+	return keys, vals, nil
+}
+
+func (b *Builder) checkValue(value []byte) error {
+	if !b.variableValues && uint32(len(value)) < b.valueSize {
+		return ErrShortValue
+	}
+	return nil
+}
+
+func (b *Builder) finish(bitsPerKeyHint int) *SuRF {
 	b.determineCutoffLevel(bitsPerKeyHint)
 	b.buildDense()
 
@@ -103,9 +233,14 @@ func (b *Builder) buildNodes(keys, vals [][]byte, prefixDepth, depth, level int)
 		groupStart = groupEnd
 	}
 
+	b.closeNode(level, nodeStartPos, keys[0][prefixDepth:depth])
+}
+
+// closeNode finish the node at level whose first item is at nodeStartPos,
+// prefix is the compressed path of this node.
+func (b *Builder) closeNode(level int, nodeStartPos uint32, prefix []byte) {
 	// check if current node contains compressed path.
-	if depth-prefixDepth > 0 {
-		prefix := keys[0][prefixDepth:depth]
+	if len(prefix) > 0 {
 		setBit(b.hasPrefix[level], b.nodeCounts[level])
 		b.insertPrefix(prefix, level)
 	}
@@ -148,7 +283,7 @@ func (b *Builder) buildDense() {
 }
 
 func (b *Builder) ensureLevel(level int) {
-	if level >= b.treeHeight() {
+	for level >= b.treeHeight() {
 		b.addLevel()
 	}
 }
@@ -174,6 +309,7 @@ func (b *Builder) addLevel() {
 	b.suffixCounts = append(b.suffixCounts, 0)
 	b.values = append(b.values, []byte{})
 	b.valueCounts = append(b.valueCounts, 0)
+	b.valueOffsets = append(b.valueOffsets, []uint32{})
 	b.prefixes = append(b.prefixes, [][]byte{})
 
 	b.nodeCounts = append(b.nodeCounts, 0)
@@ -185,6 +321,79 @@ func (b *Builder) addLevel() {
 	b.hasPrefix[level] = append(b.hasPrefix[level], 0)
 }
 
+// appendLevel appends the nodes of level src to level dst, src is unchanged.
+func (b *Builder) appendLevel(dst, src int) {
+	numItems, numNodes := b.numItems(dst), b.nodeCounts[dst]
+	b.lsLabels[dst] = append(b.lsLabels[dst], b.lsLabels[src]...)
+	b.lsHasChild[dst] = appendSlotBits(b.lsHasChild[dst], numItems, b.lsHasChild[src], b.numItems(src))
+	b.lsLoudsBits[dst] = appendSlotBits(b.lsLoudsBits[dst], numItems, b.lsLoudsBits[src], b.numItems(src))
+	b.hasPrefix[dst] = appendSlotBits(b.hasPrefix[dst], numNodes, b.hasPrefix[src], b.nodeCounts[src])
+	b.isLastItemTerminator[dst] = b.isLastItemTerminator[dst] || b.isLastItemTerminator[src]
+
+	suffixLen := b.suffixLen()
+	b.suffixes[dst] = appendBits(b.suffixes[dst], b.suffixCounts[dst]*suffixLen, b.suffixes[src], b.suffixCounts[src]*suffixLen)
+	b.suffixCounts[dst] += b.suffixCounts[src]
+
+	valuesLen := uint32(len(b.values[dst]))
+	for _, off := range b.valueOffsets[src] {
+		b.valueOffsets[dst] = append(b.valueOffsets[dst], valuesLen+off)
+	}
+	b.values[dst] = append(b.values[dst], b.values[src]...)
+	b.valueCounts[dst] += b.valueCounts[src]
+
+	b.prefixes[dst] = append(b.prefixes[dst], b.prefixes[src]...)
+	b.nodeCounts[dst] += b.nodeCounts[src]
+}
+
+// appendSlotBits appends bits like appendBits, and keeps a free word after the last bit like addLevel.
+func appendSlotBits(dst []uint64, n uint32, src []uint64, m uint32) []uint64 {
+	dst = appendBits(dst, n, src, m)
+	if (n+m)%wordSize == 0 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+// resetLevel releases the nodes of level, and leaves it empty as addLevel.
+func (b *Builder) resetLevel(level int) {
+	b.lsLabels[level] = []byte{}
+	b.lsHasChild[level] = []uint64{0}
+	b.lsLoudsBits[level] = []uint64{0}
+	b.hasPrefix[level] = []uint64{0}
+	b.suffixes[level] = []uint64{}
+	b.suffixCounts[level] = 0
+	b.values[level] = []byte{}
+	b.valueCounts[level] = 0
+	b.valueOffsets[level] = []uint32{}
+	b.prefixes[level] = [][]byte{}
+	b.nodeCounts[level] = 0
+	b.isLastItemTerminator[level] = false
+}
+
+// reorderLevels keeps only the levels in order, the i-th level is the order[i]-th level before.
+func (b *Builder) reorderLevels(order []int) {
+	b.lsLabels = reorder(b.lsLabels, order)
+	b.lsHasChild = reorder(b.lsHasChild, order)
+	b.lsLoudsBits = reorder(b.lsLoudsBits, order)
+	b.hasPrefix = reorder(b.hasPrefix, order)
+	b.suffixes = reorder(b.suffixes, order)
+	b.suffixCounts = reorder(b.suffixCounts, order)
+	b.values = reorder(b.values, order)
+	b.valueCounts = reorder(b.valueCounts, order)
+	b.valueOffsets = reorder(b.valueOffsets, order)
+	b.prefixes = reorder(b.prefixes, order)
+	b.nodeCounts = reorder(b.nodeCounts, order)
+	b.isLastItemTerminator = reorder(b.isLastItemTerminator, order)
+}
+
+func reorder[T any](s []T, order []int) []T {
+	r := make([]T, len(order))
+	for i, j := range order {
+		r[i] = s[j]
+	}
+	return r
+}
+
 func (b *Builder) moveToNextItemSlot(level int) {
 	if b.numItems(level)%wordSize == 0 {
 		b.lsHasChild[level] = append(b.lsHasChild[level], 0)
@@ -196,8 +405,10 @@ func (b *Builder) insertSuffix(key []byte, level, depth int) {
 	if level >= b.treeHeight() {
 		b.addLevel()
 	}
-	suffix := constructSuffix(key, uint32(depth)+1, b.realSuffixLen, b.hashSuffixLen)
+	b.appendSuffix(constructSuffix(key, uint32(depth)+1, b.realSuffixLen, b.hashSuffixLen), level)
+}
 
+func (b *Builder) appendSuffix(suffix uint64, level int) {
 	suffixLen := b.suffixLen()
 	pos := b.suffixCounts[level] * suffixLen
 	if pos == uint32(len(b.suffixes[level])*wordSize) {
@@ -214,10 +425,24 @@ func (b *Builder) insertSuffix(key []byte, level, depth int) {
 }
 
 func (b *Builder) insertValue(value []byte, level int) {
-	b.values[level] = append(b.values[level], value[:b.valueSize]...)
+	if b.variableValues {
+		b.valueOffsets[level] = append(b.valueOffsets[level], uint32(len(b.values[level])))
+		b.values[level] = append(b.values[level], value...)
+	} else {
+		b.values[level] = append(b.values[level], value[:b.valueSize]...)
+	}
 	b.valueCounts[level]++
 }
 
+// initValues init v with the values in levels [start, end).
+func (b *Builder) initValues(v *valueVector, start, end uint32) {
+	if b.variableValues {
+		v.InitVariable(b.values[start:end], b.valueOffsets[start:end])
+		return
+	}
+	v.Init(b.values[start:end], b.valueSize)
+}
+
 func (b *Builder) insertPrefix(prefix []byte, level int) {
 	b.prefixes[level] = append(b.prefixes[level], append([]byte{}, prefix...))
 }
@@ -0,0 +1,332 @@
+package surf
+
+import "bytes"
+
+// buildFrame is an unfinished node on the path of the last added key.
+type buildFrame struct {
+	level int
+	// the compressed path of this node is key[prefixDepth:labelDepth],
+	// and the labels of this node are key[labelDepth].
+	prefixDepth int
+	labelDepth  int
+	// outer is the scope of this node, and scope is the scope of the finished nodes below this node.
+	// A splittable node has its own scope, the others share the scope of their parents.
+	outer *buildScope
+	scope *buildScope
+	node  nodeItems
+}
+
+// splittable returns true if the compressed path of this node may be split by the following keys.
+func (f *buildFrame) splittable() bool {
+	return f.labelDepth > f.prefixDepth
+}
+
+// nodeItems is the items of a node, and the suffixes and values of the leaves among them.
+type nodeItems struct {
+	items     []buildItem
+	suffixes  []uint64
+	values    []byte
+	valueLens []uint32
+}
+
+type buildItem struct {
+	label      byte
+	hasChild   bool
+	terminator bool
+}
+
+func (n *nodeItems) reset() {
+	n.items = n.items[:0]
+	n.suffixes = n.suffixes[:0]
+	n.values = n.values[:0]
+	n.valueLens = n.valueLens[:0]
+}
+
+// minChunkItems is the number of items of a chunk to be linked into the parent scope,
+// the smaller chunks are copied into the last chunk of their levels.
+const minChunkItems = 1024
+
+// buildScope holds the finished nodes below a splittable node. The split of the node moves all nodes of
+// its scope one level down, so the nodes are written into levels relative to the scope.
+type buildScope struct {
+	// base is the level of the nodes in chunks[0].
+	base int
+	// chunks[i] is the levels of builder holding the nodes at level base+i, in the order of the nodes.
+	chunks [][]int
+}
+
+// shift moves the nodes of s one level down.
+func (s *buildScope) shift() {
+	s.chunks = append(s.chunks, nil)
+	copy(s.chunks[1:], s.chunks)
+	s.chunks[0] = nil
+}
+
+// Add adds a kv pair into builder, the keys must be added in strictly ascending order.
+// Instead of collecting all keys like Build, Add builds the LOUDS levels incrementally,
+// and only the path of the last key is kept besides the result.
+//
+// The compressed path of an unfinished node is split when a key diverges from the previous key inside it,
+// which moves the finished subtree of the node one level down. So the finished nodes below such a node are
+// written into its scope as soon as they are finished, and a split only inserts an empty level into the scope.
+// The scope is linked into the scope of the parent when the node is finished, only the chunks of levels
+// with less than minChunkItems items are copied, and Finish concatenates the chunks of each level.
+// The key and value can be reused by caller after Add returns.
+// Finish must be called to get the SuRF after all pairs are added, Add and Build can't be mixed on one builder.
+// Add returns an error and leaves builder unchanged if the key or value is invalid, see Build.
+func (b *Builder) Add(key, value []byte) error {
+	if err := b.checkValue(value); err != nil {
+		return err
+	}
+	if b.hasPending {
+		cmp := bytes.Compare(b.pendingKey, key)
+		if cmp > 0 {
+			return ErrUnsortedKeys
+		}
+		if cmp == 0 {
+			if !b.deduplicate {
+				return ErrDuplicateKey
+			}
+			b.pendingValue = append(b.pendingValue[:0], value...)
+			return nil
+		}
+	}
+
+	b.totalCount++
+	if b.hasPending {
+		lcp := commonPrefixLen(b.pendingKey, key)
+		b.addKey(b.pendingKey, b.pendingValue, b.pendingLcp, lcp)
+		b.lastKey, b.pendingKey = b.pendingKey, b.lastKey
+		b.pendingLcp = lcp
+	} else {
+		b.pendingLcp = -1
+		b.hasPending = true
+	}
+	b.pendingKey = append(b.pendingKey[:0], key...)
+	b.pendingValue = append(b.pendingValue[:0], value...)
+	return nil
+}
+
+// Finish returns the SuRF for the kv pairs added by Add.
+// The bitsPerKeyHint is the same as Build.
+func (b *Builder) Finish(bitsPerKeyHint int) *SuRF {
+	if b.hasPending {
+		b.addKey(b.pendingKey, b.pendingValue, b.pendingLcp, -1)
+		b.lastKey, b.pendingKey = b.pendingKey, b.lastKey
+		b.hasPending = false
+	}
+	for len(b.frames) > 0 {
+		b.popFrame()
+	}
+	b.collectLevels()
+	return b.finish(bitsPerKeyHint)
+}
+
+// addKey adds key into the trie, lp and ln are the length of common prefix of key with
+// the previous key and the next key, or -1 if there isn't one.
+// Like buildNodes, the key is truncated at depth max(lp, ln), which is the shortest prefix distinguish
+// it from its neighbors.
+func (b *Builder) addKey(key, value []byte, lp, ln int) {
+	if len(b.frames) == 0 {
+		depth := ln
+		if depth < 0 {
+			depth = 0
+		}
+		b.pushFrame(0, 0, depth)
+	} else {
+		for b.topFrame().prefixDepth > lp {
+			b.popFrame()
+		}
+		if b.topFrame().labelDepth > lp {
+			b.splitFrame(lp)
+		}
+	}
+
+	// labelDepth of the top node is lp now, unless key is the first one.
+	f := b.topFrame()
+	if ln > f.labelDepth {
+		f.node.items = append(f.node.items, buildItem{label: key[f.labelDepth], hasChild: true})
+		f = b.pushFrame(f.level+1, f.labelDepth+1, ln)
+	}
+	b.appendLeaf(&f.node, key, value, f.labelDepth)
+}
+
+func (b *Builder) topFrame() *buildFrame {
+	return &b.frames[len(b.frames)-1]
+}
+
+func (b *Builder) pushFrame(level, prefixDepth, labelDepth int) *buildFrame {
+	outer := &b.top
+	if len(b.frames) > 0 {
+		outer = b.topFrame().scope
+	}
+	if len(b.frames) < cap(b.frames) {
+		b.frames = b.frames[:len(b.frames)+1]
+	} else {
+		b.frames = append(b.frames, buildFrame{})
+	}
+
+	f := b.topFrame()
+	f.level = level
+	f.prefixDepth = prefixDepth
+	f.labelDepth = labelDepth
+	f.outer, f.scope = outer, outer
+	if f.splittable() {
+		f.scope = b.newScope(level + 1)
+	}
+	f.node.reset()
+	return f
+}
+
+// popFrame finish the top node, all keys of it must have been added.
+func (b *Builder) popFrame() {
+	f := b.topFrame()
+	b.writeNode(f.outer, f.level, &f.node, b.lastKey[f.prefixDepth:f.labelDepth])
+	if f.scope != f.outer {
+		b.mergeScope(f.outer, f.scope)
+	}
+	b.frames = b.frames[:len(b.frames)-1]
+}
+
+// splitFrame splits the compressed path of the top node at depth.
+// The top node keeps the path before depth, and the origin node is finished as its only child,
+// so the finished subtree of the top node is one level deeper than it was written.
+// All children of the top node must have been finished.
+func (b *Builder) splitFrame(depth int) {
+	f := b.topFrame()
+	f.scope.shift()
+	b.writeNode(f.scope, f.level+1, &f.node, b.lastKey[depth+1:f.labelDepth])
+	f.node.reset()
+	f.node.items = append(f.node.items, buildItem{label: b.lastKey[depth], hasChild: true})
+	f.labelDepth = depth
+	if !f.splittable() {
+		// the top node can't be split anymore, so its subtree is written into the scope of its parent.
+		b.mergeScope(f.outer, f.scope)
+		f.scope = f.outer
+	}
+}
+
+func (b *Builder) appendLeaf(n *nodeItems, key, value []byte, depth int) {
+	if depth == len(key) {
+		n.items = append(n.items, buildItem{label: labelTerminator, terminator: true})
+	} else {
+		n.items = append(n.items, buildItem{label: key[depth]})
+	}
+	n.suffixes = append(n.suffixes, constructSuffix(key, uint32(depth)+1, b.realSuffixLen, b.hashSuffixLen))
+	if !b.variableValues {
+		value = value[:b.valueSize]
+	}
+	n.values = append(n.values, value...)
+	n.valueLens = append(n.valueLens, uint32(len(value)))
+}
+
+// writeNode writes a finished node at level into scope s.
+func (b *Builder) writeNode(s *buildScope, level int, n *nodeItems, prefix []byte) {
+	l := b.lastChunk(s, level-s.base)
+	nodeStartPos := b.numItems(l)
+	for _, item := range n.items {
+		b.appendItem(l, item.label, item.hasChild)
+		if item.terminator {
+			b.isLastItemTerminator[l] = true
+		}
+	}
+
+	var valueOff uint32
+	for i, suffix := range n.suffixes {
+		b.appendSuffix(suffix, l)
+		vl := n.valueLens[i]
+		b.insertValue(n.values[valueOff:valueOff+vl], l)
+		valueOff += vl
+	}
+	b.closeNode(l, nodeStartPos, prefix)
+}
+
+// lastChunk returns the last chunk of i-th level of s, a new chunk is added if the level is empty.
+func (b *Builder) lastChunk(s *buildScope, i int) int {
+	for len(s.chunks) <= i {
+		s.chunks = append(s.chunks, nil)
+	}
+	if len(s.chunks[i]) == 0 {
+		s.chunks[i] = append(s.chunks[i], b.newLevel())
+	}
+	return s.chunks[i][len(s.chunks[i])-1]
+}
+
+// mergeScope appends the levels of src to the levels of dst, and releases src.
+func (b *Builder) mergeScope(dst, src *buildScope) {
+	off := src.base - dst.base
+	for i, chunks := range src.chunks {
+		for len(dst.chunks) <= off+i {
+			dst.chunks = append(dst.chunks, nil)
+		}
+		for _, c := range chunks {
+			if last := dst.chunks[off+i]; len(last) > 0 && b.numItems(c) < minChunkItems {
+				b.appendLevel(last[len(last)-1], c)
+				b.resetLevel(c)
+				b.freeLevels = append(b.freeLevels, c)
+				continue
+			}
+			dst.chunks[off+i] = append(dst.chunks[off+i], c)
+		}
+	}
+	src.chunks = src.chunks[:0]
+	b.freeScopes = append(b.freeScopes, src)
+}
+
+func (b *Builder) newScope(base int) *buildScope {
+	var s *buildScope
+	if n := len(b.freeScopes); n > 0 {
+		s = b.freeScopes[n-1]
+		b.freeScopes = b.freeScopes[:n-1]
+	} else {
+		s = new(buildScope)
+	}
+	s.base = base
+	return s
+}
+
+// newLevel returns an empty level used as a chunk.
+func (b *Builder) newLevel() int {
+	if n := len(b.freeLevels); n > 0 {
+		l := b.freeLevels[n-1]
+		b.freeLevels = b.freeLevels[:n-1]
+		return l
+	}
+	b.addLevel()
+	return b.treeHeight() - 1
+}
+
+// collectLevels concatenates the chunks of each level of root scope, and drops the other levels.
+func (b *Builder) collectLevels() {
+	order := make([]int, len(b.top.chunks))
+	for i, chunks := range b.top.chunks {
+		for _, c := range chunks[1:] {
+			b.appendLevel(chunks[0], c)
+			b.resetLevel(c)
+		}
+		order[i] = chunks[0]
+	}
+	b.reorderLevels(order)
+	b.top.chunks = nil
+	b.freeLevels = nil
+}
+
+func (b *Builder) appendItem(level int, label byte, hasChild bool) {
+	b.lsLabels[level] = append(b.lsLabels[level], label)
+	b.moveToNextItemSlot(level)
+	if hasChild {
+		setBit(b.lsHasChild[level], b.numItems(level)-1)
+	}
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	var i int
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,190 @@
+package surf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The serialized SuRF is a header followed by four sections,
+// which are LOUDS-Dense, LOUDS-Sparse, values of LOUDS-Dense and values of LOUDS-Sparse.
+//
+//	header:  magic "SuRF" | version uint32 | hashSuffixLen uint32 | realSuffixLen uint32 |
+//	         valueSize uint32 | denseHeight uint32 | reserved uint32 | crc32 uint32
+//	section: size uint64 | vectors | crc32 uint32 | reserved uint32
+//
+// Integers are little endian, the checksum of header is CRC-32C of the bytes before it,
+// and the checksum of section is CRC-32C of its vectors.
+// Every vector is padded to 8 bytes, so the serialized SuRF can be used in place if it is 8 bytes aligned.
+const (
+	formatMagic   = "SuRF"
+	formatVersion = 1
+	headerSize    = 32
+	// sectionOverhead is the size of section header and trailer.
+	sectionOverhead = 16
+)
+
+var (
+	// ErrInvalidFormat is returned by Unmarshal when the input is not a serialized SuRF.
+	ErrInvalidFormat = errors.New("surf: invalid format")
+	// ErrChecksumMismatch is returned by Unmarshal when the input is corrupted.
+	ErrChecksumMismatch = errors.New("surf: checksum mismatch")
+	// ErrCorrupted is returned by Unmarshal when the checksums are valid, but the sections disagree with each other.
+	ErrCorrupted = errors.New("surf: corrupted")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// section is a checksummed part of serialized SuRF.
+type section interface {
+	MarshalSize() int64
+	writeTo(w io.Writer) error
+	Unmarshal(d *decoder)
+}
+
+func (s *SuRF) sections() [4]section {
+	return [4]section{&s.ld, &s.ls, &s.ld.values, &s.ls.values}
+}
+
+func (s *SuRF) header() [headerSize]byte {
+	var h [headerSize]byte
+	copy(h[:], formatMagic)
+	endian.PutUint32(h[4:], formatVersion)
+	suffixes := &s.ld.suffixes
+	if !suffixes.hasSuffix() {
+		suffixes = &s.ls.suffixes
+	}
+	endian.PutUint32(h[8:], suffixes.hashSuffixLen)
+	endian.PutUint32(h[12:], suffixes.realSuffixLen)
+	endian.PutUint32(h[16:], s.ls.values.valueSize)
+	endian.PutUint32(h[20:], s.ld.height)
+	endian.PutUint32(h[28:], crc32.Checksum(h[:28], crcTable))
+	return h
+}
+
+// MarshalSize returns the size of SuRF after serialization.
+func (s *SuRF) MarshalSize() int64 {
+	size := int64(headerSize)
+	for _, sec := range s.sections() {
+		size += sectionOverhead + sec.MarshalSize()
+	}
+	return size
+}
+
+// Marshal returns the serialized SuRF.
+func (s *SuRF) Marshal() []byte {
+	w := bytes.NewBuffer(make([]byte, 0, s.MarshalSize()))
+	_, _ = s.WriteTo(w)
+	return w.Bytes()
+}
+
+// WriteTo serialize SuRF to writer, it returns the number of bytes written.
+func (s *SuRF) WriteTo(w io.Writer) (int64, error) {
+	cw := &checksumWriter{w: w, crc: crc32.New(crcTable)}
+	h := s.header()
+	if _, err := cw.Write(h[:]); err != nil {
+		return cw.n, err
+	}
+
+	var buf [8]byte
+	for _, sec := range s.sections() {
+		endian.PutUint64(buf[:], uint64(sec.MarshalSize()))
+		if _, err := cw.Write(buf[:]); err != nil {
+			return cw.n, err
+		}
+		cw.crc.Reset()
+		if err := sec.writeTo(cw); err != nil {
+			return cw.n, err
+		}
+		endian.PutUint64(buf[:], uint64(cw.crc.Sum32()))
+		if _, err := cw.Write(buf[:]); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// Unmarshal deserialize SuRF from bytes, the SuRF refers to b instead of copying it,
+// so b must not be modified while the SuRF is in use.
+// The input is checked against checksums, its bounds and the consistency of sections,
+// and s is unchanged if an error is returned.
+func (s *SuRF) Unmarshal(b []byte) error {
+	return s.unmarshal(b, true)
+}
+
+// unmarshal is the same as Unmarshal, but if verify is false, only the header, the bounds of sections and vectors
+// and the offsets of values and prefixes are checked, so the bit vectors and their lookup tables are not read.
+func (s *SuRF) unmarshal(b []byte, verify bool) error {
+	if len(b) < headerSize || string(b[:len(formatMagic)]) != formatMagic {
+		return ErrInvalidFormat
+	}
+	if crc32.Checksum(b[:28], crcTable) != endian.Uint32(b[28:]) {
+		return ErrChecksumMismatch
+	}
+	if v := endian.Uint32(b[4:]); v != formatVersion {
+		return fmt.Errorf("surf: unsupported format version %d", v)
+	}
+
+	var t SuRF
+	buf := b[headerSize:]
+	for _, sec := range t.sections() {
+		if len(buf) < sectionOverhead {
+			return ErrInvalidFormat
+		}
+		size := endian.Uint64(buf)
+		if size > uint64(len(buf)-sectionOverhead) {
+			return ErrInvalidFormat
+		}
+		body := buf[8 : 8+size]
+		if verify && uint64(crc32.Checksum(body, crcTable)) != endian.Uint64(buf[8+size:]) {
+			return ErrChecksumMismatch
+		}
+
+		d := decoder{buf: body}
+		sec.Unmarshal(&d)
+		if d.err != nil || len(d.buf) != 0 {
+			return ErrInvalidFormat
+		}
+		buf = buf[sectionOverhead+size:]
+	}
+
+	h := t.header()
+	if len(buf) != 0 || !bytes.Equal(h[:], b[:headerSize]) ||
+		t.ld.values.valueSize != t.ls.values.valueSize || t.ls.startLevel != t.ld.height {
+		return ErrInvalidFormat
+	}
+	if verify && !t.consistent() {
+		return ErrCorrupted
+	}
+	// the mapping is still owned by s, it is released by Close.
+	t.mapped = s.mapped
+	*s = t
+	return nil
+}
+
+// consistent returns whether the sizes of vectors, the dense height and the suffix lengths agree with each other,
+// so the lookups of a SuRF unmarshalled from an input with recomputed checksums can't go out of range.
+func (s *SuRF) consistent() bool {
+	ds, ss := &s.ld.suffixes, &s.ls.suffixes
+	if ds.hashSuffixLen != ss.hashSuffixLen || ds.realSuffixLen != ss.realSuffixLen {
+		return false
+	}
+	return s.ls.consistent() && s.ld.consistent(&s.ls)
+}
+
+// checksumWriter counts the bytes written to w, and updates the checksum of them.
+type checksumWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	n   int64
+}
+
+func (cw *checksumWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	_, _ = cw.crc.Write(b[:n])
+	return n, err
+}
@@ -45,7 +45,7 @@ func (ld *loudsDense) Init(builder *Builder) *loudsDense {
 		ld.suffixes.Init(hashLen, realLen, builder.suffixes[:ld.height], numSuffixBitsPerLevel)
 	}
 
-	ld.values.Init(builder.values[:ld.height], builder.valueSize)
+	builder.initValues(&ld.values, 0, ld.height)
 	ld.prefixVec.Init(builder.hasPrefix[:ld.height], builder.nodeCounts[:ld.height], builder.prefixes[:ld.height])
 
 	return ld
@@ -96,29 +96,30 @@ func (ld *loudsDense) MarshalSize() int64 {
 }
 
 func (ld *loudsDense) rawMarshalSize() int64 {
-	return 4 + ld.labelVec.MarshalSize() + ld.hasChildVec.MarshalSize() + ld.isPrefixVec.MarshalSize() + ld.suffixes.MarshalSize() + ld.prefixVec.MarshalSize()
+	return 8 + ld.labelVec.MarshalSize() + ld.hasChildVec.MarshalSize() + ld.isPrefixVec.MarshalSize() + ld.suffixes.MarshalSize() + ld.prefixVec.MarshalSize()
 }
 
-func (ld *loudsDense) WriteTo(w io.Writer) error {
-	var bs [4]byte
+func (ld *loudsDense) writeTo(w io.Writer) error {
+	// the height is padded to 8 bytes to keep vectors aligned.
+	var bs [8]byte
 	endian.PutUint32(bs[:], ld.height)
 
 	if _, err := w.Write(bs[:]); err != nil {
 		return err
 	}
-	if err := ld.labelVec.WriteTo(w); err != nil {
+	if err := ld.labelVec.writeTo(w); err != nil {
 		return err
 	}
-	if err := ld.hasChildVec.WriteTo(w); err != nil {
+	if err := ld.hasChildVec.writeTo(w); err != nil {
 		return err
 	}
-	if err := ld.isPrefixVec.WriteTo(w); err != nil {
+	if err := ld.isPrefixVec.writeTo(w); err != nil {
 		return err
 	}
-	if err := ld.suffixes.WriteTo(w); err != nil {
+	if err := ld.suffixes.writeTo(w); err != nil {
 		return err
 	}
-	if err := ld.prefixVec.WriteTo(w); err != nil {
+	if err := ld.prefixVec.writeTo(w); err != nil {
 		return err
 	}
 
@@ -128,17 +129,53 @@ func (ld *loudsDense) WriteTo(w io.Writer) error {
 	return err
 }
 
-func (ld *loudsDense) Unmarshal(buf []byte) []byte {
-	ld.height = endian.Uint32(buf)
-	buf1 := buf[4:]
-	buf1 = ld.labelVec.Unmarshal(buf1)
-	buf1 = ld.hasChildVec.Unmarshal(buf1)
-	buf1 = ld.isPrefixVec.Unmarshal(buf1)
-	buf1 = ld.suffixes.Unmarshal(buf1)
-	buf1 = ld.prefixVec.Unmarshal(buf1)
-
-	sz := align(int64(len(buf) - len(buf1)))
-	return buf[sz:]
+func (ld *loudsDense) Unmarshal(d *decoder) {
+	ld.height = d.uint32()
+	d.uint32()
+	ld.labelVec.Unmarshal(d)
+	ld.hasChildVec.Unmarshal(d)
+	ld.isPrefixVec.Unmarshal(d)
+	ld.suffixes.Unmarshal(d)
+	ld.prefixVec.Unmarshal(d)
+	d.align()
+}
+
+// consistent returns whether the vectors of ld agree with each other and with ls,
+// ls must be consistent. Every level below height must have nodes, and every node of ld must be within them.
+func (ld *loudsDense) consistent(ls *loudsSparse) bool {
+	nodes := ld.labelVec.numBits / denseFanout
+	if ld.labelVec.numBits%denseFanout != 0 || ld.hasChildVec.numBits != ld.labelVec.numBits ||
+		ld.isPrefixVec.numBits != nodes+ls.loudsVec.numOnes || !ld.prefixVec.holds(nodes) {
+		return false
+	}
+	if !ld.labelVec.validLut() || !ld.hasChildVec.validLut() || !ld.isPrefixVec.validLut() {
+		return false
+	}
+	for i, w := range ld.hasChildVec.bits {
+		if w&^ld.labelVec.bits[i] != 0 {
+			return false
+		}
+	}
+
+	children := ld.hasChildVec.ones()
+	if ls.denseNodeCount != nodes || ls.denseChildCount != children {
+		return false
+	}
+	var first, levelNodes uint32 = 0, 1
+	for level := uint32(0); level < ld.height; level++ {
+		if levelNodes == 0 || levelNodes > nodes-first {
+			return false
+		}
+		next := first + levelNodes
+		levelNodes = ld.hasChildVec.rankBefore(next*denseFanout) - ld.hasChildVec.rankBefore(first*denseFanout)
+		first = next
+	}
+	if first != nodes {
+		return false
+	}
+
+	leaves := ld.labelVec.ones() - children + ld.isPrefixVec.ones()
+	return ld.suffixes.holds(leaves) && ld.values.holds(leaves)
 }
 
 func (ld *loudsDense) childNodeID(pos uint32) uint32 {
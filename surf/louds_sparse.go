@@ -51,7 +51,7 @@ func (ls *loudsSparse) Init(builder *Builder) *loudsSparse {
 		ls.suffixes.Init(hashLen, realLen, builder.suffixes[ls.startLevel:], numSuffixBitsPerLevel)
 	}
 
-	ls.values.Init(builder.values[ls.startLevel:], builder.valueSize)
+	builder.initValues(&ls.values, ls.startLevel, ls.height)
 	ls.prefixVec.Init(builder.hasPrefix[ls.startLevel:], builder.nodeCounts[ls.startLevel:], builder.prefixes[ls.startLevel:])
 
 	return ls
@@ -110,7 +110,7 @@ func (ls *loudsSparse) rawMarshalSize() int64 {
 		ls.suffixes.MarshalSize() + ls.prefixVec.MarshalSize()
 }
 
-func (ls *loudsSparse) WriteTo(w io.Writer) error {
+func (ls *loudsSparse) writeTo(w io.Writer) error {
 	var bs [4]byte
 	endian.PutUint32(bs[:], ls.height)
 	if _, err := w.Write(bs[:]); err != nil {
@@ -128,19 +128,19 @@ func (ls *loudsSparse) WriteTo(w io.Writer) error {
 	if _, err := w.Write(bs[:]); err != nil {
 		return err
 	}
-	if err := ls.labelVec.WriteTo(w); err != nil {
+	if err := ls.labelVec.writeTo(w); err != nil {
 		return err
 	}
-	if err := ls.hasChildVec.WriteTo(w); err != nil {
+	if err := ls.hasChildVec.writeTo(w); err != nil {
 		return err
 	}
-	if err := ls.loudsVec.WriteTo(w); err != nil {
+	if err := ls.loudsVec.writeTo(w); err != nil {
 		return err
 	}
-	if err := ls.suffixes.WriteTo(w); err != nil {
+	if err := ls.suffixes.writeTo(w); err != nil {
 		return err
 	}
-	if err := ls.prefixVec.WriteTo(w); err != nil {
+	if err := ls.prefixVec.writeTo(w); err != nil {
 		return err
 	}
 
@@ -150,25 +150,62 @@ func (ls *loudsSparse) WriteTo(w io.Writer) error {
 	return err
 }
 
-func (ls *loudsSparse) Unmarshal(buf []byte) []byte {
-	buf1 := buf
-	ls.height = endian.Uint32(buf1)
-	buf1 = buf1[4:]
-	ls.startLevel = endian.Uint32(buf1)
-	buf1 = buf1[4:]
-	ls.denseNodeCount = endian.Uint32(buf1)
-	buf1 = buf1[4:]
-	ls.denseChildCount = endian.Uint32(buf1)
-	buf1 = buf1[4:]
-
-	buf1 = ls.labelVec.Unmarshal(buf1)
-	buf1 = ls.hasChildVec.Unmarshal(buf1)
-	buf1 = ls.loudsVec.Unmarshal(buf1)
-	buf1 = ls.suffixes.Unmarshal(buf1)
-	buf1 = ls.prefixVec.Unmarshal(buf1)
-
-	sz := align(int64(len(buf) - len(buf1)))
-	return buf[sz:]
+func (ls *loudsSparse) Unmarshal(d *decoder) {
+	ls.height = d.uint32()
+	ls.startLevel = d.uint32()
+	ls.denseNodeCount = d.uint32()
+	ls.denseChildCount = d.uint32()
+	if ls.startLevel > ls.height {
+		d.fail()
+	}
+
+	ls.labelVec.Unmarshal(d)
+	ls.hasChildVec.Unmarshal(d)
+	ls.loudsVec.Unmarshal(d)
+	ls.suffixes.Unmarshal(d)
+	ls.prefixVec.Unmarshal(d)
+	d.align()
+}
+
+// consistent returns whether the vectors of ls agree with each other.
+// Every level from startLevel to height must have nodes, and every node of ls must be within them.
+func (ls *loudsSparse) consistent() bool {
+	numBits := ls.loudsVec.numBits
+	nodes := ls.loudsVec.numOnes
+	if ls.hasChildVec.numBits != numBits || uint64(len(ls.labelVec.labels)) != uint64(numBits)+1 || !ls.prefixVec.holds(nodes) {
+		return false
+	}
+	if !ls.loudsVec.validLut() || !ls.hasChildVec.validLut() || (numBits != 0 && !ls.loudsVec.IsSet(0)) {
+		return false
+	}
+
+	if ls.denseChildCount+1 < ls.denseNodeCount {
+		return false
+	}
+	// the nodes of a level are numbered from first, which is the rank of their first labels in loudsVec.
+	first, levelNodes := uint32(1), ls.denseChildCount+1-ls.denseNodeCount
+	if ls.height == 0 {
+		// an empty trie has no root.
+		levelNodes = 0
+	}
+	for level := ls.startLevel; level < ls.height; level++ {
+		if levelNodes == 0 || levelNodes > nodes+1-first {
+			return false
+		}
+		next := first + levelNodes
+		start, end := ls.loudsVec.Select(first), numBits
+		if next <= nodes {
+			end = ls.loudsVec.Select(next)
+		}
+		levelNodes = ls.hasChildVec.rankBefore(end) - ls.hasChildVec.rankBefore(start)
+		first = next
+	}
+	if levelNodes != 0 || first != nodes+1 {
+		return false
+	}
+
+	leaves := numBits - ls.hasChildVec.ones()
+	return ls.suffixes.holds(leaves) && ls.values.holds(leaves)
 }
 
 func (ls *loudsSparse) suffixPos(pos uint32) uint32 {
@@ -0,0 +1,80 @@
+package surf
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// OpenOption configures Open.
+type OpenOption func(o *openOptions)
+
+type openOptions struct {
+	verify bool
+}
+
+// VerifyChecksums makes Open check the file against checksums and the consistency of sections like Unmarshal.
+// It reads the whole file, so all pages of the mapping are resident after Open.
+func VerifyChecksums() OpenOption {
+	return func(o *openOptions) {
+		o.verify = true
+	}
+}
+
+// Open maps the serialized SuRF in the file at path into memory, and returns a SuRF backed by the mapping.
+// The vectors and their rank and select lookup tables are used in place, nothing is copied onto heap.
+// Only the header, the bounds of sections and vectors and the offsets of values and prefixes are checked by default,
+// so the pages of bit vectors are read on demand by lookups. The lookups on a file with corrupted bit vectors
+// or lookup tables may return wrong results or panic, use VerifyChecksums if the file is not trusted.
+// The file must not be modified while the SuRF is in use, and the SuRF must be released by Close after use.
+func Open(path string, opts ...OpenOption) (*SuRF, error) {
+	var o openOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < headerSize || int64(int(size)) != size {
+		return nil, ErrInvalidFormat
+	}
+
+	data, err := mmap(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	// the vectors are aligned relative to the start of file, so the mapping must be aligned too.
+	if uintptr(unsafe.Pointer(&data[0]))%8 != 0 {
+		_ = munmap(data)
+		return nil, fmt.Errorf("surf: mapping of %s is not 8 bytes aligned", path)
+	}
+
+	s := new(SuRF)
+	if err := s.unmarshal(data, o.verify); err != nil {
+		_ = munmap(data)
+		return nil, err
+	}
+	s.mapped = data
+	return s, nil
+}
+
+// Close releases the memory mapping of SuRF returned by Open,
+// the SuRF and its iterators must not be used after Close.
+// It does nothing if the SuRF is not returned by Open.
+func (s *SuRF) Close() error {
+	if s.mapped == nil {
+		return nil
+	}
+	err := munmap(s.mapped)
+	*s = SuRF{}
+	return err
+}
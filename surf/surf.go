@@ -1,17 +1,17 @@
 package surf
 
-import (
-	"bytes"
-	"io"
-)
-
 type SuRF struct {
 	ld loudsDense
 	ls loudsSparse
+	// mapped is the memory mapping of the file opened by Open.
+	mapped []byte
 }
 
 // Get returns the values mapped by the key, may return value for keys doesn't in SuRF.
 func (s *SuRF) Get(key []byte) ([]byte, bool) {
+	if s.ld.height == 0 && s.ls.height == 0 {
+		return nil, false
+	}
 	cont, depth, value, ok := s.ld.Get(key)
 	if !ok || cont < 0 {
 		return value, ok
@@ -40,43 +40,6 @@ func (s *SuRF) HasOverlap(start, end []byte, includeEnd bool) bool {
 	return cmp < 0
 }
 
-// MarshalSize returns the size of SuRF after serialization.
-func (s *SuRF) MarshalSize() int64 {
-	return s.ld.MarshalSize() + s.ls.MarshalSize() + s.ld.values.MarshalSize() + s.ls.values.MarshalSize()
-}
-
-// Marshal returns the serialized SuRF.
-func (s *SuRF) Marshal() []byte {
-	w := bytes.NewBuffer(make([]byte, 0, s.MarshalSize()))
-	_ = s.WriteTo(w)
-	return w.Bytes()
-}
-
-// WriteTo serialize SuRF to writer.
-func (s *SuRF) WriteTo(w io.Writer) error {
-	if err := s.ld.WriteTo(w); err != nil {
-		return err
-	}
-	if err := s.ls.WriteTo(w); err != nil {
-		return err
-	}
-	if err := s.ld.values.WriteTo(w); err != nil {
-		return err
-	}
-	if err := s.ls.values.WriteTo(w); err != nil {
-		return err
-	}
-	return nil
-}
-
-// Unmarshal deserialize SuRF from bytes.
-func (s *SuRF) Unmarshal(b []byte) {
-	b = s.ld.Unmarshal(b)
-	b = s.ls.Unmarshal(b)
-	b = s.ld.values.Unmarshal(b)
-	s.ls.values.Unmarshal(b)
-}
-
 // Iterator is iterator of SuRF.
 type Iterator struct {
 	denseIter  denseIter
@@ -2,6 +2,7 @@ package surf
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"encoding/binary"
 	"fmt"
@@ -81,6 +82,39 @@ func BenchmarkSeek(b *testing.B) {
 	})
 }
 
+// BenchmarkAddSharedPrefix measures Add with keys splitting the compressed path of the root repeatedly,
+// every key after the group diverges from the group one byte shallower, so the root is split prefixLen times.
+func BenchmarkAddSharedPrefix(b *testing.B) {
+	const groupSize = 10000
+	for _, prefixLen := range []int{8, 64, 256} {
+		b.Run(fmt.Sprintf("prefixLen=%d", prefixLen), func(b *testing.B) {
+			prefix := bytes.Repeat([]byte{'a'}, prefixLen)
+			keys := make([][]byte, 0, groupSize+prefixLen)
+			for i := 0; i < groupSize; i++ {
+				key := append(append([]byte{}, prefix...), 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(key[prefixLen:], uint32(i))
+				keys = append(keys, key)
+			}
+			for l := prefixLen - 1; l >= 0; l-- {
+				keys = append(keys, append(append([]byte{}, prefix[:l]...), 'b'))
+			}
+			value := make([]byte, 4)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				builder := NewBuilder(4, 0, 0)
+				for _, k := range keys {
+					if err := builder.Add(k, value); err != nil {
+						b.Fatal(err)
+					}
+				}
+				builder.Finish(64)
+			}
+		})
+	}
+}
+
 func buildAndBenchSuRF(b *testing.B, keys, vals [][]byte, run func(t *testing.B, surf *SuRF)) {
 	suffixLens := [][]uint32{
 		{0, 0},
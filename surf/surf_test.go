@@ -2,11 +2,17 @@ package surf
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 	"time"
+	"unsafe"
 
 	"github.com/ngaut/log"
 	"github.com/stretchr/testify/require"
@@ -95,11 +101,350 @@ func TestMarshal(t *testing.T) {
 	s1 := b.Build(keys, vals, 60)
 	var s2 SuRF
 	buf := s1.Marshal()
-	s2.Unmarshal(buf)
+	require.Equal(t, s1.MarshalSize(), int64(len(buf)))
+	require.NoError(t, s2.Unmarshal(buf))
 	s1.checkEquals(t, &s2)
 	newFullSuRFChecker(keys, vals)(t, &s2)
 }
 
+func TestUnmarshalCorrupted(t *testing.T) {
+	keys := genRandomKeys(10, 10, 10)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		vals[i] = bytes.Repeat([]byte{byte(i)}, i%5)
+	}
+	s1 := NewBuilder(0, 4, 4, WithVariableValues()).Build(keys, vals, 30)
+	buf := s1.Marshal()
+
+	var s2 SuRF
+	for i := 0; i < len(buf); i++ {
+		require.Error(t, s2.Unmarshal(buf[:i]))
+	}
+	require.Equal(t, ErrInvalidFormat, s2.Unmarshal(append(buf[:len(buf):len(buf)], 0)))
+
+	corrupted := make([]byte, len(buf))
+	for i := 0; i < len(buf); i++ {
+		copy(corrupted, buf)
+		corrupted[i] ^= 0x10
+		require.Error(t, s2.Unmarshal(corrupted), "corrupt byte %d", i)
+	}
+	copy(corrupted, buf)
+	corrupted[headerSize+100] ^= 1
+	require.Equal(t, ErrChecksumMismatch, s2.Unmarshal(corrupted))
+	require.Equal(t, SuRF{}, s2)
+
+	copy(corrupted, buf)
+	endian.PutUint32(corrupted[4:], formatVersion+1)
+	endian.PutUint32(corrupted[28:], crc32.Checksum(corrupted[:28], crcTable))
+	require.EqualError(t, s2.Unmarshal(corrupted), "surf: unsupported format version 2")
+
+	require.NoError(t, s2.Unmarshal(buf))
+	newFullSuRFChecker(keys, vals)(t, &s2)
+}
+
+func TestUnmarshalCorruptedOffsets(t *testing.T) {
+	keys := [][]byte{[]byte("a"), []byte("b1234567x"), []byte("b1234567y"), []byte("c")}
+	vals := [][]byte{{1}, {2, 2}, {}, {4, 4, 4}}
+	s1 := NewBuilder(0, 0, 0, WithVariableValues()).Build(keys, vals, 0)
+	require.NotEmpty(t, s1.ls.prefixVec.prefixOffsets)
+	buf := s1.Marshal()
+
+	var s2 SuRF
+	for i := 0; i < len(buf); i++ {
+		require.Error(t, s2.unmarshal(buf[:i], false))
+	}
+
+	// the offsets are checked even if the checksums are not verified.
+	lsBody := headerSize + sectionOverhead + int(s1.ld.MarshalSize()) + 8
+	prefixVec := &s1.ls.prefixVec
+	prefixOffsets := lsBody + int(s1.ls.MarshalSize()-prefixVec.MarshalSize()+prefixVec.hasPrefixVec.MarshalSize()) + 8
+	ldValuesBody := lsBody + int(s1.ls.MarshalSize()) + sectionOverhead
+	valueOffsets := ldValuesBody + int(s1.ld.values.MarshalSize()) + sectionOverhead + 16
+	require.Equal(t, prefixVec.prefixOffsets, bytesToU32Slice(buf[prefixOffsets:prefixOffsets+4*len(prefixVec.prefixOffsets)]))
+	require.Equal(t, s1.ls.values.offsets, bytesToU32Slice(buf[valueOffsets:valueOffsets+4*len(s1.ls.values.offsets)]))
+
+	corrupted := make([]byte, len(buf))
+	for i := range prefixVec.prefixOffsets {
+		copy(corrupted, buf)
+		corrupted[prefixOffsets+4*i+3] ^= 0x80
+		require.Equal(t, ErrInvalidFormat, s2.unmarshal(corrupted, false), "corrupt prefix offset %d", i)
+	}
+	for i := range s1.ls.values.offsets {
+		copy(corrupted, buf)
+		corrupted[valueOffsets+4*i+3] ^= 0x80
+		require.Equal(t, ErrInvalidFormat, s2.unmarshal(corrupted, false), "corrupt value offset %d", i)
+	}
+	require.Equal(t, SuRF{}, s2)
+
+	require.NoError(t, s2.unmarshal(buf, false))
+	newFullSuRFChecker(keys, vals)(t, &s2)
+}
+
+func TestUnmarshalInconsistent(t *testing.T) {
+	keys := genRandomKeys(10, 10, 10)
+	vals := genSeqVals(len(keys))
+	s1 := NewBuilder(4, 4, 4).Build(keys, vals, 1000)
+	require.NotZero(t, s1.ld.height)
+	buf := s1.Marshal()
+	ldBody := headerSize + 8
+	lsBody := ldBody + int(s1.ld.MarshalSize()) + sectionOverhead
+
+	var s2 SuRF
+	corrupted := make([]byte, len(buf))
+	check := func(msg string) {
+		fixChecksums(corrupted)
+		require.Equal(t, ErrCorrupted, s2.Unmarshal(corrupted), msg)
+		require.Equal(t, SuRF{}, s2)
+	}
+
+	copy(corrupted, buf)
+	endian.PutUint32(corrupted[20:], s1.ld.height-1)
+	endian.PutUint32(corrupted[ldBody:], s1.ld.height-1)
+	endian.PutUint32(corrupted[lsBody+4:], s1.ld.height-1)
+	check("dense height")
+
+	copy(corrupted, buf)
+	off := lsBody + 16 + int(s1.ls.labelVec.MarshalSize()+s1.ls.hasChildVec.MarshalSize()+s1.ls.loudsVec.MarshalSize())
+	endian.PutUint32(corrupted[off+8:], s1.ls.suffixes.realSuffixLen+1)
+	check("suffix length")
+
+	copy(corrupted, buf)
+	off = lsBody + 16 + int(s1.ls.labelVec.MarshalSize()) + 8
+	corrupted[off] ^= 1
+	check("rank lookup table")
+
+	// the sections of another SuRF with the same dense height have valid checksums.
+	var s3 *SuRF
+	for n := len(keys) - 1; n > 0; n-- {
+		s3 = NewBuilder(4, 4, 4).Build(keys[:n], vals[:n], 1000)
+		if s3.ld.height == s1.ld.height {
+			break
+		}
+	}
+	require.Equal(t, s1.ld.height, s3.ld.height)
+	other := s3.Marshal()
+	other = other[len(other)-int(s3.ld.values.MarshalSize()+s3.ls.values.MarshalSize()+2*sectionOverhead):]
+	corrupted = append([]byte{}, buf[:len(buf)-int(s1.ld.values.MarshalSize()+s1.ls.values.MarshalSize()+2*sectionOverhead)]...)
+	corrupted = append(corrupted, other...)
+	require.Equal(t, ErrCorrupted, s2.Unmarshal(corrupted), "values")
+	require.Equal(t, SuRF{}, s2)
+
+	require.NoError(t, s2.Unmarshal(buf))
+	newFullSuRFChecker(keys, vals)(t, &s2)
+}
+
+// fixChecksums recomputes the checksums of a serialized SuRF.
+func fixChecksums(b []byte) {
+	endian.PutUint32(b[28:], crc32.Checksum(b[:28], crcTable))
+	for off := headerSize; off < len(b); {
+		size := int(endian.Uint64(b[off:]))
+		body := b[off+8 : off+8+size]
+		endian.PutUint64(b[off+8+size:], uint64(crc32.Checksum(body, crcTable)))
+		off += sectionOverhead + size
+	}
+}
+
+func TestOpen(t *testing.T) {
+	keys := genRandomKeys(30, 20, 30)
+	vals := genSeqVals(len(keys))
+	s1 := NewBuilder(4, 8, 8).Build(keys, vals, 30)
+
+	path := filepath.Join(t.TempDir(), "surf")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	n, err := s1.WriteTo(f)
+	require.NoError(t, err)
+	require.Equal(t, s1.MarshalSize(), n)
+	require.NoError(t, f.Close())
+
+	s2, err := Open(path, VerifyChecksums())
+	require.NoError(t, err)
+	s1.checkEquals(t, s2)
+	require.NoError(t, s2.Close())
+	s2, err = Open(path)
+	require.NoError(t, err)
+	s1.checkEquals(t, s2)
+	newFullSuRFChecker(keys, vals)(t, s2)
+
+	// lookup tables are used in place.
+	start := uintptr(unsafe.Pointer(&s2.mapped[0]))
+	end := start + uintptr(len(s2.mapped))
+	for _, p := range []unsafe.Pointer{
+		unsafe.Pointer(&s2.ld.labelVec.rankLut[0]),
+		unsafe.Pointer(&s2.ls.hasChildVec.rankLut[0]),
+		unsafe.Pointer(&s2.ls.loudsVec.selectLut[0]),
+		unsafe.Pointer(&s2.ls.labelVec.labels[0]),
+	} {
+		require.True(t, uintptr(p) >= start && uintptr(p) < end)
+	}
+	require.NoError(t, s2.Close())
+	_, ok := s2.Get(keys[0])
+	require.False(t, ok)
+	require.NoError(t, s2.Close())
+
+	// the bodies of sections are only checked with VerifyChecksums.
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-sectionOverhead-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	s3, err := Open(path)
+	require.NoError(t, err)
+	require.NoError(t, s3.Close())
+	_, err = Open(path, VerifyChecksums())
+	require.Equal(t, ErrChecksumMismatch, err)
+
+	require.NoError(t, os.Truncate(path, n-1))
+	_, err = Open(path)
+	require.Equal(t, ErrInvalidFormat, err)
+	_, err = Open(path, VerifyChecksums())
+	require.Equal(t, ErrInvalidFormat, err)
+	_, err = Open(path + ".missing")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestVariableValues(t *testing.T) {
+	keys := genRandomKeys(30, 20, 30)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		vals[i] = bytes.Repeat([]byte{byte(i)}, i%20)
+	}
+	for _, sl := range [][]uint32{{0, 0}, {4, 0}, {0, 8}, {8, 8}} {
+		for _, bitsPerKey := range []int{0, 60, 1000} {
+			b := NewBuilder(0, sl[0], sl[1], WithVariableValues())
+			s1 := b.Build(keys, vals, bitsPerKey)
+			newFullSuRFChecker(keys, vals)(t, s1)
+
+			var s2 SuRF
+			require.NoError(t, s2.Unmarshal(s1.Marshal()))
+			s1.checkEquals(t, &s2)
+			newFullSuRFChecker(keys, vals)(t, &s2)
+		}
+	}
+}
+
+func TestStreamBuild(t *testing.T) {
+	keySets := [][][]byte{
+		{{1}, {1, 1}, {1, 1, 1}, {1, 1, 1, 1}, {2}, {2, 2}, {2, 2, 2}},
+		{{1, 1, 1}, {1, 1, 1, 2, 2}, {1, 1, 1, 2, 2, 2}, {1, 1, 1, 2, 2, 3}, {2, 1, 3}, {2, 2, 3}},
+		{{1, 2, 3, 4}, {1, 2, 3, 5}, {1, 2, 4}, {1, 3}, {1, 3, 1}, {1, 4}},
+		{{0}, {1, 1, 1, 1}, {1, 1, 1, 2}, {1, 1, 2}, {1, 2}, {2, 2, 2, 2}},
+		{{1, 1, 1}},
+		genRandomKeys(100, 10, 10),
+		genRandomKeys(10, 20, 30),
+		genSharedPrefixKeys(20, 8),
+		append(genTableKeys(300), []byte{'t', 0, 0, 1}, []byte{'u'}),
+	}
+	for _, keys := range keySets {
+		vals := genSeqVals(len(keys))
+		for _, sl := range [][]uint32{{0, 0}, {4, 0}, {0, 13}, {8, 8}} {
+			for _, bitsPerKey := range []int{0, 30, 1000} {
+				s1 := NewBuilder(4, sl[0], sl[1]).Build(keys, vals, bitsPerKey)
+
+				b := NewBuilder(4, sl[0], sl[1])
+				for i := range keys {
+					require.NoError(t, b.Add(keys[i], vals[i]))
+				}
+				s2 := b.Finish(bitsPerKey)
+				s1.checkEquals(t, s2)
+				newFullSuRFChecker(keys, vals)(t, s2)
+			}
+		}
+
+		varVals := make([][]byte, len(keys))
+		for i := range varVals {
+			varVals[i] = bytes.Repeat([]byte{byte(i)}, i%7)
+		}
+		b := NewBuilder(0, 4, 4, WithVariableValues())
+		for i := range keys {
+			require.NoError(t, b.Add(keys[i], varVals[i]))
+		}
+		newFullSuRFChecker(keys, varVals)(t, b.Finish(30))
+	}
+
+	// the compressed paths of root and the node of second table are split many times,
+	// but the finished nodes are written into their levels as they finish, in a few chunks.
+	twoTables := [][]byte{[]byte("t1_r00000000")}
+	for i := 0; i < 100000; i++ {
+		twoTables = append(twoTables, []byte(fmt.Sprintf("t2_r%08d", i)))
+	}
+	for _, keys := range [][][]byte{genTableKeys(20000), twoTables} {
+		vals := genSeqVals(len(keys))
+		b := NewBuilder(4, 0, 0)
+		var maxLevels, maxUnwritten int
+		for i := range keys {
+			require.NoError(t, b.Add(keys[i], vals[i]))
+			if b.treeHeight() > maxLevels {
+				maxLevels = b.treeHeight()
+			}
+			if i%10000 != 0 {
+				continue
+			}
+			// besides the unfinished nodes on the path of last key, only the nodes
+			// added by the pending key are not written yet.
+			built := NewBuilder(4, 0, 0)
+			built.Build(keys[:i+1], vals[:i+1], 30)
+			unwritten := -len(b.frames)
+			for l := range built.nodeCounts {
+				unwritten += int(built.nodeCounts[l])
+			}
+			for l := range b.nodeCounts {
+				unwritten -= int(b.nodeCounts[l])
+			}
+			if unwritten > maxUnwritten {
+				maxUnwritten = unwritten
+			}
+		}
+		require.True(t, maxLevels <= 16, "%d levels", maxLevels)
+		require.True(t, maxUnwritten <= 2, "%d nodes unwritten", maxUnwritten)
+		NewBuilder(4, 0, 0).Build(keys, vals, 30).checkEquals(t, b.Finish(30))
+	}
+
+	empty := NewBuilder(4, 0, 0).Finish(30)
+	_, ok := empty.Get([]byte{1})
+	require.False(t, ok)
+	it := empty.NewIterator()
+	it.SeekToFirst()
+	require.False(t, it.Valid())
+}
+
+func TestBuildValidation(t *testing.T) {
+	keys := [][]byte{{1}, {2}, {2}, {3}, {3}, {3}, {4}}
+	vals := genSeqVals(len(keys))
+
+	_, err := NewBuilder(4, 0, 0).BuildChecked(keys, vals[:3], 0)
+	require.True(t, errors.Is(err, ErrLengthMismatch))
+	_, err = NewBuilder(4, 0, 0).BuildChecked(keys, vals, 0)
+	require.True(t, errors.Is(err, ErrDuplicateKey))
+	_, err = NewBuilder(4, 0, 0).BuildChecked([][]byte{{1}, {3}, {2}}, vals[:3], 0)
+	require.True(t, errors.Is(err, ErrUnsortedKeys))
+	_, err = NewBuilder(4, 0, 0).BuildChecked(keys[:2], [][]byte{{1, 2, 3, 4}, {1, 2}}, 0)
+	require.True(t, errors.Is(err, ErrShortValue))
+	_, err = NewBuilder(0, 0, 0, WithVariableValues()).BuildChecked(keys[:2], [][]byte{{1, 2, 3, 4}, {}}, 0)
+	require.NoError(t, err)
+	require.Panics(t, func() { NewBuilder(4, 0, 0).Build(keys, vals, 0) })
+
+	uniqKeys := [][]byte{{1}, {2}, {3}, {4}}
+	uniqVals := [][]byte{vals[0], vals[2], vals[5], vals[6]}
+	s := NewBuilder(4, 4, 4, WithDeduplicate()).Build(keys, vals, 0)
+	newFullSuRFChecker(uniqKeys, uniqVals)(t, s)
+	require.Equal(t, []byte{2}, keys[2])
+	require.Equal(t, genSeqVals(len(keys)), vals)
+
+	b := NewBuilder(4, 0, 0)
+	require.NoError(t, b.Add([]byte{1}, vals[0]))
+	require.True(t, errors.Is(b.Add([]byte{1}, vals[1]), ErrDuplicateKey))
+	require.True(t, errors.Is(b.Add([]byte{0}, vals[1]), ErrUnsortedKeys))
+	require.True(t, errors.Is(b.Add([]byte{2}, []byte{1}), ErrShortValue))
+	require.NoError(t, b.Add([]byte{2}, vals[1]))
+	newFullSuRFChecker(keys[:2], vals[:2])(t, b.Finish(0))
+
+	b = NewBuilder(4, 4, 4, WithDeduplicate())
+	for i := range keys {
+		require.NoError(t, b.Add(keys[i], vals[i]))
+	}
+	newFullSuRFChecker(uniqKeys, uniqVals)(t, b.Finish(0))
+}
+
 func splitKeys(keys [][]byte) (a, aIdx, b [][]byte) {
 	a = keys[:0]
 	b = make([][]byte, 0, len(keys)/2)
@@ -205,6 +550,7 @@ func buildAndCheckSuRF(t *testing.T, keys, vals [][]byte, checker func(t *testin
 
 func newFullSuRFChecker(keys, vals [][]byte) func(t *testing.T, surf *SuRF) {
 	return func(t *testing.T, surf *SuRF) {
+		require.True(t, surf.consistent())
 		for i, k := range keys {
 			val, ok := surf.Get(k)
 			require.True(t, ok)
@@ -274,6 +620,16 @@ func (v *suffixVector) checkEquals(t *testing.T, o *suffixVector) {
 func (v *valueVector) checkEquals(t *testing.T, o *valueVector) {
 	require.Equal(t, v.bytes, o.bytes)
 	require.Equal(t, v.valueSize, o.valueSize)
+	require.Equal(t, v.offsets, o.offsets)
+}
+
+func (v *prefixVector) checkEquals(t *testing.T, o *prefixVector) {
+	v.hasPrefixVec.checkEquals(t, &o.hasPrefixVec.rankVector)
+	require.Equal(t, len(v.prefixOffsets), len(o.prefixOffsets))
+	for i := range v.prefixOffsets {
+		require.Equal(t, v.prefixOffsets[i], o.prefixOffsets[i])
+	}
+	require.True(t, bytes.Equal(v.prefixData, o.prefixData))
 }
 
 func (v *labelVector) checkEquals(t *testing.T, o *labelVector) {
@@ -287,6 +643,7 @@ func (ld *loudsDense) checkEquals(t *testing.T, o *loudsDense) {
 	ld.isPrefixVec.checkEquals(t, &o.isPrefixVec.rankVector)
 	ld.suffixes.checkEquals(t, &o.suffixes)
 	ld.values.checkEquals(t, &o.values)
+	ld.prefixVec.checkEquals(t, &o.prefixVec)
 }
 
 func (ls *loudsSparse) checkEquals(t *testing.T, o *loudsSparse) {
@@ -299,9 +656,38 @@ func (ls *loudsSparse) checkEquals(t *testing.T, o *loudsSparse) {
 	ls.loudsVec.checkEquals(t, &o.loudsVec)
 	ls.suffixes.checkEquals(t, &o.suffixes)
 	ls.values.checkEquals(t, &o.values)
+	ls.prefixVec.checkEquals(t, &o.prefixVec)
 }
 
 func (s *SuRF) checkEquals(t *testing.T, o *SuRF) {
 	s.ld.checkEquals(t, &o.ld)
 	s.ls.checkEquals(t, &o.ls)
 }
+
+// genTableKeys returns the keys of n rows like the record keys of a table, every key has
+// the same table prefix and a row id, followed by a column of 4 values.
+func genTableKeys(n int) [][]byte {
+	keys := make([][]byte, 0, n*4)
+	for id := 0; id < n; id++ {
+		for c := 0; c < 4; c++ {
+			key := []byte{'t', 0, 0, 0, 0, 0, 0, 0, '_', 'r', byte(c)}
+			binary.BigEndian.PutUint32(key[4:], uint32(id))
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// genSharedPrefixKeys returns n keys sharing a prefix of prefixLen bytes, followed by
+// prefixLen keys diverging from the prefix one byte shallower each.
+func genSharedPrefixKeys(n, prefixLen int) [][]byte {
+	prefix := bytes.Repeat([]byte{'a'}, prefixLen)
+	keys := make([][]byte, 0, n+prefixLen)
+	for i := 0; i < n; i++ {
+		keys = append(keys, append(append([]byte{}, prefix...), byte(i)))
+	}
+	for l := prefixLen - 1; l >= 0; l-- {
+		keys = append(keys, append(append([]byte{}, prefix[:l]...), 'b'))
+	}
+	return keys
+}